@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/run"
 	"github.com/pkg/errors"
 	"github.com/ppanyukov/thanos-data-gen/pkg/blockgen"
+	"github.com/ppanyukov/thanos-data-gen/pkg/objstore"
+	"github.com/prometheus/prometheus/tsdb/labels"
 	"gopkg.in/alecthomas/kingpin.v2"
 	log2 "log"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -20,28 +24,187 @@ const (
 // Add your own if needed, will make it work nicer later.
 var blockgenProfiles = map[string]blockgenProfile{
 	defaultProfileName: {
-		name:      defaultProfileName,
-		outDir:    os.ExpandEnv("${HOME}/zzz-prom-data/zzz"),
-		deleteDir: true,
-		genConfig: blockgen.GeneratorConfig{
+		Name:      defaultProfileName,
+		OutDir:    os.ExpandEnv("${HOME}/zzz-prom-data/zzz"),
+		DeleteDir: true,
+		GenConfig: blockgen.GeneratorConfig{
 			StartTime:      time.Date(2019, time.September, 30, 0, 0, 0, 0, time.Local),
 			SampleInterval: 15 * time.Second,
 			FlushInterval:  2 * time.Hour,
 			Retention:      10 * time.Hour,
 		},
-		valConfig: blockgen.ValProviderConfig{
+		ValConfig: &blockgen.ValProviderConfig{
 			MetricCount: 200,
 			TargetCount: 100,
 		},
 	},
 }
 
+// blockgenProfile describes one generation run. At least one of the
+// value provider configs must be set, all of them are used if more.
 type blockgenProfile struct {
-	name      string
-	outDir    string
-	deleteDir bool
-	genConfig blockgen.GeneratorConfig
-	valConfig blockgen.ValProviderConfig
+	Name      string                   `yaml:"name"`
+	OutDir    string                   `yaml:"outDir"`
+	DeleteDir bool                     `yaml:"deleteDir"`
+	GenConfig blockgen.GeneratorConfig `yaml:"generator"`
+
+	// WriterConfig.Dir is always OutDir.
+	WriterConfig blockgen.BlockWriterConfig `yaml:"writer"`
+
+	// StreamingWriter makes blocks with `blockgen.NewStreamingBlockWriter`,
+	// which is needed for large blocks, e.g. 14d.
+	StreamingWriter bool `yaml:"streamingWriter"`
+
+	// Downsample also writes downsampled blocks next to the raw ones.
+	Downsample *blockgen.DownsampleConfig `yaml:"downsample"`
+
+	// Faults injects invalid samples into every block writer, see
+	// `WriterConfig.InvalidSamples` for what the writers do with them.
+	Faults *blockgen.FaultConfig `yaml:"faults"`
+
+	// RemoteWrite sends the samples to remote write endpoint instead of
+	// writing blocks, or along with them, see Writers.
+	RemoteWrite *blockgen.RemoteWriteConfig `yaml:"remoteWrite"`
+
+	// OpenMetrics writes the samples into OpenMetrics text files instead
+	// of blocks, or along with them. OpenMetrics.Dir is OutDir if not set.
+	OpenMetrics *blockgen.OpenMetricsConfig `yaml:"openMetrics"`
+
+	// Export writes the samples into CSV or Parquet files instead of
+	// blocks, or along with them. Export.Dir is OutDir if not set.
+	Export *blockgen.ExportConfig `yaml:"export"`
+
+	// Writers writes into all these writers at once, e.g. blocks and
+	// remoteWrite. Names are blocks, remoteWrite, openMetrics and export,
+	// all but blocks configured by the fields above. If empty, the only
+	// one configured is used, blocks by default.
+	Writers []blockgen.MultiWriterConfig `yaml:"writers"`
+
+	// Replication makes one block stream for each replica in subdirectories of OutDir.
+	Replication *blockgen.ReplicationConfig `yaml:"replication"`
+
+	ValConfig     *blockgen.ValProviderConfig     `yaml:"valProvider"`
+	RandValConfig *blockgen.RandValProviderConfig `yaml:"randValProvider"`
+
+	HistogramConfigs []blockgen.HistogramProviderConfig `yaml:"histogramProviders"`
+	SummaryConfigs   []blockgen.SummaryProviderConfig   `yaml:"summaryProviders"`
+
+	// K8sLabels replaces `target` label of all value providers if set.
+	// The targetCount of the providers is then ignored.
+	K8sLabels *blockgen.K8sSchemaConfig `yaml:"k8sLabels"`
+
+	// Churn is applied to all value providers if set. With K8sLabels,
+	// its targetLabel is pod by default.
+	Churn *blockgen.ChurnConfig `yaml:"churn"`
+}
+
+// valProviders creates value providers configured in the profile.
+func (p *blockgenProfile) valProviders() ([]blockgen.ValProvider, error) {
+	var res []blockgen.ValProvider
+
+	// targets replace targetCount of providers if set.
+	var targets []labels.Labels
+	targetCount := func(n int) int {
+		if targets != nil {
+			return len(targets)
+		}
+		return n
+	}
+
+	if p.K8sLabels != nil {
+		t, err := p.K8sLabels.Targets()
+		if err != nil {
+			return nil, errors.Wrap(err, "k8sLabels")
+		}
+		targets = t
+	}
+
+	if p.ValConfig != nil {
+		c := *p.ValConfig
+		c.TargetCount = targetCount(c.TargetCount)
+		res = append(res, blockgen.NewValProvider(c))
+	}
+
+	if p.RandValConfig != nil {
+		c := *p.RandValConfig
+		c.TargetCount = targetCount(c.TargetCount)
+		valProvider, err := blockgen.NewRandValProvider(c)
+		if err != nil {
+			return nil, errors.Wrap(err, "randValProvider")
+		}
+		res = append(res, valProvider)
+	}
+
+	for _, c := range p.HistogramConfigs {
+		c.TargetCount = targetCount(c.TargetCount)
+		valProvider, err := blockgen.NewHistogramProvider(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "histogramProvider %s", c.Name)
+		}
+		res = append(res, valProvider)
+	}
+
+	for _, c := range p.SummaryConfigs {
+		c.TargetCount = targetCount(c.TargetCount)
+		valProvider, err := blockgen.NewSummaryProvider(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "summaryProvider %s", c.Name)
+		}
+		res = append(res, valProvider)
+	}
+
+	if len(res) == 0 {
+		return nil, errors.New("no value providers configured")
+	}
+
+	if targets != nil {
+		for i := range res {
+			res[i] = blockgen.NewLabelSchemaProvider(res[i], targets)
+		}
+	}
+
+	if p.Churn != nil {
+		churnConfig := *p.Churn
+		if churnConfig.SampleInterval == 0 {
+			churnConfig.SampleInterval = p.GenConfig.SampleInterval
+		}
+
+		// There is no target label with k8sLabels, pods are the targets.
+		if targets != nil && churnConfig.TargetLabel == "" {
+			churnConfig.TargetLabel = "pod"
+		}
+
+		for i := range res {
+			// Different seeds so that providers don't churn in sync.
+			churnConfig.Seed = p.Churn.Seed + int64(i)
+
+			valProvider, err := blockgen.NewChurnProvider(res[i], churnConfig)
+			if err != nil {
+				return nil, errors.Wrap(err, "churn")
+			}
+			res[i] = valProvider
+		}
+	}
+
+	return res, nil
+}
+
+// seriesPerSample returns the number of series the value providers of
+// the profile write at the first sample.
+func (p *blockgenProfile) seriesPerSample() (int, error) {
+	valProviders, err := p.valProviders()
+	if err != nil {
+		return 0, errors.Wrap(err, "valProviders")
+	}
+
+	res := 0
+	for _, valProvider := range valProviders {
+		for range valProvider.Next() {
+			res++
+		}
+	}
+
+	return res, nil
 }
 
 // Hacky hacky script to generate TSDB
@@ -49,44 +212,314 @@ func registerBlockgen(m map[string]setupFunc, app *kingpin.Application) {
 	cmd := app.Command("blockgen", "Generates Prometheus TSDB blocks.")
 
 	profileName := cmd.Flag("profile.name", "The name of the profile to use.").Required().String()
+	profileFiles := cmd.Flag("profile.file", "YAML file with additional profiles. Can be specified multiple times.").ExistingFiles()
+	objStoreConfigFile := cmd.Flag("objstore.config-file", "Thanos-style bucket config YAML file. If set, blocks are uploaded to the bucket after every flush.").ExistingFile()
+	deleteLocal := cmd.Flag("delete-local", "Delete local copy of blocks after verified upload.").Bool()
+	workers := cmd.Flag("workers", "Number of blocks to generate concurrently. Overrides the profile if set.").Int()
+	progressInterval := cmd.Flag("progress.interval", "How often to print generation progress, 0 to disable.").Default("10s").Duration()
+	progressFile := cmd.Flag("progress.file", "File to append generation progress to as JSON lines, at progress.interval and once at the end.").String()
+	httpAddress := cmd.Flag("http-address", "Listen host:port for HTTP endpoint serving generator metrics on /metrics. Disabled if not set.").String()
 
 	// TODO(bwplotka): Consider mode in which it generates the data only if empty work dir.
 	m["blockgen"] = func(g *run.Group, logger log.Logger) error {
+		var metrics *blockgen.BlockWriterMetrics
+		if *httpAddress != "" {
+			reg := newMetricsRegistry()
+			metrics = blockgen.NewBlockWriterMetrics(reg)
+
+			if err := addHTTPServer(g, logger, reg, *httpAddress); err != nil {
+				return err
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
-			profile, found := blockgenProfiles[*profileName]
+			profiles, err := loadProfileFiles(blockgenProfiles, *profileFiles...)
+			if err != nil {
+				return errors.Wrap(err, "loadProfileFiles")
+			}
+
+			profile, found := profiles[*profileName]
 			if !found {
 				return fmt.Errorf("profile with name '%s' not found", *profileName)
 			}
 
-			if err := execBlockgenProfile(profile); err != nil {
+			if *workers > 0 {
+				profile.GenConfig.Workers = *workers
+			}
+
+			opts := execOptions{
+				deleteLocal:      *deleteLocal,
+				metrics:          metrics,
+				progressInterval: *progressInterval,
+				progressFile:     *progressFile,
+			}
+
+			if *objStoreConfigFile != "" {
+				opts.bkt, err = objstore.NewBucketFromFile(logger, *objStoreConfigFile)
+				if err != nil {
+					return errors.Wrap(err, "objstore.NewBucketFromFile")
+				}
+				defer opts.bkt.Close()
+			}
+
+			if err := execBlockgenProfile(ctx, logger, profile, opts); err != nil {
 				return errors.Wrap(err, "execBlockgenProfile")
 			}
 
 			log2.Printf("GREAT SUCCESS!")
-			log2.Printf("Data generated into: %s", profile.outDir)
+			if profile.RemoteWrite == nil {
+				log2.Printf("Data generated into: %s", profile.OutDir)
+			}
 			return nil
-		}, func(error) {})
+		}, func(error) {
+			// Generation stops between samples and discards the unflushed data.
+			cancel()
+		})
 		return nil
 	}
 }
 
-func execBlockgenProfile(p blockgenProfile) error {
+// execOptions are the command line options of blockgen which are not
+// part of the profile.
+type execOptions struct {
+	// bkt is the bucket to upload blocks to, nil for no upload.
+	bkt         objstore.Bucket
+	deleteLocal bool
+
+	// metrics are given to block writers, nil for no metrics.
+	metrics *blockgen.BlockWriterMetrics
+
+	progressInterval time.Duration
+	progressFile     string
+}
+
+// execBlockgenProfile generates the data for the profile until done or
+// the context is cancelled.
+func execBlockgenProfile(ctx context.Context, logger log.Logger, p blockgenProfile, opts execOptions) (err error) {
 	// remove dir if asked to do so
-	if p.deleteDir {
-		log2.Printf("Deleting outDir %s", p.outDir)
-		if err := os.RemoveAll(p.outDir); err != nil {
-			return errors.Wrapf(err, "delete dir %s", p.outDir)
+	if p.DeleteDir {
+		log2.Printf("Deleting outDir %s", p.OutDir)
+		if err := os.RemoveAll(p.OutDir); err != nil {
+			return errors.Wrapf(err, "delete dir %s", p.OutDir)
 		}
 	}
 
-	writer, err := blockgen.NewBlockWriter(p.outDir)
+	newWriter := func() (blockgen.Writer, error) {
+		return newProfileWriter(ctx, logger, p, opts)
+	}
+
+	generator := blockgen.NewGeneratorWithConfig(p.GenConfig)
+
+	progress, err := startProgressReporter(p.Name, generator, opts.progressInterval, opts.progressFile)
 	if err != nil {
-		return errors.Wrap(err, "blockgen.NewBlockWriter")
+		return err
+	}
+	defer func() {
+		if perr := progress.Stop(); perr != nil && err == nil {
+			err = perr
+		}
+	}()
+
+	if len(p.Writers) > 0 {
+		log2.Printf("Writing to writers: %s", strings.Join(p.writerNames(), ", "))
+	} else if p.RemoteWrite != nil {
+		log2.Printf("Writing to remote write URL: %s", p.RemoteWrite.URL)
+	} else {
+		log2.Printf("Writing to dir: %s", p.OutDir)
+	}
+	if p.GenConfig.Workers > 1 {
+		log2.Printf("Using %d workers", p.GenConfig.Workers)
+		return generator.GenerateParallel(ctx, newWriter, p.valProviders)
+	}
+
+	writer, err := newWriter()
+	if err != nil {
+		return err
+	}
+
+	valProviders, err := p.valProviders()
+	if err != nil {
+		return errors.Wrap(err, "valProviders")
+	}
+
+	return generator.GenerateContext(ctx, writer, valProviders...)
+}
+
+// Names of the writers in `blockgenProfile.Writers`.
+const (
+	blocksWriterName      = "blocks"
+	remoteWriteWriterName = "remoteWrite"
+	openMetricsWriterName = "openMetrics"
+	exportWriterName      = "export"
+)
+
+// writerNames returns the names of the writers of the profile: those in
+// Writers, or else the only one configured, which is blocks by default.
+func (p *blockgenProfile) writerNames() []string {
+	if len(p.Writers) == 0 {
+		switch {
+		case p.RemoteWrite != nil:
+			return []string{remoteWriteWriterName}
+		case p.OpenMetrics != nil:
+			return []string{openMetricsWriterName}
+		case p.Export != nil:
+			return []string{exportWriterName}
+		}
+		return []string{blocksWriterName}
+	}
+
+	var res []string
+	for _, c := range p.Writers {
+		res = append(res, c.Name)
+	}
+	return res
+}
+
+// newProfileWriter creates the writer for the profile: either the only
+// writer of the profile, or multi writer with all the writers.
+func newProfileWriter(ctx context.Context, logger log.Logger, p blockgenProfile, opts execOptions) (blockgen.Writer, error) {
+	if len(p.Writers) == 0 {
+		return newNamedWriter(ctx, logger, p, p.writerNames()[0], opts)
+	}
+
+	var writers []blockgen.Writer
+	for _, c := range p.Writers {
+		w, err := newNamedWriter(ctx, logger, p, c.Name, opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "writer %s", c.Name)
+		}
+		writers = append(writers, w)
+	}
+
+	w, err := blockgen.NewMultiWriter(logger, writers, p.Writers)
+	if err != nil {
+		return nil, errors.Wrap(err, "blockgen.NewMultiWriter")
+	}
+
+	return w, nil
+}
+
+// newNamedWriter creates the writer of the profile with given name.
+func newNamedWriter(ctx context.Context, logger log.Logger, p blockgenProfile, name string, opts execOptions) (blockgen.Writer, error) {
+	if name == blocksWriterName {
+		return newBlocksWriter(ctx, logger, p, opts)
+	}
+
+	return newSampleWriter(p, name)
+}
+
+// newBlocksWriter creates the writer of blocks: either block writer or
+// replica writer with block writer for each replica.
+func newBlocksWriter(ctx context.Context, logger log.Logger, p blockgenProfile, opts execOptions) (blockgen.Writer, error) {
+	writerConfig := p.WriterConfig
+	writerConfig.Dir = p.OutDir
+
+	if p.Replication == nil {
+		return newBlockWriter(ctx, logger, p, writerConfig, opts)
+	}
+
+	var writers []blockgen.Writer
+	for _, r := range p.Replication.Replicas {
+		w, err := newBlockWriter(ctx, logger, p, r.BlockWriterConfig(writerConfig), opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "replica %s", r.Name)
+		}
+		writers = append(writers, w)
+	}
+
+	w, err := blockgen.NewReplicaWriter(writers, *p.Replication)
+	if err != nil {
+		return nil, errors.Wrap(err, "blockgen.NewReplicaWriter")
+	}
+
+	return w, nil
+}
+
+// newSampleWriter creates the writer of the profile with given name which
+// writes samples elsewhere than into blocks, and also injects faults if
+// configured.
+func newSampleWriter(p blockgenProfile, name string) (blockgen.Writer, error) {
+	var writer blockgen.Writer
+	var err error
+
+	switch name {
+	case remoteWriteWriterName:
+		writer, err = blockgen.NewRemoteWriter(*p.RemoteWrite)
+		if err != nil {
+			return nil, errors.Wrap(err, "blockgen.NewRemoteWriter")
+		}
+	case openMetricsWriterName:
+		config := *p.OpenMetrics
+		if config.Dir == "" {
+			config.Dir = p.OutDir
+		}
+
+		writer, err = blockgen.NewOpenMetricsWriter(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "blockgen.NewOpenMetricsWriter")
+		}
+	case exportWriterName:
+		config := *p.Export
+		if config.Dir == "" {
+			config.Dir = p.OutDir
+		}
+
+		writer, err = blockgen.NewExportWriter(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "blockgen.NewExportWriter")
+		}
+	default:
+		return nil, errors.Errorf("unknown writer %s", name)
 	}
 
-	valProvider := blockgen.NewValProvider(p.valConfig)
-	generator := blockgen.NewGeneratorWithConfig(p.genConfig)
+	if p.Faults != nil {
+		writer, err = blockgen.NewFaultWriter(writer, *p.Faults)
+		if err != nil {
+			return nil, errors.Wrap(err, "blockgen.NewFaultWriter")
+		}
+	}
+
+	return writer, nil
+}
+
+// newBlockWriter creates block writer of the profile which also
+// downsamples if configured, and uploads blocks if the bucket is set.
+// Faults are injected into each replica separately, so that the
+// timestamp jitter does not hide them.
+func newBlockWriter(ctx context.Context, logger log.Logger, p blockgenProfile, config blockgen.BlockWriterConfig, opts execOptions) (blockgen.Writer, error) {
+	config.Metrics = opts.metrics
+
+	newWriter := blockgen.NewBlockWriterWithConfig
+	if p.StreamingWriter {
+		newWriter = blockgen.NewStreamingBlockWriter
+	}
+
+	writer, err := newWriter(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "create block writer")
+	}
+
+	if p.Downsample != nil {
+		writer, err = blockgen.NewDownsampleWriter(writer, config, *p.Downsample)
+		if err != nil {
+			return nil, errors.Wrap(err, "blockgen.NewDownsampleWriter")
+		}
+	}
+
+	if opts.bkt != nil {
+		writer = blockgen.NewUploadWriter(ctx, logger, writer, opts.bkt, blockgen.UploadWriterConfig{
+			Dir:         config.Dir,
+			DeleteLocal: opts.deleteLocal,
+		})
+	}
+
+	if p.Faults != nil {
+		writer, err = blockgen.NewFaultWriter(writer, *p.Faults)
+		if err != nil {
+			return nil, errors.Wrap(err, "blockgen.NewFaultWriter")
+		}
+	}
 
-	log2.Printf("Writing to dir: %s", p.outDir)
-	return generator.Generate(writer, valProvider)
+	return writer, nil
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/run"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newMetricsRegistry creates registry with the Go runtime and process metrics.
+func newMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return reg
+}
+
+// addHTTPServer adds the actor serving metrics of the registry on /metrics.
+func addHTTPServer(g *run.Group, logger log.Logger, reg *prometheus.Registry, address string) error {
+	// Listen now so that bad address fails before the generation starts.
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "listen %s", address)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+
+	g.Add(func() error {
+		level.Info(logger).Log("msg", "serving metrics", "address", listener.Addr())
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			return errors.Wrap(err, "serve metrics")
+		}
+		return nil
+	}, func(error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			level.Warn(logger).Log("msg", "failed to shut down HTTP server", "err", err)
+		}
+	})
+
+	return nil
+}
@@ -44,7 +44,10 @@ func main() {
 
 	cmds := map[string]setupFunc{}
 	registerBlockgen(cmds, app)
-	// TODO(bwplotka): Add command to sync to object storage (?)
+	registerUpload(cmds, app)
+	registerVerify(cmds, app)
+	registerPlan(cmds, app)
+	registerServe(cmds, app)
 
 	cmd, err := app.Parse(os.Args[1:])
 	if err != nil {
@@ -82,7 +85,7 @@ func main() {
 	}
 
 	loggerAdapter := func(template string, args ...interface{}) {
-		level.Debug(logger).Log("msg", fmt.Sprintf(template, args))
+		level.Debug(logger).Log("msg", fmt.Sprintf(template, args...))
 	}
 
 	// Running in container with limits but with empty/wrong value of GOMAXPROCS env var could lead to throttling by cpu
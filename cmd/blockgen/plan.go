@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/run"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/blockgen"
+	"gopkg.in/alecthomas/kingpin.v2"
+	log2 "log"
+)
+
+// registerPlan registers command to estimate the output of the profile.
+func registerPlan(m map[string]setupFunc, app *kingpin.Application) {
+	cmd := app.Command("plan", "Estimates blocks, series, samples, disk size and memory of the profile without generating it.")
+
+	profileName := cmd.Flag("profile.name", "The name of the profile to estimate.").Required().String()
+	profileFiles := cmd.Flag("profile.file", "YAML file with additional profiles. Can be specified multiple times.").ExistingFiles()
+	workers := cmd.Flag("workers", "Number of blocks to generate concurrently. Overrides the profile if set.").Int()
+	calibrate := cmd.Flag("calibrate", "Generate a small block of the profile into temp dir to measure the sizes the estimate is based on.").Bool()
+
+	m["plan"] = func(g *run.Group, logger log.Logger) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			profiles, err := loadProfileFiles(blockgenProfiles, *profileFiles...)
+			if err != nil {
+				return errors.Wrap(err, "loadProfileFiles")
+			}
+
+			profile, found := profiles[*profileName]
+			if !found {
+				return fmt.Errorf("profile with name '%s' not found", *profileName)
+			}
+
+			if *workers > 0 {
+				profile.GenConfig.Workers = *workers
+			}
+
+			return execPlanProfile(ctx, profile, *calibrate)
+		}, func(error) {
+			cancel()
+		})
+		return nil
+	}
+}
+
+// execPlanProfile estimates the output of the profile and prints it.
+func execPlanProfile(ctx context.Context, p blockgenProfile, calibrate bool) error {
+	config, err := p.planConfig()
+	if err != nil {
+		return err
+	}
+
+	if calibrate {
+		valProviders, err := p.valProviders()
+		if err != nil {
+			return errors.Wrap(err, "valProviders")
+		}
+
+		log2.Printf("Calibrating with %d series", config.Series)
+		if err := blockgen.CalibratePlan(ctx, p.GenConfig, &config, valProviders...); err != nil {
+			return errors.Wrap(err, "blockgen.CalibratePlan")
+		}
+
+		log2.Printf("Measured %.1f bytes per series and %.2f per sample on disk, %.0f bytes per series and %.1f per sample in memory",
+			config.BytesPerSeries, config.BytesPerSample, config.HeadBytesPerSeries, config.HeadBytesPerSample)
+	}
+
+	plan, err := blockgen.EstimatePlan(p.GenConfig, config)
+	if err != nil {
+		return errors.Wrap(err, "blockgen.EstimatePlan")
+	}
+
+	log2.Printf("Plan for profile %s:", p.Name)
+	log2.Printf("  blocks:            %d per replica", plan.Blocks)
+	log2.Printf("  series per block:  %d", plan.SeriesPerBlock)
+	log2.Printf("  samples per block: %d", plan.SamplesPerBlock)
+	log2.Printf("  samples:           %d", plan.Samples)
+	log2.Printf("  block size:        %s", humanBytes(plan.BlockSize))
+	log2.Printf("  disk size:         %s (downsampled %s)", humanBytes(plan.DiskSize), humanBytes(plan.DownsampledSize))
+	log2.Printf("  peak head memory:  %s", humanBytes(plan.HeadMemory))
+	return nil
+}
+
+// planConfig returns the plan config of the profile.
+func (p *blockgenProfile) planConfig() (blockgen.PlanConfig, error) {
+	series, err := p.seriesPerSample()
+	if err != nil {
+		return blockgen.PlanConfig{}, err
+	}
+
+	config := blockgen.PlanConfig{
+		Series:    int64(series),
+		Streaming: p.StreamingWriter,
+	}
+
+	if p.Churn != nil {
+		config.SeriesLifetime = p.Churn.MeanLifetime
+	}
+
+	if p.Replication != nil {
+		config.Replicas = len(p.Replication.Replicas)
+	}
+
+	if p.Downsample != nil {
+		config.DownsampleResolutions = p.Downsample.Resolutions
+	}
+
+	return config, nil
+}
+
+// humanBytes formats the size with binary units, e.g. 1.5GiB.
+func humanBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
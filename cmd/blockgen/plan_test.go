@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_blockgenProfile_planConfig(t *testing.T) {
+	in := `
+profiles:
+  - name: small
+    outDir: /tmp/small
+    streamingWriter: true
+    generator:
+      retention: 10h
+    valProvider:
+      metricCount: 2
+      targetCount: 3
+    churn:
+      meanLifetime: 6h
+    downsample:
+      resolutions: [5m, 1h]
+    replication:
+      replicas:
+        - name: a
+        - name: b
+`
+	profiles, err := parseProfiles([]byte(in))
+	if err != nil {
+		t.Fatalf("parseProfiles: %v", err)
+	}
+
+	config, err := profiles[0].planConfig()
+	if err != nil {
+		t.Fatalf("planConfig: %v", err)
+	}
+
+	if config.Series != 6 || config.SeriesLifetime != 6*time.Hour || !config.Streaming || config.Replicas != 2 {
+		t.Errorf("want 6 streaming series with 6h lifetime in 2 replicas, got %+v", config)
+	}
+
+	if len(config.DownsampleResolutions) != 2 {
+		t.Errorf("want 2 downsample resolutions, got %v", config.DownsampleResolutions)
+	}
+}
+
+func Test_humanBytes(t *testing.T) {
+	for in, want := range map[int64]string{
+		0:                        "0B",
+		1023:                     "1023B",
+		1536:                     "1.5KiB",
+		5 * 1024 * 1024:          "5.0MiB",
+		200 * 1024 * 1024 * 1024: "200.0GiB",
+	} {
+		if got := humanBytes(in); got != want {
+			t.Errorf("humanBytes(%d): want %s, got %s", in, want, got)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/blockgen"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+)
+
+// profileFile is the format of the YAML file given via `--profile.file`,
+// see README.md for an example. Fields of `generator` which are not set
+// take values from `blockgen.DefaultGeneratorConfig`. Unknown fields are
+// errors.
+type profileFile struct {
+	Profiles []blockgenProfile `yaml:"profiles"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler to fill in the defaults.
+func (p *blockgenProfile) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*p = blockgenProfile{
+		GenConfig: blockgen.DefaultGeneratorConfig(0),
+	}
+
+	// plain has no UnmarshalYAML method, otherwise we'd recurse forever.
+	type plain blockgenProfile
+	return unmarshal((*plain)(p))
+}
+
+// loadProfileFiles reads profiles from the given YAML files and returns
+// them merged with the builtin profiles. Profile names must be unique.
+func loadProfileFiles(builtin map[string]blockgenProfile, files ...string) (map[string]blockgenProfile, error) {
+	res := make(map[string]blockgenProfile, len(builtin))
+	for name, p := range builtin {
+		res[name] = p
+	}
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read profile file %s", file)
+		}
+
+		profiles, err := parseProfiles(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse profile file %s", file)
+		}
+
+		for _, p := range profiles {
+			if _, found := res[p.Name]; found {
+				return nil, errors.Errorf("profile file %s: duplicate profile name '%s'", file, p.Name)
+			}
+			res[p.Name] = p
+		}
+	}
+
+	return res, nil
+}
+
+// parseProfiles parses and validates the contents of the profile file.
+func parseProfiles(b []byte) ([]blockgenProfile, error) {
+	var f profileFile
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, err
+	}
+
+	for i := range f.Profiles {
+		p := &f.Profiles[i]
+		p.OutDir = os.ExpandEnv(p.OutDir)
+
+		if err := validateProfile(p); err != nil {
+			name := p.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i)
+			}
+			return nil, errors.Wrapf(err, "profile '%s'", name)
+		}
+	}
+
+	return f.Profiles, nil
+}
+
+// validateProfile checks the things which the YAML decoder cannot check.
+func validateProfile(p *blockgenProfile) error {
+	if p.Name == "" {
+		return errors.New("name: must be set")
+	}
+
+	for _, name := range p.writerNames() {
+		if p.OutDir == "" && name != remoteWriteWriterName {
+			return errors.New("outDir: must be set")
+		}
+	}
+
+	if p.GenConfig.Retention <= 0 {
+		return errors.New("generator.retention: must be positive duration")
+	}
+
+	if p.GenConfig.SampleInterval <= 0 {
+		return errors.New("generator.sampleInterval: must be positive duration")
+	}
+
+	if p.GenConfig.FlushInterval <= 0 {
+		return errors.New("generator.flushInterval: must be positive duration")
+	}
+
+	if c := p.ValConfig; c != nil {
+		if c.MetricCount <= 0 {
+			return errors.New("valProvider.metricCount: must be positive")
+		}
+
+		if c.TargetCount <= 0 {
+			return errors.New("valProvider.targetCount: must be positive")
+		}
+
+		if m := c.ValueModel; m != nil && m.MaxValue <= m.MinValue {
+			return errors.New("valProvider.valueModel.maxValue: must be greater than minValue")
+		}
+	}
+
+	// The value providers have no target label with k8sLabels.
+	if p.K8sLabels != nil && p.Churn != nil && p.Churn.TargetLabel == "target" {
+		return errors.New("churn.targetLabel: must be one of k8sLabels, e.g. pod")
+	}
+
+	if d := p.Downsample; d != nil && len(d.Resolutions) == 0 {
+		return errors.New("downsample.resolutions: must not be empty")
+	}
+
+	if r := p.Replication; r != nil {
+		if len(r.Replicas) == 0 {
+			return errors.New("replication.replicas: must not be empty")
+		}
+
+		if 2*r.TimestampJitter >= p.GenConfig.SampleInterval {
+			return errors.New("replication.timestampJitter: must be less than half of generator.sampleInterval")
+		}
+
+		if err := r.Validate(); err != nil {
+			return errors.Wrap(err, "replication")
+		}
+	}
+
+	if len(p.Writers) == 0 {
+		if err := validateOnlyWriter(p); err != nil {
+			return err
+		}
+	} else if err := validateWriters(p); err != nil {
+		return err
+	}
+
+	// Workers write different time ranges, the series would go out of order.
+	if p.RemoteWrite != nil && p.GenConfig.Workers > 1 {
+		return errors.New("remoteWrite: cannot be used with more than one worker")
+	}
+
+	// Provider constructors do the rest of validation.
+	if _, err := p.valProviders(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateOnlyWriter checks the profile which writes into only one of
+// blocks, remoteWrite, openMetrics and export.
+func validateOnlyWriter(p *blockgenProfile) error {
+	if p.RemoteWrite != nil {
+		if p.Replication != nil || p.Downsample != nil {
+			return errors.New("remoteWrite: cannot be used with replication or downsample")
+		}
+	}
+
+	if p.OpenMetrics != nil {
+		if p.RemoteWrite != nil {
+			return errors.New("openMetrics: cannot be used with remoteWrite")
+		}
+
+		if p.Replication != nil || p.Downsample != nil {
+			return errors.New("openMetrics: cannot be used with replication or downsample")
+		}
+	}
+
+	if p.Export != nil {
+		if p.RemoteWrite != nil || p.OpenMetrics != nil {
+			return errors.New("export: cannot be used with remoteWrite or openMetrics")
+		}
+
+		if p.Replication != nil || p.Downsample != nil {
+			return errors.New("export: cannot be used with replication or downsample")
+		}
+	}
+
+	return nil
+}
+
+// validateWriters checks the profile which writes into all of `writers`.
+func validateWriters(p *blockgenProfile) error {
+	configured := map[string]bool{
+		blocksWriterName:      true,
+		remoteWriteWriterName: p.RemoteWrite != nil,
+		openMetricsWriterName: p.OpenMetrics != nil,
+		exportWriterName:      p.Export != nil,
+	}
+
+	used := map[string]bool{}
+	for _, c := range p.Writers {
+		isConfigured, known := configured[c.Name]
+		if !known {
+			return errors.Errorf("writers: unknown writer '%s'", c.Name)
+		}
+
+		if !isConfigured {
+			return errors.Errorf("writers: %s must be configured", c.Name)
+		}
+
+		if used[c.Name] {
+			return errors.Errorf("writers: %s is used more than once", c.Name)
+		}
+		used[c.Name] = true
+	}
+
+	for _, name := range []string{remoteWriteWriterName, openMetricsWriterName, exportWriterName} {
+		if configured[name] && !used[name] {
+			return errors.Errorf("%s: must be in writers", name)
+		}
+	}
+
+	if !used[blocksWriterName] {
+		if p.Replication != nil || p.Downsample != nil {
+			return errors.New("writers: replication and downsample need blocks writer")
+		}
+		return nil
+	}
+
+	// Files next to the blocks would get in the way of tools reading them.
+	if p.OpenMetrics != nil && p.OpenMetrics.Dir == "" {
+		return errors.New("openMetrics.dir: must be set when also writing blocks")
+	}
+
+	if p.Export != nil && p.Export.Dir == "" {
+		return errors.New("export.dir: must be set when also writing blocks")
+	}
+
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseProfiles(t *testing.T) {
+	in := `
+profiles:
+  - name: small
+    outDir: /tmp/small
+    generator:
+      startTime: 2019-09-30T00:00:00Z
+      retention: 10h
+    valProvider:
+      metricCount: 2
+      targetCount: 3
+      valueModel:
+        minValue: 10
+        maxValue: 20
+    randValProvider:
+      targetCount: 3
+      metrics:
+        - name: foo_total
+          type: counter
+          valueModel:
+            maxValue: 1000
+            changeBaseValue: 10
+`
+	profiles, err := parseProfiles([]byte(in))
+	if err != nil {
+		t.Fatalf("parseProfiles: %v", err)
+	}
+
+	if len(profiles) != 1 {
+		t.Fatalf("want 1 profile, got %d", len(profiles))
+	}
+
+	p := profiles[0]
+	if p.GenConfig.Retention != 10*time.Hour {
+		t.Errorf("want retention 10h, got %v", p.GenConfig.Retention)
+	}
+
+	// not in the file, comes from defaults
+	if p.GenConfig.SampleInterval != 15*time.Second {
+		t.Errorf("want default sampleInterval 15s, got %v", p.GenConfig.SampleInterval)
+	}
+
+	if p.ValConfig.ValueModel == nil || p.ValConfig.ValueModel.MaxValue != 20 {
+		t.Errorf("want valueModel.maxValue 20, got %+v", p.ValConfig.ValueModel)
+	}
+
+	if p.RandValConfig == nil || len(p.RandValConfig.Metrics) != 1 {
+		t.Errorf("want randValProvider with 1 metric, got %+v", p.RandValConfig)
+	}
+}
+
+func Test_parseProfiles_Writers(t *testing.T) {
+	in := `
+profiles:
+  - name: multi
+    outDir: /tmp/multi
+    generator:
+      retention: 10h
+    valProvider:
+      metricCount: 2
+      targetCount: 3
+    replication:
+      replicas:
+        - name: a
+        - name: b
+    remoteWrite:
+      url: http://localhost:19291/api/v1/receive
+    openMetrics:
+      dir: /tmp/multi-om
+    writers:
+      - name: blocks
+      - name: remoteWrite
+        errorPolicy: logAndContinue
+      - name: openMetrics
+        match:
+          __name__: foo_metric_total_0
+`
+	profiles, err := parseProfiles([]byte(in))
+	if err != nil {
+		t.Fatalf("parseProfiles: %v", err)
+	}
+
+	p := profiles[0]
+	if want := []string{"blocks", "remoteWrite", "openMetrics"}; !reflect.DeepEqual(p.writerNames(), want) {
+		t.Errorf("want writers %v, got %v", want, p.writerNames())
+	}
+
+	if p.Writers[2].Match["__name__"] != "foo_metric_total_0" {
+		t.Errorf("want match of openMetrics, got %+v", p.Writers[2])
+	}
+}
+
+func Test_parseProfiles_K8sLabelsChurn(t *testing.T) {
+	in := `
+profiles:
+  - name: k8s
+    outDir: /tmp/k8s
+    generator:
+      retention: 10h
+    valProvider:
+      metricCount: 2
+      targetCount: 1
+    k8sLabels:
+      namespaces: 2
+      deploymentsPerNamespace: 2
+      podsPerDeployment: 3
+      containersPerPod: 2
+      nodes: 2
+    churn:
+      meanLifetime: 5m
+`
+	profiles, err := parseProfiles([]byte(in))
+	if err != nil {
+		t.Fatalf("parseProfiles: %v", err)
+	}
+
+	valProviders, err := profiles[0].valProviders()
+	if err != nil {
+		t.Fatalf("valProviders: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		seen := map[string]bool{}
+		pods := map[string]bool{}
+		for _, valProvider := range valProviders {
+			for v := range valProvider.Next() {
+				key := v.Labels().String()
+				if seen[key] {
+					t.Fatalf("sample %d: duplicate series %s", i, key)
+				}
+				seen[key] = true
+				pods[v.Labels().Get("pod")] = true
+			}
+		}
+
+		// 2 x 2 deployments of 3 pods, same pod for both containers.
+		if len(seen) != 48 || len(pods) != 12 {
+			t.Fatalf("sample %d: want 48 series of 12 pods, got %d of %d", i, len(seen), len(pods))
+		}
+	}
+}
+
+func Test_parseProfiles_Errors(t *testing.T) {
+	tests := map[string]string{
+		"retentionn": `
+profiles:
+  - name: bad
+    outDir: /tmp/bad
+    generator:
+      retentionn: 10h
+`,
+		"generator.retention": `
+profiles:
+  - name: bad
+    outDir: /tmp/bad
+    valProvider:
+      metricCount: 2
+      targetCount: 3
+`,
+		"unknown type 'counterr'": `
+profiles:
+  - name: bad
+    outDir: /tmp/bad
+    generator:
+      retention: 10h
+    randValProvider:
+      targetCount: 3
+      metrics:
+        - name: foo_total
+          type: counterr
+`,
+		"time.Duration": `
+profiles:
+  - name: bad
+    outDir: /tmp/bad
+    generator:
+      retention: 10 hours
+`,
+		"remoteWrite: cannot be used with more than one worker": `
+profiles:
+  - name: bad
+    generator:
+      retention: 10h
+      workers: 2
+    valProvider:
+      metricCount: 2
+      targetCount: 3
+    remoteWrite:
+      url: http://localhost:19291/api/v1/receive
+`,
+		"remoteWrite: must be in writers": `
+profiles:
+  - name: bad
+    outDir: /tmp/bad
+    generator:
+      retention: 10h
+    valProvider:
+      metricCount: 2
+      targetCount: 3
+    remoteWrite:
+      url: http://localhost:19291/api/v1/receive
+    writers:
+      - name: blocks
+`,
+		"openMetrics.dir: must be set when also writing blocks": `
+profiles:
+  - name: bad
+    outDir: /tmp/bad
+    generator:
+      retention: 10h
+    valProvider:
+      metricCount: 2
+      targetCount: 3
+    openMetrics: {}
+    writers:
+      - name: blocks
+      - name: openMetrics
+`,
+		"churn.targetLabel: must be one of k8sLabels": `
+profiles:
+  - name: bad
+    outDir: /tmp/bad
+    generator:
+      retention: 10h
+    valProvider:
+      metricCount: 2
+      targetCount: 3
+    k8sLabels:
+      namespaces: 1
+      deploymentsPerNamespace: 1
+      podsPerDeployment: 1
+      containersPerPod: 1
+      nodes: 1
+    churn:
+      meanLifetime: 5m
+      targetLabel: target
+`,
+		"must not contain path separators": `
+profiles:
+  - name: bad
+    outDir: /tmp/bad
+    generator:
+      retention: 10h
+    valProvider:
+      metricCount: 2
+      targetCount: 3
+    replication:
+      replicas:
+        - name: ../a
+`,
+		"export: cannot be used with remoteWrite or openMetrics": `
+profiles:
+  - name: bad
+    outDir: /tmp/bad
+    generator:
+      retention: 10h
+    valProvider:
+      metricCount: 2
+      targetCount: 3
+    openMetrics: {}
+    export:
+      format: parquet
+`,
+	}
+
+	for want, in := range tests {
+		_, err := parseProfiles([]byte(in))
+		if err == nil {
+			t.Errorf("want error containing '%s', got nil", want)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want error containing '%s', got '%v'", want, err)
+		}
+	}
+}
+
+func Test_parseProfiles_Example(t *testing.T) {
+	if _, err := loadProfileFiles(nil, "../../examples/profiles.yaml"); err != nil {
+		t.Fatalf("loadProfileFiles: %v", err)
+	}
+}
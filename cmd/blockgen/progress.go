@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/blockgen"
+	log2 "log"
+	"os"
+	"time"
+)
+
+// progressRecord is one line of the progress file. Durations are in
+// seconds to make it easy to parse in CI.
+type progressRecord struct {
+	Time             time.Time `json:"time"`
+	Profile          string    `json:"profile"`
+	SamplesWritten   int64     `json:"samplesWritten"`
+	BlocksFlushed    int64     `json:"blocksFlushed"`
+	BlocksTotal      int64     `json:"blocksTotal"`
+	CoveredSeconds   float64   `json:"coveredSeconds"`
+	RetentionSeconds float64   `json:"retentionSeconds"`
+	Percent          float64   `json:"percent"`
+	ElapsedSeconds   float64   `json:"elapsedSeconds"`
+	SamplesPerSecond float64   `json:"samplesPerSecond"`
+	ETASeconds       float64   `json:"etaSeconds"`
+	Done             bool      `json:"done"`
+}
+
+func newProgressRecord(profile string, p blockgen.Progress) progressRecord {
+	return progressRecord{
+		Time:             time.Now().UTC(),
+		Profile:          profile,
+		SamplesWritten:   p.SamplesWritten,
+		BlocksFlushed:    p.BlocksFlushed,
+		BlocksTotal:      p.BlocksTotal,
+		CoveredSeconds:   p.Covered.Seconds(),
+		RetentionSeconds: p.Retention.Seconds(),
+		Percent:          p.Percent(),
+		ElapsedSeconds:   p.Elapsed.Seconds(),
+		SamplesPerSecond: p.SamplesPerSecond,
+		ETASeconds:       p.ETA.Seconds(),
+		Done:             p.Done,
+	}
+}
+
+// progressReporter prints the generator progress periodically and
+// optionally appends it to JSON-lines file.
+type progressReporter struct {
+	profile   string
+	generator blockgen.Generator
+	interval  time.Duration
+
+	file *os.File
+	enc  *json.Encoder
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startProgressReporter starts reporting the progress of the generator
+// every interval until `stop` is called. Zero interval disables periodic
+// reports, the final report is still written to the file if set.
+func startProgressReporter(profile string, generator blockgen.Generator, interval time.Duration, file string) (*progressReporter, error) {
+	r := &progressReporter{
+		profile:   profile,
+		generator: generator,
+		interval:  interval,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, errors.Wrap(err, "open progress file")
+		}
+		r.file = f
+		r.enc = json.NewEncoder(f)
+	}
+
+	go r.run()
+	return r, nil
+}
+
+func (r *progressReporter) run() {
+	defer close(r.done)
+
+	if r.interval <= 0 {
+		<-r.stop
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.report(r.generator.Progress())
+		}
+	}
+}
+
+// report renders the progress and writes it to the file if set.
+func (r *progressReporter) report(p blockgen.Progress) {
+	if p.Done {
+		log2.Printf("Progress: finished, %d blocks, %d samples in %s, %.0f samples/s",
+			p.BlocksFlushed, p.SamplesWritten, p.Elapsed.Round(time.Second), p.SamplesPerSecond)
+	} else {
+		eta := "unknown"
+		if p.ETA > 0 {
+			eta = p.ETA.Round(time.Second).String()
+		}
+
+		log2.Printf("Progress: %.1f%% (%s of %s), blocks %d/%d, %d samples, %.0f samples/s, ETA %s",
+			p.Percent(), p.Covered, p.Retention, p.BlocksFlushed, p.BlocksTotal,
+			p.SamplesWritten, p.SamplesPerSecond, eta)
+	}
+
+	if r.enc == nil {
+		return
+	}
+
+	if err := r.enc.Encode(newProgressRecord(r.profile, p)); err != nil {
+		log2.Printf("Failed to write progress file: %v", err)
+	}
+}
+
+// Stop stops periodic reports, writes the final one and closes the file.
+func (r *progressReporter) Stop() error {
+	close(r.stop)
+	<-r.done
+
+	r.report(r.generator.Progress())
+
+	if r.file == nil {
+		return nil
+	}
+
+	if err := r.file.Close(); err != nil {
+		return errors.Wrap(err, "close progress file")
+	}
+
+	return nil
+}
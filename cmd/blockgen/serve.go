@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/run"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/blockgen"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// registerServe registers command to serve the profile values as live scrape targets.
+func registerServe(m map[string]setupFunc, app *kingpin.Application) {
+	cmd := app.Command("serve", "Serves the current values of the profile on /metrics of simulated scrape targets, for Prometheus to scrape.")
+
+	profileName := cmd.Flag("profile.name", "The name of the profile whose value providers to serve.").Required().String()
+	profileFiles := cmd.Flag("profile.file", "YAML file with additional profiles. Can be specified multiple times.").ExistingFiles()
+	listenAddress := cmd.Flag("listen-address", "Listen host:port serving all targets on /targets/<target>/metrics. Only the host is used with --port-range.").Default(":9100").String()
+	portRange := cmd.Flag("port-range", "Range of ports, e.g. 9100-9199, to serve every target on its own port on /metrics.").String()
+	advertiseHost := cmd.Flag("advertise-host", "Host of the targets in the file_sd file.").Default("localhost").String()
+	fileSD := cmd.Flag("file-sd", "File to write the targets to in Prometheus file_sd JSON format.").String()
+	targetLabel := cmd.Flag("target-label", "Label whose values are the targets, e.g. pod with k8sLabels.").Default(blockgen.DefaultScrapeTargetLabel).String()
+	tickInterval := cmd.Flag("tick-interval", "Move the values forward at this interval. If 0, every scrape of a target moves them forward.").Default("0s").Duration()
+
+	m["serve"] = func(g *run.Group, logger log.Logger) error {
+		profiles, err := loadProfileFiles(blockgenProfiles, *profileFiles...)
+		if err != nil {
+			return errors.Wrap(err, "loadProfileFiles")
+		}
+
+		profile, found := profiles[*profileName]
+		if !found {
+			return fmt.Errorf("profile with name '%s' not found", *profileName)
+		}
+
+		valProviders, err := profile.valProviders()
+		if err != nil {
+			return errors.Wrap(err, "valProviders")
+		}
+
+		targets, err := blockgen.NewScrapeTargets(blockgen.ScrapeTargetsConfig{
+			TargetLabel:  *targetLabel,
+			TickInterval: *tickInterval,
+		}, valProviders...)
+		if err != nil {
+			return errors.Wrap(err, "blockgen.NewScrapeTargets")
+		}
+
+		var groups []fileSDGroup
+		if *portRange != "" {
+			groups, err = addPortTargets(g, logger, targets, *listenAddress, *portRange, *advertiseHost)
+		} else {
+			groups, err = addPathTargets(g, logger, targets, *listenAddress, *advertiseHost)
+		}
+		if err != nil {
+			return err
+		}
+
+		if *fileSD != "" {
+			if err := writeFileSD(*fileSD, groups); err != nil {
+				return err
+			}
+		}
+
+		level.Info(logger).Log("msg", "serving targets", "targets", len(groups))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			if err := targets.Run(ctx); err != nil {
+				return err
+			}
+
+			// Values move forward when scraped, wait for the servers.
+			<-ctx.Done()
+			return nil
+		}, func(error) {
+			cancel()
+		})
+		return nil
+	}
+}
+
+// fileSDGroup is one target group of Prometheus file_sd.
+type fileSDGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// writeFileSD writes the target groups into file_sd file. The file is
+// replaced at once, so that Prometheus never reads partial file.
+func writeFileSD(path string, groups []fileSDGroup) error {
+	b, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal file_sd")
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return errors.Wrapf(err, "write file %s", tmp)
+	}
+
+	return errors.Wrapf(os.Rename(tmp, path), "rename file %s", tmp)
+}
+
+// addPathTargets adds the actor serving every target on its own path of
+// one listener, and returns the target groups of the targets.
+func addPathTargets(g *run.Group, logger log.Logger, targets *blockgen.ScrapeTargets, address, advertiseHost string) ([]fileSDGroup, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listen %s", address)
+	}
+
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	advertised := net.JoinHostPort(advertiseHost, port)
+
+	mux := http.NewServeMux()
+	var groups []fileSDGroup
+	for _, target := range targets.Targets() {
+		h, err := targets.Handler(target)
+		if err != nil {
+			return nil, err
+		}
+
+		path := "/targets/" + url.PathEscape(target) + "/metrics"
+		mux.Handle(path, h)
+
+		groups = append(groups, fileSDGroup{
+			Targets: []string{advertised},
+			Labels:  map[string]string{"__metrics_path__": path},
+		})
+	}
+
+	addServer(g, logger, listener, mux)
+	return groups, nil
+}
+
+// addPortTargets adds the actors serving every target on /metrics of its
+// own port from the range, and returns the target groups of the targets.
+func addPortTargets(g *run.Group, logger log.Logger, targets *blockgen.ScrapeTargets, address, portRange, advertiseHost string) ([]fileSDGroup, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid listen address %s", address)
+	}
+
+	from, to, err := parsePortRange(portRange)
+	if err != nil {
+		return nil, err
+	}
+
+	if n := len(targets.Targets()); n > to-from+1 {
+		return nil, errors.Errorf("port range %s is too small for %d targets", portRange, n)
+	}
+
+	group := fileSDGroup{}
+	for i, target := range targets.Targets() {
+		h, err := targets.Handler(target)
+		if err != nil {
+			return nil, err
+		}
+
+		port := strconv.Itoa(from + i)
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return nil, errors.Wrapf(err, "listen %s for target %s", port, target)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", h)
+		addServer(g, logger, listener, mux)
+
+		group.Targets = append(group.Targets, net.JoinHostPort(advertiseHost, port))
+	}
+
+	return []fileSDGroup{group}, nil
+}
+
+// parsePortRange parses port range like 9100-9199.
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("port range must be like 9100-9199, got %s", s)
+	}
+
+	from, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "port range %s", s)
+	}
+
+	to, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "port range %s", s)
+	}
+
+	if from <= 0 || to > 65535 || from > to {
+		return 0, 0, errors.Errorf("invalid port range %s", s)
+	}
+
+	return from, to, nil
+}
+
+// addServer adds the actor serving the handler on the listener.
+func addServer(g *run.Group, logger log.Logger, listener net.Listener, handler http.Handler) {
+	srv := &http.Server{Handler: handler}
+
+	g.Add(func() error {
+		level.Debug(logger).Log("msg", "serving targets", "address", listener.Addr())
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			return errors.Wrap(err, "serve targets")
+		}
+		return nil
+	}, func(error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			level.Warn(logger).Log("msg", "failed to shut down HTTP server", "err", err)
+		}
+	})
+}
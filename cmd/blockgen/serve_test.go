@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/run"
+	"github.com/ppanyukov/thanos-data-gen/pkg/blockgen"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_parsePortRange(t *testing.T) {
+	from, to, err := parsePortRange("9100-9199")
+	if err != nil || from != 9100 || to != 9199 {
+		t.Errorf("want 9100-9199, got %d-%d, err: %v", from, to, err)
+	}
+
+	for _, s := range []string{"9100", "9199-9100", "0-10", "9100-99999", "a-b"} {
+		if _, _, err := parsePortRange(s); err == nil {
+			t.Errorf("want error for %s", s)
+		}
+	}
+}
+
+func Test_addPathTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	targets, err := blockgen.NewScrapeTargets(blockgen.ScrapeTargetsConfig{},
+		blockgen.NewValProvider(blockgen.ValProviderConfig{MetricCount: 1, TargetCount: 2}))
+	if err != nil {
+		t.Fatalf("NewScrapeTargets: %v", err)
+	}
+
+	var g run.Group
+	groups, err := addPathTargets(&g, log.NewNopLogger(), targets, "127.0.0.1:0", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("addPathTargets: %v", err)
+	}
+
+	stop := make(chan struct{})
+	g.Add(func() error {
+		<-stop
+		return nil
+	}, func(error) {})
+
+	done := make(chan error)
+	go func() {
+		done <- g.Run()
+	}()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	}()
+
+	if len(groups) != 2 {
+		t.Fatalf("want 2 target groups, got %v", groups)
+	}
+
+	path := filepath.Join(dir, "targets.json")
+	if err := writeFileSD(path, groups); err != nil {
+		t.Fatalf("writeFileSD: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file_sd: %v", err)
+	}
+
+	var read []fileSDGroup
+	if err := json.Unmarshal(b, &read); err != nil {
+		t.Fatalf("unmarshal file_sd: %v", err)
+	}
+
+	for _, group := range read {
+		resp, err := http.Get("http://" + group.Targets[0] + group.Labels["__metrics_path__"])
+		if err != nil {
+			t.Fatalf("scrape: %v", err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("read body: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK || !strings.HasSuffix(string(body), "# EOF\n") {
+			t.Errorf("%s: want metrics, got %d %s", group.Labels["__metrics_path__"], resp.StatusCode, body)
+		}
+	}
+}
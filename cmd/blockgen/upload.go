@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/run"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/blockgen"
+	"github.com/ppanyukov/thanos-data-gen/pkg/objstore"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// registerUpload registers command to upload already generated blocks.
+func registerUpload(m map[string]setupFunc, app *kingpin.Application) {
+	cmd := app.Command("upload", "Uploads generated blocks to object storage.")
+
+	dir := cmd.Flag("dir", "Directory with the blocks to upload.").Required().ExistingDir()
+	objStoreConfigFile := cmd.Flag("objstore.config-file", "Thanos-style bucket config YAML file.").Required().ExistingFile()
+	deleteLocal := cmd.Flag("delete-local", "Delete local copy of blocks after verified upload.").Bool()
+
+	m["upload"] = func(g *run.Group, logger log.Logger) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			bkt, err := objstore.NewBucketFromFile(logger, *objStoreConfigFile)
+			if err != nil {
+				return errors.Wrap(err, "objstore.NewBucketFromFile")
+			}
+			defer bkt.Close()
+
+			uploaded, err := blockgen.UploadBlocks(ctx, logger, bkt, *dir, *deleteLocal)
+			if err != nil {
+				return errors.Wrap(err, "blockgen.UploadBlocks")
+			}
+
+			level.Info(logger).Log("msg", "upload done", "uploaded", uploaded, "bucket", bkt.Name())
+			return nil
+		}, func(error) {
+			cancel()
+		})
+		return nil
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/run"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/blockgen"
+	"gopkg.in/alecthomas/kingpin.v2"
+	log2 "log"
+	"path/filepath"
+	"time"
+)
+
+// registerVerify registers command to check generated blocks against the profile.
+func registerVerify(m map[string]setupFunc, app *kingpin.Application) {
+	cmd := app.Command("verify", "Verifies that generated blocks contain what the profile asks for.")
+
+	profileName := cmd.Flag("profile.name", "The name of the profile the blocks were generated with.").Required().String()
+	profileFiles := cmd.Flag("profile.file", "YAML file with additional profiles. Can be specified multiple times.").ExistingFiles()
+	dir := cmd.Flag("dir", "Directory with the blocks. Default is the outDir of the profile.").String()
+	checkStartTime := cmd.Flag("check.start-time", "Check that blocks end at the startTime of the profile. Disable for profiles without fixed startTime.").Default("true").Bool()
+
+	m["verify"] = func(g *run.Group, logger log.Logger) error {
+		g.Add(func() error {
+			profiles, err := loadProfileFiles(blockgenProfiles, *profileFiles...)
+			if err != nil {
+				return errors.Wrap(err, "loadProfileFiles")
+			}
+
+			profile, found := profiles[*profileName]
+			if !found {
+				return fmt.Errorf("profile with name '%s' not found", *profileName)
+			}
+
+			if *dir != "" {
+				profile.OutDir = *dir
+			}
+
+			return execVerifyProfile(profile, *checkStartTime)
+		}, func(error) {
+			// Verification is not interruptible, it only reads blocks.
+		})
+		return nil
+	}
+}
+
+// execVerifyProfile verifies the output of the profile, every replica
+// separately, and prints the report.
+func execVerifyProfile(p blockgenProfile, checkStartTime bool) error {
+	config, err := p.verifyConfig()
+	if err != nil {
+		return err
+	}
+
+	if !checkStartTime {
+		config.StartTime = time.Time{}
+	}
+
+	dirs := []string{p.OutDir}
+	if p.Replication != nil {
+		dirs = dirs[:0]
+		for _, r := range p.Replication.Replicas {
+			dirs = append(dirs, filepath.Join(p.OutDir, r.Name))
+		}
+	}
+
+	problems := 0
+	for _, dir := range dirs {
+		report, err := blockgen.VerifyBlocks(dir, config)
+		if err != nil {
+			return errors.Wrapf(err, "verify %s", dir)
+		}
+
+		log2.Printf("%s: %s", dir, report)
+		problems += len(report.Problems)
+	}
+
+	if problems > 0 {
+		return errors.Errorf("verification failed with %d problems", problems)
+	}
+
+	return nil
+}
+
+// verifyConfig returns what the blocks generated by the profile must contain.
+func (p *blockgenProfile) verifyConfig() (blockgen.VerifyConfig, error) {
+	config := blockgen.VerifyConfig{
+		Retention:      p.GenConfig.Retention,
+		SampleInterval: p.GenConfig.SampleInterval,
+		StartTime:      p.GenConfig.StartTime,
+	}
+
+	if p.Replication != nil {
+		// Two replicas may move neighbour samples in opposite directions.
+		config.TimestampTolerance = 2 * p.Replication.TimestampJitter
+	}
+
+	// Series are the same at every sample unless they churn.
+	if p.Churn == nil {
+		series, err := p.seriesPerSample()
+		if err != nil {
+			return config, err
+		}
+		config.SeriesCount = series
+	}
+
+	// The values of `valProvider` metrics are random, not counters.
+	if c := p.RandValConfig; c != nil {
+		for _, m := range c.Metrics {
+			if m.Type == blockgen.Counter {
+				config.Counters = append(config.Counters, m.Name)
+			}
+		}
+	}
+
+	for _, c := range p.HistogramConfigs {
+		config.Counters = append(config.Counters, c.Name+"_bucket", c.Name+"_sum", c.Name+"_count")
+	}
+
+	for _, c := range p.SummaryConfigs {
+		config.Counters = append(config.Counters, c.Name+"_sum", c.Name+"_count")
+	}
+
+	return config, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_blockgenProfile_verifyConfig(t *testing.T) {
+	in := `
+profiles:
+  - name: small
+    outDir: /tmp/small
+    generator:
+      startTime: 2019-09-30T00:00:00Z
+      retention: 10h
+    valProvider:
+      metricCount: 2
+      targetCount: 3
+    randValProvider:
+      targetCount: 3
+      metrics:
+        - name: foo_total
+          type: counter
+        - name: foo_gauge
+          type: gauge
+    histogramProviders:
+      - name: http_request_duration_seconds
+        targetCount: 2
+        observationsPerSample: 10
+        buckets:
+          type: linear
+          start: 1
+          width: 1
+          count: 2
+        observations:
+          type: normal
+          mean: 1
+          stdDev: 1
+    replication:
+      timestampJitter: 1s
+      replicas:
+        - name: a
+        - name: b
+`
+	profiles, err := parseProfiles([]byte(in))
+	if err != nil {
+		t.Fatalf("parseProfiles: %v", err)
+	}
+
+	config, err := profiles[0].verifyConfig()
+	if err != nil {
+		t.Fatalf("verifyConfig: %v", err)
+	}
+
+	// 6 + 6 + 2 targets x (3 buckets + sum + count)
+	if config.SeriesCount != 22 {
+		t.Errorf("want 22 series, got %d", config.SeriesCount)
+	}
+
+	wantCounters := []string{
+		"foo_total",
+		"http_request_duration_seconds_bucket",
+		"http_request_duration_seconds_sum",
+		"http_request_duration_seconds_count",
+	}
+	if !reflect.DeepEqual(config.Counters, wantCounters) {
+		t.Errorf("want counters %v, got %v", wantCounters, config.Counters)
+	}
+
+	if config.TimestampTolerance != 2*time.Second {
+		t.Errorf("want timestamp tolerance 2s, got %s", config.TimestampTolerance)
+	}
+
+	if config.Retention != 10*time.Hour || config.SampleInterval != 15*time.Second {
+		t.Errorf("want retention and sampleInterval of the profile, got %+v", config)
+	}
+}
@@ -8,14 +8,20 @@ go 1.13
 
 require (
 	github.com/go-kit/kit v0.9.0
+	github.com/golang/snappy v0.0.1
 	github.com/oklog/run v1.0.0
-	github.com/pkg/errors v0.8.1
+	github.com/oklog/ulid v1.3.1
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.1.0
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
 	github.com/prometheus/common v0.7.0
 	github.com/prometheus/prometheus v1.8.2-0.20190913102521-8ab628b35467
-	github.com/stretchr/testify v1.4.0 // indirect
+	github.com/thanos-io/thanos v0.8.1
+	github.com/xitongsys/parquet-go v1.5.4
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
 	go.uber.org/automaxprocs v1.2.0
-	golang.org/x/sys v0.0.0-20190924154521-2837fb4f24fe // indirect
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 replace k8s.io/client-go => k8s.io/client-go v0.0.0-20190620085101-78d2af792bab
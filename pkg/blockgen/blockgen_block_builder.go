@@ -0,0 +1,259 @@
+package blockgen
+
+import (
+	crand "crypto/rand"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// indexFilename and chunksDirname are the same as in tsdb.
+	indexFilename = "index"
+	chunksDirname = "chunks"
+)
+
+// blockSeries is one series of the block being built.
+type blockSeries struct {
+	labels labels.Labels
+
+	// chunks are the chunks written to disk, without data.
+	chunks []chunks.Meta
+}
+
+// blockBuilder writes chunks of a block to disk as they come, and the
+// index and meta.json at the end. This is what tsdb compactor does but
+// without the need to have all the data at hand. Not thread-safe.
+type blockBuilder struct {
+	dir    string
+	config BlockWriterConfig
+
+	// resolution is the Thanos downsampling resolution in milliseconds.
+	resolution int64
+
+	// The block being built, the chunk writer is nil until first series.
+	id     ulid.ULID
+	tmp    string
+	chunkw *chunks.Writer
+
+	series []*blockSeries
+	stats  tsdb.BlockStats
+}
+
+// newBlockBuilder creates builder for blocks in config.Dir.
+func newBlockBuilder(config BlockWriterConfig, resolution int64) (*blockBuilder, error) {
+	if config.Source == "" {
+		config.Source = DefaultThanosSource
+	}
+
+	if err := os.MkdirAll(config.Dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "create dir")
+	}
+
+	return &blockBuilder{
+		dir:        config.Dir,
+		config:     config,
+		resolution: resolution,
+	}, nil
+}
+
+// open creates the temporary block dir and the chunk writer.
+func (b *blockBuilder) open() error {
+	id, err := ulid.New(ulid.Now(), crand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "new ULID")
+	}
+
+	tmp := filepath.Join(b.dir, id.String()+".tmp")
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return errors.Wrap(err, "create tmp dir")
+	}
+
+	chunkw, err := chunks.NewWriter(filepath.Join(tmp, chunksDirname))
+	if err != nil {
+		return errors.Wrap(err, "open chunk writer")
+	}
+
+	b.id, b.tmp, b.chunkw = id, tmp, chunkw
+	return nil
+}
+
+// newSeries adds the series to the block.
+func (b *blockBuilder) newSeries(l labels.Labels) (*blockSeries, error) {
+	if b.chunkw == nil {
+		if err := b.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &blockSeries{labels: l}
+	b.series = append(b.series, s)
+	return s, nil
+}
+
+// addChunk writes the chunk of the series to disk.
+func (b *blockBuilder) addChunk(s *blockSeries, chk chunks.Meta) error {
+	// The writer sets the reference in the slice.
+	metas := []chunks.Meta{chk}
+	if err := b.chunkw.WriteChunks(metas...); err != nil {
+		return errors.Wrap(err, "write chunks")
+	}
+
+	b.stats.NumChunks++
+	b.stats.NumSamples += uint64(chk.Chunk.NumSamples())
+
+	// Keep only the reference, the data is on disk.
+	metas[0].Chunk = nil
+	s.chunks = append(s.chunks, metas[0])
+
+	return nil
+}
+
+// write finishes the block with range [mint, maxt) and makes it visible.
+// It returns zero ULID if there are no series. The builder can be used
+// for the next block afterwards.
+func (b *blockBuilder) write(mint, maxt int64) (ulid.ULID, error) {
+	if b.chunkw == nil {
+		return ulid.ULID{}, nil
+	}
+	defer b.reset()
+
+	if err := b.chunkw.Close(); err != nil {
+		return ulid.ULID{}, errors.Wrap(err, "close chunk writer")
+	}
+
+	// Sorted series, same as required by the index.
+	sort.Slice(b.series, func(i, j int) bool {
+		return labels.Compare(b.series[i].labels, b.series[j].labels) < 0
+	})
+
+	if err := writeIndex(filepath.Join(b.tmp, indexFilename), b.series); err != nil {
+		return ulid.ULID{}, errors.Wrap(err, "write index")
+	}
+	b.stats.NumSeries = uint64(len(b.series))
+
+	labels := b.config.ExternalLabels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	meta := &metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{
+			ULID:    b.id,
+			MinTime: mint,
+			MaxTime: maxt,
+			Stats:   b.stats,
+			Compaction: tsdb.BlockMetaCompaction{
+				Level:   CompactionLevel(time.Duration(maxt-mint) * time.Millisecond),
+				Sources: []ulid.ULID{b.id},
+			},
+			Version: 1,
+		},
+		Thanos: metadata.Thanos{
+			Labels:     labels,
+			Downsample: metadata.ThanosDownsample{Resolution: b.resolution},
+			Source:     metadata.SourceType(b.config.Source),
+		},
+	}
+
+	if err := WriteThanosMeta(b.tmp, meta); err != nil {
+		return ulid.ULID{}, errors.Wrap(err, "write meta")
+	}
+
+	if err := os.Rename(b.tmp, filepath.Join(b.dir, b.id.String())); err != nil {
+		return ulid.ULID{}, errors.Wrap(err, "rename block dir")
+	}
+
+	return b.id, nil
+}
+
+// discard drops the block being built.
+func (b *blockBuilder) discard() error {
+	if b.chunkw == nil {
+		return nil
+	}
+	defer b.reset()
+
+	if err := b.chunkw.Close(); err != nil {
+		return errors.Wrap(err, "close chunk writer")
+	}
+
+	return errors.Wrapf(os.RemoveAll(b.tmp), "remove %s", b.tmp)
+}
+
+// reset prepares the builder for the next block.
+func (b *blockBuilder) reset() {
+	b.id = ulid.ULID{}
+	b.tmp = ""
+	b.chunkw = nil
+	b.series = nil
+	b.stats = tsdb.BlockStats{}
+}
+
+// writeIndex writes the index of the sorted series, the same way as tsdb
+// compactor does.
+func writeIndex(fn string, series []*blockSeries) (err error) {
+	symbols := map[string]struct{}{}
+	values := map[string]map[string]struct{}{}
+	for _, s := range series {
+		for _, l := range s.labels {
+			symbols[l.Name] = struct{}{}
+			symbols[l.Value] = struct{}{}
+
+			if values[l.Name] == nil {
+				values[l.Name] = map[string]struct{}{}
+			}
+			values[l.Name][l.Value] = struct{}{}
+		}
+	}
+
+	indexw, err := index.NewWriter(fn)
+	if err != nil {
+		return errors.Wrap(err, "open index writer")
+	}
+	defer func() {
+		// Close explicitly on success to check the error.
+		if err != nil {
+			indexw.Close()
+		}
+	}()
+
+	if err := indexw.AddSymbols(symbols); err != nil {
+		return errors.Wrap(err, "add symbols")
+	}
+
+	postings := index.NewMemPostings()
+	for i, s := range series {
+		if err := indexw.AddSeries(uint64(i), s.labels, s.chunks...); err != nil {
+			return errors.Wrap(err, "add series")
+		}
+		postings.Add(uint64(i), s.labels)
+	}
+
+	for name, set := range values {
+		vals := make([]string, 0, len(set))
+		for v := range set {
+			vals = append(vals, v)
+		}
+
+		if err := indexw.WriteLabelIndex([]string{name}, vals); err != nil {
+			return errors.Wrap(err, "write label index")
+		}
+	}
+
+	for _, l := range postings.SortedKeys() {
+		if err := indexw.WritePostings(l.Name, l.Value, postings.Get(l.Name, l.Value)); err != nil {
+			return errors.Wrap(err, "write postings")
+		}
+	}
+
+	return errors.Wrap(indexw.Close(), "close index writer")
+}
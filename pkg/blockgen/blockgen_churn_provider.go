@@ -0,0 +1,332 @@
+package blockgen
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// LifetimeDist is the distribution of simulated target lifetimes.
+type LifetimeDist string
+
+const (
+	// ExponentialLifetime is memoryless, like pods killed at random.
+	ExponentialLifetime LifetimeDist = "exponential"
+
+	// FixedLifetime is exactly MeanLifetime, like pods rolled by cron.
+	FixedLifetime LifetimeDist = "fixed"
+
+	// NormalLifetime is about normal with MeanLifetime and LifetimeStdDev,
+	// limited to range [1 sample, 2*MeanLifetime].
+	NormalLifetime LifetimeDist = "normal"
+)
+
+// ChurnConfig configures series churn, see `NewChurnProvider`.
+type ChurnConfig struct {
+	// MeanLifetime is the average time a target lives before it's replaced.
+	MeanLifetime time.Duration `yaml:"meanLifetime"`
+
+	// LifetimeDist is the distribution of lifetimes, default is exponential.
+	LifetimeDist LifetimeDist `yaml:"lifetimeDist"`
+
+	// LifetimeStdDev is the standard deviation for normal distribution.
+	LifetimeStdDev time.Duration `yaml:"lifetimeStdDev"`
+
+	// SampleInterval must be the same as `GeneratorConfig.SampleInterval`,
+	// it is needed to convert lifetimes into number of samples.
+	SampleInterval time.Duration `yaml:"sampleInterval"`
+
+	// TargetLabel is the label which identifies the target in the
+	// series of the wrapped provider, default is "target".
+	TargetLabel string `yaml:"targetLabel"`
+
+	// InstanceLabel is the label set on every series to the value
+	// which changes every time the target is replaced, default is "pod".
+	// It can be the same as TargetLabel.
+	InstanceLabel string `yaml:"instanceLabel"`
+
+	// Seed is the random seed.
+	Seed int64 `yaml:"seed"`
+}
+
+// NewChurnProvider wraps the provider to simulate target churn, e.g. pods
+// being rescheduled. Every target of the wrapped provider, as identified
+// by `TargetLabel`, is given a lifetime after which it is replaced by a
+// new target with fresh `InstanceLabel` value.
+//
+// The number of live series stays the same as in wrapped provider but
+// the number of series in each block grows with the churn rate.
+func NewChurnProvider(provider ValProvider, config ChurnConfig) (ValProvider, error) {
+	if config.MeanLifetime <= 0 {
+		return nil, errors.New("meanLifetime must be positive duration")
+	}
+
+	if config.SampleInterval <= 0 {
+		return nil, errors.New("sampleInterval must be positive duration")
+	}
+
+	switch config.LifetimeDist {
+	case "":
+		config.LifetimeDist = ExponentialLifetime
+	case ExponentialLifetime, FixedLifetime, NormalLifetime:
+	default:
+		return nil, errors.Errorf("unknown lifetime distribution '%s'", config.LifetimeDist)
+	}
+
+	if config.TargetLabel == "" {
+		config.TargetLabel = "target"
+	}
+
+	if config.InstanceLabel == "" {
+		config.InstanceLabel = "pod"
+	}
+
+	lifetime := int64(math.Max(1, math.Round(float64(config.MeanLifetime)/float64(config.SampleInterval))))
+
+	return &churnProvider{
+		provider: provider,
+		config:   config,
+		lifetime: lifetime,
+		targets:  map[string]*churnTarget{},
+	}, nil
+}
+
+// churnTarget is the state of one simulated target.
+type churnTarget struct {
+	name string
+
+	// seed is the random seed of the target, phase shifts the slots of
+	// the target so that targets are not replaced at the same time.
+	seed  int64
+	phase int64
+
+	// sample is the index of the sample the generation is for.
+	sample int64
+
+	// generation is the index of the sample the current instance started at.
+	generation int64
+	instance   string
+
+	// replaced is set if the target was replaced at the sample, previous
+	// is the instance it replaced.
+	replaced bool
+	previous string
+
+	// series caches the labels with instance label added,
+	// by hash of the original labels.
+	series map[uint64]labels.Labels
+}
+
+// churnProvider is implementation of `ValProvider` which adds churn.
+//
+// Replacements of a target are not accumulated from the previous lifetimes,
+// they are random events placed in slots of MeanLifetime samples each, so that
+// the instance at any sample is found in constant time and seeking is
+// cheap. Exponential lifetimes are Poisson process with one event per slot
+// on average, normal lifetimes are one event per slot with normal offset
+// around the middle of the slot and fixed lifetimes are one event at the
+// start of every slot.
+type churnProvider struct {
+	provider ValProvider
+	config   ChurnConfig
+	targets  map[string]*churnTarget
+
+	// lifetime is the mean lifetime in samples, the length of a slot.
+	lifetime int64
+
+	// pos is the index of the next sample.
+	pos int64
+
+	// terminated are the series of the targets replaced in the latest Next.
+	terminated []labels.Labels
+}
+
+// Next implements ValProvider interface.
+func (g *churnProvider) Next() <-chan Val {
+	c := make(chan Val)
+	sample := g.pos
+	g.pos++
+	g.terminated = g.terminated[:0]
+
+	go func() {
+		defer close(c)
+
+		for v := range g.provider.Next() {
+			l := v.Labels()
+			t := g.target(l.Get(g.config.TargetLabel), sample)
+
+			// The series of the previous instance ended at the sample before.
+			if t.replaced {
+				g.terminated = append(g.terminated, withLabel(l, g.config.InstanceLabel, t.previous))
+			}
+
+			c <- &valAdapter{v: v.Val(), l: t.labels(g.config.InstanceLabel, l)}
+		}
+
+		sort.Sort(labels.Slice(g.terminated))
+	}()
+
+	return c
+}
+
+// SeekSample implements SampleSeeker interface.
+func (g *churnProvider) SeekSample(index int64) error {
+	if index < g.pos {
+		return errors.Errorf("cannot seek back from sample %d to %d", g.pos, index)
+	}
+
+	if err := seek(g.provider, g.pos, index); err != nil {
+		return err
+	}
+
+	g.pos = index
+	return nil
+}
+
+// Terminated implements SeriesTerminator interface.
+func (g *churnProvider) Terminated() []labels.Labels {
+	return g.terminated
+}
+
+// target returns the target with given name updated to the sample.
+func (g *churnProvider) target(name string, sample int64) *churnTarget {
+	t, found := g.targets[name]
+	if !found {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%d/%s", g.config.Seed, name)
+
+		t = &churnTarget{
+			name:   name,
+			seed:   int64(h.Sum64()),
+			sample: -1,
+		}
+		t.phase = int64(randval.Uint64(t.seed, -1) % uint64(g.lifetime))
+		g.targets[name] = t
+	}
+
+	if t.sample == sample {
+		return t
+	}
+	t.sample = sample
+
+	generation := g.generation(t, sample)
+	if t.series != nil && generation == t.generation {
+		t.replaced = false
+		return t
+	}
+
+	// There is nothing to replace at the very first sample.
+	t.replaced = sample > 0 && generation == sample
+	if t.replaced {
+		t.previous = g.instance(t, g.generation(t, sample-1))
+	}
+
+	t.generation = generation
+	t.instance = g.instance(t, generation)
+	t.series = map[uint64]labels.Labels{}
+
+	return t
+}
+
+// generation returns the index of the sample at which the instance of
+// the target live at the sample started.
+func (g *churnProvider) generation(t *churnTarget, sample int64) int64 {
+	m := sample + t.phase
+	slot := m / g.lifetime
+	if m%g.lifetime < 0 {
+		slot--
+	}
+
+	// The latest event not after the sample, in this slot or earlier.
+	for ; ; slot-- {
+		if event, found := g.latestEvent(t, slot, m-slot*g.lifetime); found {
+			return slot*g.lifetime + event - t.phase
+		}
+	}
+}
+
+// latestEvent returns the offset of the latest replacement in the slot
+// not greater than the limit, if any.
+func (g *churnProvider) latestEvent(t *churnTarget, slot, limit int64) (int64, bool) {
+	c := &g.config
+
+	switch c.LifetimeDist {
+	case FixedLifetime:
+		return 0, true
+	case NormalLifetime:
+		// Box-Muller transform of two random numbers of the slot. The
+		// difference of two offsets has LifetimeStdDev.
+		u1, u2 := randval.Float64(t.seed, 2*slot), randval.Float64(t.seed, 2*slot+1)
+		z := math.Sqrt(-2*math.Log(1-u1)) * math.Cos(2*math.Pi*u2)
+		stdDev := float64(c.LifetimeStdDev) / float64(c.SampleInterval) / math.Sqrt2
+
+		offset := int64(math.Round(float64(g.lifetime)/2 + stdDev*z))
+		if offset < 0 {
+			offset = 0
+		}
+		if offset >= g.lifetime {
+			offset = g.lifetime - 1
+		}
+		return offset, offset <= limit
+	default:
+		// Poisson number of events with mean 1, at random offsets.
+		seed := int64(randval.Uint64(t.seed, slot))
+		u := randval.Float64(seed, 0)
+		events, p := 0, math.Exp(-1)
+		for cdf := p; u > cdf; cdf += p {
+			events++
+			p /= float64(events)
+		}
+
+		latest, found := int64(0), false
+		for i := 1; i <= events; i++ {
+			offset := int64(randval.Float64(seed, int64(i)) * float64(g.lifetime))
+			if offset <= limit && (!found || offset > latest) {
+				latest, found = offset, true
+			}
+		}
+		return latest, found
+	}
+}
+
+// instance returns the instance label value of the target generation.
+func (g *churnProvider) instance(t *churnTarget, generation int64) string {
+	// Something like the pod hash suffix in Kubernetes.
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%s/%d", g.config.Seed, t.name, generation)
+	return t.name + "-" + strconv.FormatUint(h.Sum64()%(36*36*36*36*36), 36)
+}
+
+// labels returns the series labels with instance label added.
+func (t *churnTarget) labels(instanceLabel string, l labels.Labels) labels.Labels {
+	hash := l.Hash()
+	if res, found := t.series[hash]; found {
+		return res
+	}
+
+	res := withLabel(l, instanceLabel, t.instance)
+	t.series[hash] = res
+	return res
+}
+
+// withLabel returns the labels with the label set to the value.
+func withLabel(l labels.Labels, name, value string) labels.Labels {
+	// Replace the label if the series already has it,
+	// e.g. churn of `pod` label from `K8sSchemaConfig`.
+	res := make(labels.Labels, 0, len(l)+1)
+	for _, label := range l {
+		if label.Name != name {
+			res = append(res, label)
+		}
+	}
+	res = append(res, labels.Label{Name: name, Value: value})
+	sort.Sort(res)
+
+	return res
+}
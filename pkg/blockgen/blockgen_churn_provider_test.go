@@ -0,0 +1,115 @@
+package blockgen
+
+import (
+	"github.com/prometheus/prometheus/pkg/value"
+	"testing"
+	"time"
+)
+
+func Test_churnProvider_Next(t *testing.T) {
+	valProvider := NewValProvider(ValProviderConfig{
+		MetricCount: 2,
+		TargetCount: 10,
+	})
+
+	config := ChurnConfig{
+		MeanLifetime:   time.Hour,
+		SampleInterval: 15 * time.Second,
+		Seed:           3,
+	}
+
+	p, err := NewChurnProvider(valProvider, config)
+	if err != nil {
+		t.Fatalf("NewChurnProvider: %v", err)
+	}
+
+	// 6h worth of samples.
+	all := map[string]struct{}{}
+	for i := 0; i < 6*60*4; i++ {
+		live := 0
+		for v := range p.Next() {
+			if v.Labels().Get("pod") == "" {
+				t.Fatalf("sample %d: no pod label in %s", i, v.Labels())
+			}
+			all[v.Labels().String()] = struct{}{}
+			live++
+		}
+
+		if live != 20 {
+			t.Fatalf("sample %d: want 20 live series, got %d", i, live)
+		}
+	}
+
+	// Around 6 generations per target, so expect a lot more than
+	// 20 series but don't be too precise about random things.
+	if len(all) < 60 {
+		t.Errorf("want at least 60 series with churn, got %d", len(all))
+	}
+}
+
+// memWriter is Writer which keeps everything in memory, for tests.
+type memWriter struct {
+	samples map[string][]float64
+	times   map[string][]time.Time
+	flushes int
+}
+
+func (w *memWriter) Write(t time.Time, v Val) error {
+	if w.samples == nil {
+		w.samples = map[string][]float64{}
+		w.times = map[string][]time.Time{}
+	}
+	key := v.Labels().String()
+	w.samples[key] = append(w.samples[key], v.Val())
+	w.times[key] = append(w.times[key], t)
+	return nil
+}
+
+func (w *memWriter) Flush() error {
+	w.flushes++
+	return nil
+}
+
+func Test_churnProvider_StalenessMarkers(t *testing.T) {
+	valProvider := NewValProvider(ValProviderConfig{
+		MetricCount: 1,
+		TargetCount: 5,
+	})
+
+	config := ChurnConfig{
+		MeanLifetime:   10 * time.Minute,
+		SampleInterval: 15 * time.Second,
+		Seed:           3,
+	}
+
+	p, err := NewChurnProvider(valProvider, config)
+	if err != nil {
+		t.Fatalf("NewChurnProvider: %v", err)
+	}
+
+	generatorConfig := DefaultGeneratorConfig(2 * time.Hour)
+	generatorConfig.FlushInterval = time.Hour
+
+	w := &memWriter{}
+	if err := NewGeneratorWithConfig(generatorConfig).Generate(w, p); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	stale := 0
+	for key, samples := range w.samples {
+		for i, v := range samples {
+			if !value.IsStaleNaN(v) {
+				continue
+			}
+			if i != len(samples)-1 {
+				t.Fatalf("series %s has samples after staleness marker", key)
+			}
+			stale++
+		}
+	}
+
+	// Every series apart from the live ones must have ended with marker.
+	if want := len(w.samples) - 5; stale != want {
+		t.Errorf("want %d staleness markers, got %d", want, stale)
+	}
+}
@@ -0,0 +1,454 @@
+package blockgen
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	// ResLevel1 and ResLevel2 are the resolutions of Thanos downsampled blocks.
+	ResLevel1 = 5 * time.Minute
+	ResLevel2 = time.Hour
+)
+
+// DownsampleConfig configures the writer returned by `NewDownsampleWriter`.
+type DownsampleConfig struct {
+	// Resolutions of the downsampled blocks, e.g. 5m and 1h which are
+	// the ones Thanos Compactor produces.
+	Resolutions []time.Duration `yaml:"resolutions"`
+}
+
+// NewDownsampleWriter wraps the writer to also write downsampled blocks
+// of every configured resolution into `config.Dir`. The downsampled
+// blocks have the same time range as the raw blocks written by the
+// wrapped writer, the aggregate chunk encoding and the resolution set in
+// the Thanos section of meta.json, the same as produced by Thanos Compactor.
+//
+// Every resolution is downsampled from the raw values, unlike Thanos which
+// downsamples 1h from 5m data. The aggregates are the same apart from the
+// rounding errors. Only the current aggregation window of every series is
+// kept in memory.
+func NewDownsampleWriter(writer Writer, blockConfig BlockWriterConfig, config DownsampleConfig) (Writer, error) {
+	if len(config.Resolutions) == 0 {
+		return nil, errors.New("at least one resolution required")
+	}
+
+	res := &downsampleWriter{
+		logger: log.NewLogfmtLogger(os.Stderr),
+		writer: writer,
+	}
+
+	for _, r := range config.Resolutions {
+		resolution := int64(r / time.Millisecond)
+		if resolution <= 0 {
+			return nil, errors.Errorf("resolution must be at least 1ms, got %s", r)
+		}
+
+		builder, err := newBlockBuilder(blockConfig, resolution)
+		if err != nil {
+			return nil, err
+		}
+
+		res.downsamplers = append(res.downsamplers, &downsampler{
+			resolution: resolution,
+			builder:    builder,
+			series:     map[uint64][]*aggrSeries{},
+		})
+	}
+	res.reset()
+
+	return res, nil
+}
+
+// downsampleWriter is implementation of Writer which also downsamples.
+type downsampleWriter struct {
+	logger       log.Logger
+	writer       Writer
+	downsamplers []*downsampler
+
+	// mint and maxt are the time range of written samples.
+	mint int64
+	maxt int64
+
+	// blockMint and blockMaxt are the range of the next block as set by
+	// SetBlockRange, zero if not set.
+	blockMint int64
+	blockMaxt int64
+
+	// lastBlocks are the IDs of the downsampled blocks written by the last Flush.
+	lastBlocks []ulid.ULID
+}
+
+// reset prepares the writer for the next block.
+func (w *downsampleWriter) reset() {
+	w.mint = math.MaxInt64
+	w.maxt = math.MinInt64
+	w.blockMint, w.blockMaxt = 0, 0
+
+	for _, d := range w.downsamplers {
+		d.series = map[uint64][]*aggrSeries{}
+	}
+}
+
+// Write implements Writer interface.
+func (w *downsampleWriter) Write(t time.Time, v Val) error {
+	if err := w.writer.Write(t, v); err != nil {
+		return err
+	}
+
+	// Staleness markers are not part of any aggregate.
+	if value.IsStaleNaN(v.Val()) {
+		return nil
+	}
+
+	ts := timestamp.FromTime(t)
+	if ts < w.mint {
+		w.mint = ts
+	}
+	if ts > w.maxt {
+		w.maxt = ts
+	}
+
+	for _, d := range w.downsamplers {
+		if err := d.add(v.Labels(), ts, v.Val()); err != nil {
+			return errors.Wrapf(err, "downsample %s", time.Duration(d.resolution)*time.Millisecond)
+		}
+	}
+
+	return nil
+}
+
+// SetBlockRange implements BlockRangeSetter interface.
+func (w *downsampleWriter) SetBlockRange(mint, maxt time.Time) {
+	w.blockMint = timestamp.FromTime(mint)
+	w.blockMaxt = timestamp.FromTime(maxt)
+
+	if s, ok := w.writer.(BlockRangeSetter); ok {
+		s.SetBlockRange(mint, maxt)
+	}
+}
+
+// Flush implements Writer interface. It flushes the wrapped writer and
+// writes one block for each resolution.
+func (w *downsampleWriter) Flush() error {
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+
+	w.lastBlocks = w.lastBlocks[:0]
+	if f, ok := w.writer.(blockFlusher); ok {
+		if id := f.LastFlushedBlock(); id != (ulid.ULID{}) {
+			w.lastBlocks = append(w.lastBlocks, id)
+		}
+	}
+
+	// The same range as the raw block.
+	mint, maxt := w.mint, w.maxt+1
+	if w.blockMaxt != 0 {
+		mint, maxt = w.blockMint, w.blockMaxt
+	}
+
+	for _, d := range w.downsamplers {
+		id, err := d.write(mint, maxt)
+		if err != nil {
+			return errors.Wrapf(err, "downsample %s", time.Duration(d.resolution)*time.Millisecond)
+		}
+
+		if id == (ulid.ULID{}) {
+			continue
+		}
+
+		level.Info(w.logger).Log("msg", "wrote downsampled block", "ulid", id,
+			"resolution", time.Duration(d.resolution)*time.Millisecond)
+		w.lastBlocks = append(w.lastBlocks, id)
+	}
+
+	w.reset()
+	return nil
+}
+
+// Discard implements Discarder interface.
+func (w *downsampleWriter) Discard() error {
+	if d, ok := w.writer.(Discarder); ok {
+		if err := d.Discard(); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range w.downsamplers {
+		if err := d.builder.discard(); err != nil {
+			return err
+		}
+	}
+
+	w.reset()
+	return nil
+}
+
+// LastFlushedBlocks returns the IDs of the raw block, if the wrapped
+// writer tells it, and of downsampled blocks written by the last Flush.
+func (w *downsampleWriter) LastFlushedBlocks() []ulid.ULID {
+	return w.lastBlocks
+}
+
+// downsampler builds the block of one resolution.
+type downsampler struct {
+	resolution int64
+	builder    *blockBuilder
+	series     map[uint64][]*aggrSeries
+}
+
+// add adds the raw sample to the series.
+func (d *downsampler) add(l labels.Labels, t int64, v float64) error {
+	s, err := d.getOrCreate(l)
+	if err != nil {
+		return err
+	}
+
+	// Out of order and duplicate samples, which the wrapped writer
+	// didn't fail on, are not aggregated.
+	if t <= s.lastT {
+		return nil
+	}
+
+	if t > s.nextT {
+		if s.nextT != -1 {
+			if err := d.closeWindow(s); err != nil {
+				return err
+			}
+		}
+
+		if s.chunk == nil {
+			if err := s.startChunk(t, v); err != nil {
+				return err
+			}
+		}
+
+		s.aggr.reset()
+		s.nextT = currentWindow(t, d.resolution)
+	}
+
+	s.aggr.add(v)
+	s.lastT, s.lastV = t, v
+
+	return nil
+}
+
+// closeWindow adds the aggregates of the finished window to the chunk,
+// and cuts the chunk if it's full.
+func (d *downsampler) closeWindow(s *aggrSeries) error {
+	if s.chunk.added+1 < samplesPerChunk {
+		s.chunk.add(s.nextT, &s.aggr)
+		return nil
+	}
+
+	return d.cut(s)
+}
+
+// cut adds the last window to the chunk and writes it.
+func (d *downsampler) cut(s *aggrSeries) error {
+	// The last window of the chunk is timestamped with the last raw
+	// sample rather than the window end, so that chunks don't overlap.
+	t := s.nextT
+	if t > s.lastT {
+		t = s.lastT
+	}
+	s.chunk.add(t, &s.aggr)
+
+	// The last raw value, see `ValidateCounterRange` in Thanos.
+	s.chunk.apps[downsample.AggrCounter].Append(t, s.lastV)
+
+	if err := d.builder.addChunk(s.blockSeries, s.chunk.encode()); err != nil {
+		return err
+	}
+
+	s.chunk = nil
+	return nil
+}
+
+// write cuts open chunks of all series and writes the block.
+func (d *downsampler) write(mint, maxt int64) (ulid.ULID, error) {
+	for _, ss := range d.series {
+		for _, s := range ss {
+			if s.chunk != nil {
+				if err := d.cut(s); err != nil {
+					return ulid.ULID{}, err
+				}
+			}
+		}
+	}
+
+	return d.builder.write(mint, maxt)
+}
+
+// getOrCreate returns the series with given labels.
+func (d *downsampler) getOrCreate(l labels.Labels) (*aggrSeries, error) {
+	hash := l.Hash()
+	for _, s := range d.series[hash] {
+		if s.labels.Equals(l) {
+			return s, nil
+		}
+	}
+
+	bs, err := d.builder.newSeries(l)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &aggrSeries{blockSeries: bs, nextT: -1, lastT: math.MinInt64}
+	d.series[hash] = append(d.series[hash], s)
+	return s, nil
+}
+
+// aggrSeries is the downsampling state of one series.
+type aggrSeries struct {
+	*blockSeries
+
+	// aggr is the aggregator of the current window ending at nextT,
+	// nextT is -1 before the first sample.
+	aggr  aggregator
+	nextT int64
+
+	// lastT and lastV is the last raw sample.
+	lastT int64
+	lastV float64
+
+	// chunk is the open chunk, nil if none.
+	chunk *aggrChunkBuilder
+}
+
+// startChunk starts new chunk with the raw sample.
+func (s *aggrSeries) startChunk(t int64, v float64) error {
+	b, err := newAggrChunkBuilder()
+	if err != nil {
+		return err
+	}
+
+	// The counter state starts over in every chunk.
+	s.aggr = aggregator{}
+
+	// The first raw value, see `ValidateCounterRange` in Thanos.
+	b.apps[downsample.AggrCounter].Append(t, v)
+
+	s.chunk = b
+	return nil
+}
+
+// currentWindow returns the end of the window of the timestamp, inclusive.
+func currentWindow(t, r int64) int64 {
+	return t - (t % r) + r - 1
+}
+
+// aggregator collects the aggregates of one window, same as in Thanos.
+type aggregator struct {
+	total   int     // Total samples processed.
+	count   int     // Samples in current window.
+	sum     float64 // Value sum of current window.
+	min     float64 // Min of current window.
+	max     float64 // Max of current window.
+	counter float64 // Total counter state since beginning.
+	resets  int     // Number of counter resets since beginning.
+	last    float64 // Last added value.
+}
+
+// reset the stats to start a new aggregation window.
+func (a *aggregator) reset() {
+	a.count = 0
+	a.sum = 0
+	a.min = math.MaxFloat64
+	a.max = -math.MaxFloat64
+}
+
+func (a *aggregator) add(v float64) {
+	if a.total > 0 {
+		if v < a.last {
+			// Counter reset, correct the value.
+			a.counter += v
+			a.resets++
+		} else {
+			// Add delta with last value to the counter.
+			a.counter += v - a.last
+		}
+	} else {
+		// First sample sets the counter.
+		a.counter = v
+	}
+	a.last = v
+
+	a.sum += v
+	a.count++
+	a.total++
+
+	if v < a.min {
+		a.min = v
+	}
+	if v > a.max {
+		a.max = v
+	}
+}
+
+// aggrChunkBuilder builds the chunks of all aggregates.
+type aggrChunkBuilder struct {
+	mint, maxt int64
+	added      int
+
+	chunks [5]chunkenc.Chunk
+	apps   [5]chunkenc.Appender
+}
+
+func newAggrChunkBuilder() (*aggrChunkBuilder, error) {
+	b := &aggrChunkBuilder{
+		mint: math.MaxInt64,
+		maxt: math.MinInt64,
+	}
+
+	for i := range b.chunks {
+		b.chunks[i] = chunkenc.NewXORChunk()
+
+		app, err := b.chunks[i].Appender()
+		if err != nil {
+			return nil, errors.Wrap(err, "chunk appender")
+		}
+		b.apps[i] = app
+	}
+
+	return b, nil
+}
+
+// add appends the aggregates of the window at given time.
+func (b *aggrChunkBuilder) add(t int64, a *aggregator) {
+	if t < b.mint {
+		b.mint = t
+	}
+	if t > b.maxt {
+		b.maxt = t
+	}
+
+	b.apps[downsample.AggrSum].Append(t, a.sum)
+	b.apps[downsample.AggrMin].Append(t, a.min)
+	b.apps[downsample.AggrMax].Append(t, a.max)
+	b.apps[downsample.AggrCount].Append(t, float64(a.count))
+	b.apps[downsample.AggrCounter].Append(t, a.counter)
+
+	b.added++
+}
+
+// encode returns the chunk with all aggregates.
+func (b *aggrChunkBuilder) encode() chunks.Meta {
+	return chunks.Meta{
+		MinTime: b.mint,
+		MaxTime: b.maxt,
+		Chunk:   downsample.EncodeAggrChunk(b.chunks),
+	}
+}
@@ -0,0 +1,209 @@
+package blockgen
+
+import (
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testAggr is the aggregates of one series over the whole block.
+type testAggr struct {
+	count   float64
+	sum     float64
+	min     float64
+	max     float64
+	windows int
+	mint    int64
+}
+
+// readAggrBlock reads the aggregates of all series of downsampled block.
+func readAggrBlock(t *testing.T, dir string) map[string]*testAggr {
+	ir, err := index.NewFileReader(filepath.Join(dir, indexFilename))
+	if err != nil {
+		t.Fatalf("open index: %v", err)
+	}
+	defer ir.Close()
+
+	cr, err := chunks.NewDirReader(filepath.Join(dir, chunksDirname), downsample.NewPool())
+	if err != nil {
+		t.Fatalf("open chunks: %v", err)
+	}
+	defer cr.Close()
+
+	p, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		t.Fatalf("postings: %v", err)
+	}
+
+	res := map[string]*testAggr{}
+	for p.Next() {
+		var lset labels.Labels
+		var chks []chunks.Meta
+		if err := ir.Series(p.At(), &lset, &chks); err != nil {
+			t.Fatalf("series: %v", err)
+		}
+
+		a := &testAggr{min: math.MaxFloat64, max: -math.MaxFloat64, mint: math.MaxInt64}
+		for _, meta := range chks {
+			chk, err := cr.Chunk(meta.Ref)
+			if err != nil {
+				t.Fatalf("chunk: %v", err)
+			}
+
+			aggr, ok := chk.(*downsample.AggrChunk)
+			if !ok {
+				t.Fatalf("%s: want aggregate chunk, got encoding %v", lset, chk.Encoding())
+			}
+
+			for _, at := range []downsample.AggrType{downsample.AggrCount, downsample.AggrSum, downsample.AggrMin, downsample.AggrMax} {
+				c, err := aggr.Get(at)
+				if err != nil || c == nil {
+					t.Fatalf("%s: aggregate %d: %v", lset, at, err)
+				}
+
+				it := c.Iterator(nil)
+				for it.Next() {
+					ts, v := it.At()
+					switch at {
+					case downsample.AggrCount:
+						a.count += v
+						a.windows++
+						if ts < a.mint {
+							a.mint = ts
+						}
+					case downsample.AggrSum:
+						a.sum += v
+					case downsample.AggrMin:
+						a.min = math.Min(a.min, v)
+					case downsample.AggrMax:
+						a.max = math.Max(a.max, v)
+					}
+				}
+			}
+		}
+		res[lset.String()] = a
+	}
+
+	return res
+}
+
+func Test_downsampleWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	raw := &memWriter{}
+	writer, err := NewDownsampleWriter(raw, BlockWriterConfig{
+		Dir:            dir,
+		ExternalLabels: map[string]string{"cluster": "eu-1"},
+	}, DownsampleConfig{
+		Resolutions: []time.Duration{ResLevel1, ResLevel2},
+	})
+	if err != nil {
+		t.Fatalf("NewDownsampleWriter: %v", err)
+	}
+
+	// 16h so that 5m chunks get cut in the middle of the block.
+	config := DefaultGeneratorConfig(16 * time.Hour)
+	config.StartTime = time.Date(2019, time.September, 30, 0, 0, 0, 0, time.UTC)
+	config.FlushInterval = 16 * time.Hour
+
+	providers, err := newTestValProviders()
+	if err != nil {
+		t.Fatalf("newTestValProviders: %v", err)
+	}
+
+	if err := NewGeneratorWithConfig(config).Generate(writer, providers...); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	metaFiles, err := filepath.Glob(filepath.Join(dir, "*", metaFilename))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+
+	// Both resolutions of the block and the last sample.
+	if len(metaFiles) != 4 {
+		t.Fatalf("want 4 blocks, got %d", len(metaFiles))
+	}
+
+	for _, f := range metaFiles {
+		meta, err := ReadThanosMeta(filepath.Dir(f))
+		if err != nil {
+			t.Fatalf("ReadThanosMeta: %v", err)
+		}
+
+		resolution := time.Duration(meta.Thanos.Downsample.Resolution) * time.Millisecond
+		if resolution != ResLevel1 && resolution != ResLevel2 {
+			t.Fatalf("%s: unexpected resolution %s", f, resolution)
+		}
+
+		if meta.Thanos.Labels["cluster"] != "eu-1" {
+			t.Errorf("%s: wrong external labels %v", f, meta.Thanos.Labels)
+		}
+
+		// Only check the large block, the other one has just the last sample.
+		if meta.MaxTime-meta.MinTime < int64(time.Hour/time.Millisecond) {
+			continue
+		}
+
+		aggrs := readAggrBlock(t, filepath.Dir(f))
+		for key, values := range raw.samples {
+			var want testAggr
+			want.min, want.max = math.MaxFloat64, -math.MaxFloat64
+			res := int64(resolution / time.Millisecond)
+			lastT := int64(math.MaxInt64)
+
+			for i, v := range values {
+				ts := raw.times[key][i].UnixNano() / int64(time.Millisecond)
+				if ts >= meta.MaxTime || math.IsNaN(v) {
+					continue
+				}
+
+				if want.count == 0 {
+					want.mint = currentWindow(ts, res)
+				}
+				lastT = ts
+
+				want.count++
+				want.sum += v
+				want.min = math.Min(want.min, v)
+				want.max = math.Max(want.max, v)
+			}
+
+			// Only one window, stamped with the last sample.
+			if lastT < want.mint {
+				want.mint = lastT
+			}
+
+			got, found := aggrs[key]
+			if !found {
+				t.Errorf("%s: series %s not found", resolution, key)
+				continue
+			}
+
+			if got.count != want.count || got.min != want.min || got.max != want.max {
+				t.Errorf("%s: %s: want count %v min %v max %v, got %v %v %v", resolution, key,
+					want.count, want.min, want.max, got.count, got.min, got.max)
+			}
+
+			if math.Abs(got.sum-want.sum) > 1e-9*math.Abs(want.sum) {
+				t.Errorf("%s: %s: want sum %v, got %v", resolution, key, want.sum, got.sum)
+			}
+
+			// The first window is stamped with its end.
+			if got.mint != want.mint {
+				t.Errorf("%s: %s: want first window at %d, got %d", resolution, key, want.mint, got.mint)
+			}
+		}
+	}
+}
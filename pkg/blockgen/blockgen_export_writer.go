@@ -0,0 +1,339 @@
+package blockgen
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/xitongsys/parquet-go/writer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ExportFormat is the file format of `NewExportWriter`.
+type ExportFormat string
+
+const (
+	// CSVFormat is comma separated values with header row. This is the default.
+	CSVFormat ExportFormat = "csv"
+
+	// ParquetFormat is Apache Parquet with snappy compression.
+	ParquetFormat ExportFormat = "parquet"
+)
+
+// Columns of exported rows, apart from the labels flattened into columns.
+const (
+	exportLabelsColumn    = "labels"
+	exportTimestampColumn = "timestamp"
+	exportValueColumn     = "value"
+)
+
+// ExportConfig configures the writer returned by `NewExportWriter`.
+type ExportConfig struct {
+	// Dir is the directory of the written files, created if missing.
+	Dir string `yaml:"dir"`
+
+	// Format is the file format.
+	Format ExportFormat `yaml:"format"`
+
+	// Labels are the labels flattened into their own columns, in this
+	// order. Other labels are not exported then. If empty, all labels are
+	// exported in one `labels` column as JSON object.
+	Labels []string `yaml:"labels"`
+}
+
+// NewExportWriter creates writer which exports the samples as rows of
+// labels, timestamp and value, for analysis in e.g. pandas. Samples are
+// written into one file for every `Flush`, named by the time range of
+// its samples, e.g. `1569801600000-1569808799999.csv`. The timestamp is
+// in milliseconds since epoch, `TIMESTAMP_MILLIS` in Parquet. Labels
+// missing in a series are empty in CSV and null in Parquet. Staleness
+// markers are not exported.
+func NewExportWriter(config ExportConfig) (Writer, error) {
+	if config.Dir == "" {
+		return nil, errors.New("dir must not be empty")
+	}
+
+	switch config.Format {
+	case "":
+		config.Format = CSVFormat
+	case CSVFormat, ParquetFormat:
+	default:
+		return nil, errors.Errorf("format must be %s or %s, got '%s'", CSVFormat, ParquetFormat, config.Format)
+	}
+
+	seen := map[string]bool{}
+	for _, name := range config.Labels {
+		if name == exportTimestampColumn || name == exportValueColumn || seen[name] {
+			return nil, errors.Errorf("label %s can't be a column", name)
+		}
+		seen[name] = true
+	}
+
+	if err := os.MkdirAll(config.Dir, 0777); err != nil {
+		return nil, errors.Wrapf(err, "create dir %s", config.Dir)
+	}
+
+	return &exportWriter{config: config}, nil
+}
+
+// exportWriter is implementation of Writer which exports rows into files.
+type exportWriter struct {
+	config ExportConfig
+
+	// file is the temporary file written since the last flush, nil if
+	// nothing has been written yet.
+	file exportFile
+
+	// mint and maxt are the time range of the samples since the last flush.
+	mint int64
+	maxt int64
+}
+
+// exportFile is the file of one format.
+type exportFile interface {
+	// write writes one row. The label values are nil for missing labels.
+	write(labels []*string, t int64, v float64) error
+
+	// close completes the file.
+	close() error
+
+	// name is the path of the temporary file.
+	name() string
+}
+
+// Write implements Writer interface.
+func (w *exportWriter) Write(t time.Time, v Val) error {
+	if value.IsStaleNaN(v.Val()) {
+		return nil
+	}
+
+	ts := timestamp.FromTime(t)
+	if w.file == nil {
+		if err := w.create(); err != nil {
+			return err
+		}
+		w.mint, w.maxt = ts, ts
+	}
+
+	if ts < w.mint {
+		w.mint = ts
+	}
+	if ts > w.maxt {
+		w.maxt = ts
+	}
+
+	return w.file.write(w.labelColumns(v), ts, v.Val())
+}
+
+// labelColumns returns the values of the label columns of the value.
+func (w *exportWriter) labelColumns(v Val) []*string {
+	l := v.Labels()
+
+	if len(w.config.Labels) == 0 {
+		b, _ := json.Marshal(l.Map())
+		s := string(b)
+		return []*string{&s}
+	}
+
+	res := make([]*string, len(w.config.Labels))
+	for _, lbl := range l {
+		for i, name := range w.config.Labels {
+			if lbl.Name == name {
+				s := lbl.Value
+				res[i] = &s
+			}
+		}
+	}
+
+	return res
+}
+
+// create creates the temporary file of the next flush.
+func (w *exportWriter) create() error {
+	f, err := ioutil.TempFile(w.config.Dir, "blockgen-*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "create temp file")
+	}
+
+	columns := w.config.Labels
+	if len(columns) == 0 {
+		columns = []string{exportLabelsColumn}
+	}
+
+	if w.config.Format == ParquetFormat {
+		w.file, err = newParquetExportFile(f, columns)
+	} else {
+		w.file = newCSVExportFile(f, columns)
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Flush implements Writer interface.
+func (w *exportWriter) Flush() error {
+	if w.file == nil {
+		return nil
+	}
+
+	file := w.file
+	w.file = nil
+
+	if err := file.close(); err != nil {
+		os.Remove(file.name())
+		return errors.Wrapf(err, "close file %s", file.name())
+	}
+
+	path := filepath.Join(w.config.Dir, fmt.Sprintf("%d-%d.%s", w.mint, w.maxt, w.config.Format))
+	return errors.Wrapf(os.Rename(file.name(), path), "rename file %s", file.name())
+}
+
+// Discard implements Discarder interface.
+func (w *exportWriter) Discard() error {
+	if w.file == nil {
+		return nil
+	}
+
+	file := w.file
+	w.file = nil
+
+	file.close()
+	return errors.Wrapf(os.Remove(file.name()), "remove file %s", file.name())
+}
+
+// csvExportFile is exportFile in CSV format.
+type csvExportFile struct {
+	f   *os.File
+	buf *bufio.Writer
+	csv *csv.Writer
+
+	// header is the header row, written with the first row.
+	header []string
+	row    []string
+}
+
+// newCSVExportFile creates CSV file with the label columns.
+func newCSVExportFile(f *os.File, columns []string) *csvExportFile {
+	buf := bufio.NewWriter(f)
+
+	return &csvExportFile{
+		f:      f,
+		buf:    buf,
+		csv:    csv.NewWriter(buf),
+		header: append(append([]string(nil), columns...), exportTimestampColumn, exportValueColumn),
+	}
+}
+
+func (f *csvExportFile) write(labels []*string, t int64, v float64) error {
+	if f.header != nil {
+		if err := f.csv.Write(f.header); err != nil {
+			return err
+		}
+		f.header = nil
+	}
+
+	f.row = f.row[:0]
+	for _, l := range labels {
+		if l == nil {
+			f.row = append(f.row, "")
+		} else {
+			f.row = append(f.row, *l)
+		}
+	}
+
+	f.row = append(f.row, strconv.FormatInt(t, 10), strconv.FormatFloat(v, 'g', -1, 64))
+	return f.csv.Write(f.row)
+}
+
+func (f *csvExportFile) close() error {
+	f.csv.Flush()
+	if err := f.csv.Error(); err != nil {
+		f.f.Close()
+		return err
+	}
+
+	if err := f.buf.Flush(); err != nil {
+		f.f.Close()
+		return err
+	}
+
+	return f.f.Close()
+}
+
+func (f *csvExportFile) name() string {
+	return f.f.Name()
+}
+
+// parquetExportFile is exportFile in Parquet format.
+type parquetExportFile struct {
+	f *os.File
+	w *writer.CSVWriter
+}
+
+// newParquetExportFile creates Parquet file with the label columns.
+func newParquetExportFile(f *os.File, columns []string) (*parquetExportFile, error) {
+	var schema []string
+	for _, c := range columns {
+		schema = append(schema, "name="+c+", type=UTF8, repetitiontype=OPTIONAL")
+	}
+	schema = append(schema,
+		"name="+exportTimestampColumn+", type=TIMESTAMP_MILLIS, repetitiontype=REQUIRED",
+		"name="+exportValueColumn+", type=DOUBLE, repetitiontype=REQUIRED")
+
+	w, err := newParquetCSVWriter(f, schema)
+	if err != nil {
+		return nil, errors.Wrap(err, "create parquet writer")
+	}
+
+	return &parquetExportFile{f: f, w: w}, nil
+}
+
+// newParquetCSVWriter creates the writer, which panics on invalid schema.
+func newParquetCSVWriter(f *os.File, schema []string) (w *writer.CSVWriter, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("invalid schema: %v", r)
+		}
+	}()
+
+	return writer.NewCSVWriterFromWriter(schema, f, 1)
+}
+
+func (f *parquetExportFile) write(labels []*string, t int64, v float64) error {
+	// The writer keeps the rows until the row group is full.
+	row := make([]interface{}, 0, len(labels)+2)
+	for _, l := range labels {
+		if l == nil {
+			row = append(row, nil)
+		} else {
+			row = append(row, *l)
+		}
+	}
+
+	return f.w.Write(append(row, t, v))
+}
+
+func (f *parquetExportFile) close() error {
+	if err := f.w.WriteStop(); err != nil {
+		f.f.Close()
+		return err
+	}
+
+	return f.f.Close()
+}
+
+func (f *parquetExportFile) name() string {
+	return f.f.Name()
+}
@@ -0,0 +1,244 @@
+package blockgen
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportRow is one row of exported file, for tests.
+type exportRow struct {
+	labels map[string]string
+	t      int64
+	v      float64
+}
+
+// readExportCSV reads the rows of CSV file written with the columns.
+func readExportCSV(t *testing.T, path string, columns []string) []exportRow {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+
+	header := columns
+	if len(header) == 0 {
+		header = []string{"labels"}
+	}
+
+	if want := append(append([]string(nil), header...), "timestamp", "value"); !reflect.DeepEqual(records[0], want) {
+		t.Fatalf("%s: want header %v, got %v", path, want, records[0])
+	}
+
+	var rows []exportRow
+	for _, record := range records[1:] {
+		row := exportRow{labels: map[string]string{}}
+		if len(columns) == 0 {
+			if err := json.Unmarshal([]byte(record[0]), &row.labels); err != nil {
+				t.Fatalf("%s: unmarshal labels: %v", path, err)
+			}
+			record = record[1:]
+		} else {
+			for i, name := range columns {
+				if record[i] != "" {
+					row.labels[name] = record[i]
+				}
+			}
+			record = record[len(columns):]
+		}
+
+		if row.t, err = strconv.ParseInt(record[0], 10, 64); err != nil {
+			t.Fatalf("%s: parse timestamp: %v", path, err)
+		}
+		if row.v, err = strconv.ParseFloat(record[1], 64); err != nil {
+			t.Fatalf("%s: parse value: %v", path, err)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// readExportParquet reads the rows of Parquet file written with the columns.
+func readExportParquet(t *testing.T, path string, columns []string) []exportRow {
+	f, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	pr, err := reader.NewParquetColumnReader(f, 1)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	defer pr.ReadStop()
+
+	n := pr.GetNumRows()
+	read := func(column string) []interface{} {
+		values, _, _, err := pr.ReadColumnByPath(pr.SchemaHandler.GetRootExName()+"."+column, n)
+		if err != nil {
+			t.Fatalf("%s: read column %s: %v", path, column, err)
+		}
+		if int64(len(values)) != n {
+			t.Fatalf("%s: want %d values of column %s, got %d", path, n, column, len(values))
+		}
+		return values
+	}
+
+	rows := make([]exportRow, n)
+	for i := range rows {
+		rows[i].labels = map[string]string{}
+	}
+
+	for _, name := range columns {
+		for i, v := range read(name) {
+			// Missing labels are nulls.
+			if v != nil {
+				rows[i].labels[name] = v.(string)
+			}
+		}
+	}
+
+	for i, ts := range read("timestamp") {
+		rows[i].t = ts.(int64)
+	}
+	for i, v := range read("value") {
+		rows[i].v = v.(float64)
+	}
+
+	return rows
+}
+
+func Test_exportWriter(t *testing.T) {
+	for _, c := range []struct {
+		format ExportFormat
+		labels []string
+	}{
+		{CSVFormat, nil},
+		{CSVFormat, []string{"__name__", "target", "missing"}},
+		{ParquetFormat, []string{"__name__", "target", "missing"}},
+	} {
+		dir, err := ioutil.TempDir("", "thanos-data-test")
+		if err != nil {
+			t.Fatalf("create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		writer, err := NewExportWriter(ExportConfig{Dir: dir, Format: c.format, Labels: c.labels})
+		if err != nil {
+			t.Fatalf("NewExportWriter: %v", err)
+		}
+
+		mem := &memWriter{}
+		generatorConfig := DefaultGeneratorConfig(4 * time.Minute)
+		generatorConfig.FlushInterval = 2 * time.Minute
+
+		err = NewGeneratorWithConfig(generatorConfig).Generate(&teeWriter{writer, mem},
+			NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 2}))
+		if err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+
+		files, err := filepath.Glob(filepath.Join(dir, "*"))
+		if err != nil {
+			t.Fatalf("Glob: %v", err)
+		}
+
+		// Two full flushes and one with the very last sample.
+		if len(files) != 3 {
+			t.Fatalf("%s: want 3 files, got %v", c.format, files)
+		}
+
+		got := map[string][]float64{}
+		for _, file := range files {
+			if !strings.HasSuffix(file, "."+string(c.format)) {
+				t.Errorf("unexpected file name %s", file)
+			}
+
+			var rows []exportRow
+			if c.format == ParquetFormat {
+				rows = readExportParquet(t, file, c.labels)
+			} else {
+				rows = readExportCSV(t, file, c.labels)
+			}
+
+			for _, row := range rows {
+				key := labels.FromMap(row.labels).String()
+				got[key] = append(got[key], row.v)
+			}
+		}
+
+		if len(got) != len(mem.samples) {
+			t.Errorf("%s %v: want %d series, got %d", c.format, c.labels, len(mem.samples), len(got))
+		}
+
+		for key, want := range mem.samples {
+			if len(got[key]) != len(want) {
+				t.Errorf("%s %v: %s: want %d samples, got %d", c.format, c.labels, key, len(want), len(got[key]))
+				continue
+			}
+
+			for i := range want {
+				if math.Float64bits(want[i]) != math.Float64bits(got[key][i]) {
+					t.Errorf("%s %v: %s: sample %d: want %v, got %v", c.format, c.labels, key, i, want[i], got[key][i])
+					break
+				}
+			}
+		}
+	}
+}
+
+func Test_exportWriter_Discard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, err := NewExportWriter(ExportConfig{Dir: dir, Format: ParquetFormat})
+	if err != nil {
+		t.Fatalf("NewExportWriter: %v", err)
+	}
+
+	if err := writer.Write(time.Now(), &valAdapter{1, labels.FromStrings("__name__", "foo")}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := writer.(Discarder).Discard(); err != nil {
+		t.Fatalf("Discard: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("want no files, got %d", len(files))
+	}
+
+	for _, config := range []ExportConfig{
+		{Dir: dir, Format: "json"},
+		{Dir: dir, Labels: []string{"value"}},
+		{Dir: dir, Labels: []string{"target", "target"}},
+	} {
+		if _, err := NewExportWriter(config); err == nil {
+			t.Errorf("%+v: want error", config)
+		}
+	}
+}
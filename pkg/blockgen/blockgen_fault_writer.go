@@ -0,0 +1,163 @@
+package blockgen
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/value"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// DefaultOutOfOrderMaxAge is the default of `FaultConfig.OutOfOrderMaxAge`.
+const DefaultOutOfOrderMaxAge = time.Minute
+
+// FaultConfig configures the writer returned by `NewFaultWriter`. The
+// rates are fractions of the written samples, e.g. 0.01 is 1%.
+type FaultConfig struct {
+	// OutOfOrderRate is the rate of samples followed by an out of order
+	// sample of the same series with the same value, older by random
+	// duration up to OutOfOrderMaxAge.
+	OutOfOrderRate   float64       `yaml:"outOfOrderRate"`
+	OutOfOrderMaxAge time.Duration `yaml:"outOfOrderMaxAge"`
+
+	// DuplicateRate is the rate of samples written twice.
+	DuplicateRate float64 `yaml:"duplicateRate"`
+
+	// AmendRate is the rate of samples followed by a sample with the
+	// same timestamp but different value, which TSDB rejects with
+	// `tsdb.ErrAmendSample`.
+	AmendRate float64 `yaml:"amendRate"`
+
+	// Seed is the random seed.
+	Seed int64 `yaml:"seed"`
+}
+
+// NewFaultWriter creates writer which injects out of order and duplicate
+// samples into the values written to the given writer, to test how
+// these are handled, see `InvalidSamplePolicy`. Staleness markers are
+// never duplicated. The counts of injected samples are logged at every
+// `Flush`.
+func NewFaultWriter(writer Writer, config FaultConfig) (Writer, error) {
+	for _, rate := range []float64{config.OutOfOrderRate, config.DuplicateRate, config.AmendRate} {
+		if rate < 0 || rate > 1 {
+			return nil, errors.Errorf("rates must be in range [0, 1], got %v", rate)
+		}
+	}
+
+	if config.OutOfOrderMaxAge < 0 {
+		return nil, errors.New("outOfOrderMaxAge must not be negative")
+	}
+
+	if config.OutOfOrderMaxAge == 0 {
+		config.OutOfOrderMaxAge = DefaultOutOfOrderMaxAge
+	}
+
+	if config.OutOfOrderMaxAge < time.Millisecond {
+		return nil, errors.New("outOfOrderMaxAge must be at least 1ms")
+	}
+
+	return &faultWriter{
+		logger:   log.NewLogfmtLogger(os.Stderr),
+		writer:   writer,
+		config:   config,
+		random:   rand.New(rand.NewSource(config.Seed)),
+		injected: map[string]int64{},
+	}, nil
+}
+
+// faultWriter is implementation of Writer which injects invalid samples.
+type faultWriter struct {
+	logger log.Logger
+	writer Writer
+	config FaultConfig
+	random *rand.Rand
+
+	// mint is the start of the block range set by SetBlockRange, zero
+	// if not set. Out of order samples are never older.
+	mint time.Time
+
+	// injected are the counts of injected samples by reason since the last flush.
+	injected map[string]int64
+}
+
+// Write implements Writer interface.
+func (w *faultWriter) Write(t time.Time, v Val) error {
+	if err := w.writer.Write(t, v); err != nil {
+		return err
+	}
+
+	if value.IsStaleNaN(v.Val()) {
+		return nil
+	}
+
+	if w.random.Float64() < w.config.OutOfOrderRate {
+		maxAge := int64(w.config.OutOfOrderMaxAge / time.Millisecond)
+		old := t.Add(-time.Duration(1+w.random.Int63n(maxAge)) * time.Millisecond)
+
+		if w.mint.IsZero() || !old.Before(w.mint) {
+			if err := w.inject(reasonOutOfOrder, old, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	if w.random.Float64() < w.config.DuplicateRate {
+		if err := w.inject(reasonDuplicate, t, v); err != nil {
+			return err
+		}
+	}
+
+	if w.random.Float64() < w.config.AmendRate {
+		amended := v.Val() + 1
+		if amended == v.Val() {
+			amended = math.Nextafter(v.Val(), math.Inf(1))
+		}
+
+		if err := w.inject(reasonAmend, t, &valAdapter{v: amended, l: v.Labels()}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inject writes the invalid sample.
+func (w *faultWriter) inject(reason string, t time.Time, v Val) error {
+	w.injected[reason]++
+	return errors.Wrapf(w.writer.Write(t, v), "inject %s sample", reason)
+}
+
+// Flush implements Writer interface.
+func (w *faultWriter) Flush() error {
+	level.Info(w.logger).Log(
+		"msg", "injected invalid samples",
+		reasonOutOfOrder, w.injected[reasonOutOfOrder],
+		reasonDuplicate, w.injected[reasonDuplicate],
+		reasonAmend, w.injected[reasonAmend])
+
+	w.injected = map[string]int64{}
+	return w.writer.Flush()
+}
+
+// SetBlockRange implements BlockRangeSetter interface.
+func (w *faultWriter) SetBlockRange(mint, maxt time.Time) {
+	w.mint = mint
+
+	if s, ok := w.writer.(BlockRangeSetter); ok {
+		s.SetBlockRange(mint, maxt)
+	}
+}
+
+// Discard implements Discarder interface.
+func (w *faultWriter) Discard() error {
+	w.injected = map[string]int64{}
+
+	if d, ok := w.writer.(Discarder); ok {
+		return d.Discard()
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package blockgen
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_faultWriter(t *testing.T) {
+	mem := &memWriter{}
+	writer, err := NewFaultWriter(mem, FaultConfig{
+		OutOfOrderRate: 0.1,
+		DuplicateRate:  0.2,
+		AmendRate:      0.3,
+		Seed:           1,
+	})
+	if err != nil {
+		t.Fatalf("NewFaultWriter: %v", err)
+	}
+
+	start := time.Now()
+	writer.(BlockRangeSetter).SetBlockRange(start, start.Add(time.Hour))
+
+	const samples = 10000
+	l := labels.FromStrings("__name__", "foo")
+	for i := 0; i < samples; i++ {
+		if err := writer.Write(start.Add(time.Duration(i)*time.Second), &valAdapter{v: float64(i), l: l}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if len(mem.times) != 1 {
+		t.Fatalf("want 1 series, got %d", len(mem.times))
+	}
+
+	counts := map[string]int{}
+	for key, times := range mem.times {
+		values := mem.samples[key]
+		for i := 1; i < len(times); i++ {
+			switch {
+			case times[i].Before(start):
+				t.Fatalf("sample %d is before the block range", i)
+			case times[i].Before(times[i-1]):
+				if start.Sub(times[i]) > DefaultOutOfOrderMaxAge {
+					t.Fatalf("sample %d is older than max age", i)
+				}
+				counts[reasonOutOfOrder]++
+			case times[i].Equal(times[i-1]) && values[i] == values[i-1]:
+				counts[reasonDuplicate]++
+			case times[i].Equal(times[i-1]):
+				counts[reasonAmend]++
+			}
+		}
+	}
+
+	// Out of order samples older than the block range are not injected.
+	want := map[string]float64{reasonOutOfOrder: 0.09, reasonDuplicate: 0.2, reasonAmend: 0.3}
+	for reason, rate := range want {
+		if got := float64(counts[reason]) / samples; got < rate*0.8 || got > rate*1.2 {
+			t.Errorf("want %s rate about %v, got %v", reason, rate, got)
+		}
+	}
+
+	for _, config := range []FaultConfig{{DuplicateRate: 1.5}, {AmendRate: -1}, {OutOfOrderMaxAge: -time.Second}} {
+		if _, err := NewFaultWriter(mem, config); err == nil {
+			t.Errorf("want error for config %+v", config)
+		}
+	}
+}
+
+func Test_faultWriter_BlockWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	blockWriter, err := NewBlockWriterWithConfig(BlockWriterConfig{
+		Dir:            dir,
+		InvalidSamples: CountInvalidSamples,
+		Metrics:        NewBlockWriterMetrics(reg),
+	})
+	if err != nil {
+		t.Fatalf("NewBlockWriterWithConfig: %v", err)
+	}
+
+	writer, err := NewFaultWriter(blockWriter, FaultConfig{
+		OutOfOrderRate: 0.1,
+		DuplicateRate:  0.1,
+		AmendRate:      0.1,
+	})
+	if err != nil {
+		t.Fatalf("NewFaultWriter: %v", err)
+	}
+
+	generatorConfig := DefaultGeneratorConfig(time.Hour)
+	generatorConfig.FlushInterval = time.Hour
+	valProvider := NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3})
+
+	g := NewGeneratorWithConfig(generatorConfig)
+	if err := g.Generate(writer, valProvider); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	report, err := VerifyBlocks(dir, VerifyConfig{
+		Retention:      generatorConfig.Retention,
+		SampleInterval: generatorConfig.SampleInterval,
+		SeriesCount:    6,
+	})
+	if err != nil {
+		t.Fatalf("VerifyBlocks: %v", err)
+	}
+	if !report.OK() {
+		t.Errorf("want valid blocks, got %s", report)
+	}
+
+	// Only the valid samples are appended, all injected ones are counted.
+	mfs := testMetricFamilies(t, reg)
+	appended := mfs["blockgen_samples_appended_total"].GetMetric()[0].GetCounter().GetValue()
+	if uint64(appended) != report.Samples {
+		t.Errorf("want %d samples appended, got %v", report.Samples, appended)
+	}
+
+	invalid := 0.0
+	for _, m := range mfs["blockgen_invalid_samples_total"].GetMetric() {
+		invalid += m.GetCounter().GetValue()
+	}
+	if invalid == 0 {
+		t.Errorf("want invalid samples counted")
+	}
+}
@@ -1,7 +1,11 @@
 package blockgen
 
 import (
+	"context"
 	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb"
+	"sync"
 	"time"
 )
 
@@ -10,17 +14,17 @@ type GeneratorConfig struct {
 	// Retention is the time interval for which to generate data, e.g.
 	// 8days = 8 * 24 * time.Hour. This is how much time back from `startTime`
 	// the metrics will go. Retention should be multiples of `FlushInterval`.
-	Retention time.Duration
+	Retention time.Duration `yaml:"retention"`
 
 	// StartTime is the time from which to generate metrics. The metrics
 	// are generated for the window [StartTime-Retention, StartTime].
 	//
 	// Good default value for this is time.Now() but may want to use some fixed
 	// value to make it easier to write repeatable queries for the data later.
-	StartTime time.Time
+	StartTime time.Time `yaml:"startTime"`
 
 	// SampleInterval is the interval between samples, 15s is default for Prometheus.
-	SampleInterval time.Duration
+	SampleInterval time.Duration `yaml:"sampleInterval"`
 
 	// FlushInterval is the interval at which blocks are written to disk.
 	// These are usually 2h.
@@ -28,7 +32,18 @@ type GeneratorConfig struct {
 	//
 	// NOTE: Flush is generally slow.
 	// Consider tuning this if you have little data or a lot of data.
-	FlushInterval time.Duration
+	FlushInterval time.Duration `yaml:"flushInterval"`
+
+	// Workers is the number of blocks generated concurrently by
+	// `GenerateParallel`. Default is 1.
+	Workers int `yaml:"workers"`
+
+	// AlignBlocks makes block boundaries multiples of FlushInterval since
+	// Unix epoch, same as Prometheus does. The first and last blocks are
+	// partial unless the window is aligned already. Retention then doesn't
+	// need to be multiples of FlushInterval, but FlushInterval must be one
+	// of `tsdb.DefaultOptions.BlockRanges` or `ThanosBlockRanges`.
+	AlignBlocks bool `yaml:"alignBlocks"`
 }
 
 // DefaultGeneratorConfig is the default configuration with specified retention.
@@ -61,47 +76,227 @@ func NewGeneratorWithConfig(config GeneratorConfig) Generator {
 
 // generator is implementation of Generator.
 type generator struct {
-	config GeneratorConfig
+	config   GeneratorConfig
+	progress progressTracker
 }
 
 // Generate implements Generator interface.
 func (g *generator) Generate(writer Writer, valGenerators ...ValProvider) error {
-	c := &g.config
+	return g.GenerateContext(context.Background(), writer, valGenerators...)
+}
 
-	// Basic sanity checks.
-	if c.Retention <= 0 {
-		return errors.New("retention must be positive duration")
+// GenerateContext implements Generator interface.
+func (g *generator) GenerateContext(ctx context.Context, writer Writer, valGenerators ...ValProvider) error {
+	if err := g.validate(); err != nil {
+		return err
 	}
 
-	if c.SampleInterval <= 0 {
-		return errors.New("sampleInterval must be positive duration")
+	g.progress.reset()
+	defer g.progress.finish()
+
+	// write stuff to TSDB from oldest to newest, one block after another.
+	for _, r := range g.ranges() {
+		if err := g.generateRange(ctx, writer, valGenerators, r); err != nil {
+			return discard(writer, err)
+		}
 	}
 
-	if c.FlushInterval <= 0 {
-		return errors.New("flushInterval must be positive duration")
+	return nil
+}
+
+// GenerateParallel implements Generator interface.
+func (g *generator) GenerateParallel(ctx context.Context, newWriter WriterFactory, newValProviders ValProviderFactory) error {
+	if err := g.validate(); err != nil {
+		return err
 	}
 
-	// TODO(ppanyukov): do we really need this?
-	// Make sure flushInterval is exactly multiples of sampleInterval.
-	// This is something to do with how TSDB is particular to block
-	// sizes etc, ask Bartek (:
-	// Ditto for flushInterval vs retention, as we want to produce full blocks.
-	if c.FlushInterval%c.SampleInterval != 0 {
-		return errors.New("flushInterval must be multiples of sampleInterval")
+	g.progress.reset()
+	defer g.progress.finish()
+
+	workers := g.config.Workers
+	if workers < 1 {
+		workers = 1
 	}
-	if c.Retention%c.FlushInterval != 0 {
-		return errors.New("retention must be multiples of flushInterval")
+
+	ranges := make(chan sampleRange, len(g.ranges()))
+	for _, r := range g.ranges() {
+		ranges <- r
+	}
+	close(ranges)
+
+	// The first error stops the other workers.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg  sync.WaitGroup
+		mtx sync.Mutex
+		res error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := g.worker(ctx, newWriter, newValProviders, ranges); err != nil {
+				mtx.Lock()
+				if res == nil {
+					res = err
+				}
+				mtx.Unlock()
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return res
+}
+
+// worker generates ranges from the chan until it's empty, with its own
+// writer and value providers. The ranges must be in ascending order.
+func (g *generator) worker(ctx context.Context, newWriter WriterFactory, newValProviders ValProviderFactory, ranges <-chan sampleRange) error {
+	writer, err := newWriter()
+	if err != nil {
+		return errors.Wrap(err, "newWriter")
+	}
+
+	valProviders, err := newValProviders()
+	if err != nil {
+		return discard(writer, errors.Wrap(err, "newValProviders"))
+	}
+
+	// positions are the indexes of the next sample of every provider.
+	positions := make([]int64, len(valProviders))
+
+	for r := range ranges {
+		for i, p := range valProviders {
+			if err := seek(p, positions[i], r.from); err != nil {
+				return discard(writer, errors.Wrap(err, "seek"))
+			}
+			positions[i] = r.to
+		}
+
+		if err := g.generateRange(ctx, writer, valProviders, r); err != nil {
+			return discard(writer, err)
+		}
+	}
+
+	return nil
+}
+
+// seek moves the provider from the sample index `from` to `to`.
+// Providers which are not `SampleSeeker` are moved by consuming their values.
+func seek(p ValProvider, from, to int64) error {
+	if s, ok := p.(SampleSeeker); ok {
+		return s.SeekSample(to)
+	}
+
+	for i := from; i < to; i++ {
+		for range p.Next() {
+		}
+	}
+
+	return nil
+}
+
+// sampleRange is the range of sample indexes [from, to) written into one block.
+type sampleRange struct {
+	from int64
+	to   int64
+
+	// mint and maxt are the aligned time range of the block, zero if
+	// blocks are not aligned.
+	mint time.Time
+	maxt time.Time
+}
+
+// ranges splits all samples into ranges of FlushInterval. The very last
+// sample at StartTime goes into its own range.
+func (g *generator) ranges() []sampleRange {
+	c := &g.config
+	if c.AlignBlocks {
+		return g.alignedRanges()
+	}
+
+	samplesPerFlush := int64(c.FlushInterval / c.SampleInterval)
+	samples := int64(c.Retention/c.SampleInterval) + 1
+
+	var res []sampleRange
+	for from := int64(0); from < samples; from += samplesPerFlush {
+		to := from + samplesPerFlush
+		if to > samples {
+			to = samples
+		}
+		res = append(res, sampleRange{from: from, to: to})
 	}
 
-	// write stuff to TSDB from oldest to newest
-	maxt := c.StartTime
-	mint := maxt.Add(-1 * c.Retention)
+	return res
+}
+
+// alignedRanges splits all samples into ranges by block boundaries, which
+// are multiples of FlushInterval, the same way as tsdb does.
+func (g *generator) alignedRanges() []sampleRange {
+	c := &g.config
 
-	// keep hold of last flush time so we flush at regular intervals
-	elapsed := time.Duration(0)
+	mint := c.StartTime.Add(-1 * c.Retention)
+	samples := int64(c.Retention/c.SampleInterval) + 1
+	blockRange := int64(c.FlushInterval / time.Millisecond)
+
+	var res []sampleRange
+	for i := int64(0); i < samples; i++ {
+		// The block of the sample, as tsdb.rangeForTimestamp but rounding
+		// down for negative timestamps too.
+		t := timestamp.FromTime(mint.Add(time.Duration(i) * c.SampleInterval))
+		blockMint := t - t%blockRange
+		if t%blockRange < 0 {
+			blockMint -= blockRange
+		}
+
+		if n := len(res); n > 0 && timestamp.FromTime(res[n-1].mint) == blockMint {
+			res[n-1].to = i + 1
+			continue
+		}
+
+		res = append(res, sampleRange{
+			from: i,
+			to:   i + 1,
+			mint: timestamp.Time(blockMint),
+			maxt: timestamp.Time(blockMint + blockRange),
+		})
+	}
 
-	for t := mint; !t.After(maxt); t = t.Add(c.SampleInterval) {
-		now := t
+	return res
+}
+
+// discard drops unflushed values of the writer after the error.
+func discard(writer Writer, err error) error {
+	if d, ok := writer.(Discarder); ok {
+		if derr := d.Discard(); derr != nil {
+			return errors.Wrapf(err, "discard failed: %v", derr)
+		}
+	}
+
+	return err
+}
+
+// generateRange writes the samples of the range and flushes the writer.
+// It returns the context error as is if the context is done.
+func (g *generator) generateRange(ctx context.Context, writer Writer, valGenerators []ValProvider, r sampleRange) error {
+	c := &g.config
+	mint := c.StartTime.Add(-1 * c.Retention)
+
+	if s, ok := writer.(BlockRangeSetter); ok && c.AlignBlocks {
+		s.SetBlockRange(r.mint, r.maxt)
+	}
+
+	for i := r.from; i < r.to; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		now := mint.Add(time.Duration(i) * c.SampleInterval)
+		samples := int64(0)
 
 		// grab values form generators, timestamp them and shove to the writer.
 		for _, generator := range valGenerators {
@@ -111,25 +306,80 @@ func (g *generator) Generate(writer Writer, valGenerators ...ValProvider) error
 				if err := writer.Write(now, val); err != nil {
 					return errors.Wrap(err, "writer.Write")
 				}
+				samples++
 			}
-		}
 
-		elapsed += c.SampleInterval
-
-		// Flush to disk when written enough data.
-		if elapsed >= c.FlushInterval {
-			if err := writer.Flush(); err != nil {
-				return errors.Wrap(err, "writer.Flush")
+			if terminator, ok := generator.(SeriesTerminator); ok {
+				for _, l := range terminator.Terminated() {
+					if err := writer.Write(now, newStaleVal(l)); err != nil {
+						return errors.Wrap(err, "writer.Write staleness marker")
+					}
+					samples++
+				}
 			}
-
-			elapsed = 0
 		}
+
+		g.progress.step(samples)
 	}
 
-	// NOTE: no defer write.Flush on purpose
+	// Flush to disk when written enough data.
 	if err := writer.Flush(); err != nil {
-		return errors.Wrap(err, "last writer.Flush")
+		return errors.Wrap(err, "writer.Flush")
+	}
+	g.progress.flushed()
+
+	return nil
+}
+
+// validate does basic sanity checks of the config.
+func (g *generator) validate() error {
+	c := &g.config
+
+	if c.Retention <= 0 {
+		return errors.New("retention must be positive duration")
+	}
+
+	if c.SampleInterval <= 0 {
+		return errors.New("sampleInterval must be positive duration")
+	}
+
+	if c.FlushInterval <= 0 {
+		return errors.New("flushInterval must be positive duration")
+	}
+
+	// TODO(ppanyukov): do we really need this?
+	// Make sure flushInterval is exactly multiples of sampleInterval.
+	// This is something to do with how TSDB is particular to block
+	// sizes etc, ask Bartek (:
+	// Ditto for flushInterval vs retention, as we want to produce full blocks.
+	if c.FlushInterval%c.SampleInterval != 0 {
+		return errors.New("flushInterval must be multiples of sampleInterval")
+	}
+
+	if c.AlignBlocks {
+		return validateBlockRange(c.FlushInterval)
+	}
+
+	if c.Retention%c.FlushInterval != 0 {
+		return errors.New("retention must be multiples of flushInterval")
 	}
 
 	return nil
 }
+
+// validateBlockRange checks that tsdb or Thanos would produce blocks of this range.
+func validateBlockRange(d time.Duration) error {
+	var valid []time.Duration
+	for _, r := range tsdb.DefaultOptions.BlockRanges {
+		valid = append(valid, time.Duration(r)*time.Millisecond)
+	}
+	valid = append(valid, ThanosBlockRanges...)
+
+	for _, r := range valid {
+		if r == d {
+			return nil
+		}
+	}
+
+	return errors.Errorf("flushInterval must be one of tsdb or Thanos block ranges %v with alignBlocks", valid)
+}
@@ -0,0 +1,428 @@
+package blockgen
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestValProviders() ([]ValProvider, error) {
+	randValProvider, err := NewRandValProvider(RandValProviderConfig{
+		Metrics: []MetricConfig{
+			{Name: "foo_total", Type: Counter},
+		},
+		TargetCount: 3,
+		Seed:        1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	churnProvider, err := NewChurnProvider(NewValProvider(ValProviderConfig{
+		MetricCount: 2,
+		TargetCount: 3,
+	}), ChurnConfig{
+		MeanLifetime:   20 * time.Minute,
+		SampleInterval: 15 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []ValProvider{randValProvider, churnProvider}, nil
+}
+
+type testSample struct {
+	t int64
+	v uint64
+}
+
+// testSamples merges the samples from the writers, sorted by time.
+func testSamples(writers ...*memWriter) map[string][]testSample {
+	res := map[string][]testSample{}
+	for _, w := range writers {
+		for key, values := range w.samples {
+			for i, v := range values {
+				res[key] = append(res[key], testSample{t: w.times[key][i].UnixNano(), v: math.Float64bits(v)})
+			}
+		}
+	}
+
+	for _, samples := range res {
+		sort.Slice(samples, func(i, j int) bool {
+			return samples[i].t < samples[j].t
+		})
+	}
+
+	return res
+}
+
+func Test_generator_GenerateParallel(t *testing.T) {
+	config := DefaultGeneratorConfig(6 * time.Hour)
+	config.FlushInterval = 30 * time.Minute
+	config.Workers = 4
+
+	serial := &memWriter{}
+	valProviders, err := newTestValProviders()
+	if err != nil {
+		t.Fatalf("newTestValProviders: %v", err)
+	}
+	if err := NewGeneratorWithConfig(config).Generate(serial, valProviders...); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	var mtx sync.Mutex
+	var parallel []*memWriter
+	newWriter := func() (Writer, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		w := &memWriter{}
+		parallel = append(parallel, w)
+		return w, nil
+	}
+
+	if err := NewGeneratorWithConfig(config).GenerateParallel(context.Background(), newWriter, newTestValProviders); err != nil {
+		t.Fatalf("GenerateParallel: %v", err)
+	}
+
+	if len(parallel) != 4 {
+		t.Fatalf("want 4 writers, got %d", len(parallel))
+	}
+
+	flushes := 0
+	for _, w := range parallel {
+		flushes += w.flushes
+	}
+	if flushes != serial.flushes {
+		t.Errorf("want %d flushes, got %d", serial.flushes, flushes)
+	}
+
+	want, got := testSamples(serial), testSamples(parallel...)
+	if len(want) != len(got) {
+		t.Fatalf("want %d series, got %d", len(want), len(got))
+	}
+
+	for key, samples := range want {
+		if len(samples) != len(got[key]) {
+			t.Fatalf("%s: want %d samples, got %d", key, len(samples), len(got[key]))
+		}
+
+		for i := range samples {
+			if samples[i] != got[key][i] {
+				t.Fatalf("%s: sample %d: want %v, got %v", key, i, samples[i], got[key][i])
+			}
+		}
+	}
+}
+
+// seekFailingProvider fails to seek to any but the first sample.
+type seekFailingProvider struct {
+	ValProvider
+}
+
+func (p *seekFailingProvider) SeekSample(index int64) error {
+	if index > 0 {
+		return errors.New("seek failed")
+	}
+	return nil
+}
+
+func Test_generator_GenerateParallel_Error(t *testing.T) {
+	config := DefaultGeneratorConfig(6 * time.Hour)
+	config.FlushInterval = 30 * time.Minute
+	config.Workers = 4
+
+	var mtx sync.Mutex
+	var writers []*discardWriter
+	newWriter := func() (Writer, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		w := &discardWriter{}
+		writers = append(writers, w)
+		return w, nil
+	}
+
+	newValProviders := func() ([]ValProvider, error) {
+		return []ValProvider{&seekFailingProvider{NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3})}}, nil
+	}
+
+	err := NewGeneratorWithConfig(config).GenerateParallel(context.Background(), newWriter, newValProviders)
+	if err == nil || errors.Cause(err).Error() != "seek failed" {
+		t.Fatalf("want seek error, got %v", err)
+	}
+
+	// The worker which got the first range may finish it or be cancelled,
+	// all the others fail to seek.
+	discards := 0
+	for _, w := range writers {
+		discards += w.discards
+	}
+	if discards < len(writers)-1 {
+		t.Errorf("want at least %d writers discarded, got %d", len(writers)-1, discards)
+	}
+}
+
+// cancelWriter cancels the context after the given number of writes.
+type cancelWriter struct {
+	Writer
+	cancel context.CancelFunc
+	writes int
+}
+
+func (w *cancelWriter) Write(t time.Time, v Val) error {
+	w.writes--
+	if w.writes == 0 {
+		w.cancel()
+	}
+	return w.Writer.Write(t, v)
+}
+
+func (w *cancelWriter) Discard() error {
+	return w.Writer.(Discarder).Discard()
+}
+
+func Test_generator_GenerateContext_Cancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Being written by another writer into the same dir, must be kept.
+	other := filepath.Join(dir, "01DQ7GDYV2XW8BRH4SKN3FPVJ3.tmp")
+	if err := os.MkdirAll(other, os.ModePerm); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	blockWriter, err := NewBlockWriter(dir)
+	if err != nil {
+		t.Fatalf("NewBlockWriter: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 6 series, 8 samples per block, cancel in the middle of third block.
+	writer := &cancelWriter{Writer: blockWriter, cancel: cancel, writes: 6 * 20}
+	valProvider := NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3})
+
+	config := DefaultGeneratorConfig(10 * time.Minute)
+	config.FlushInterval = 2 * time.Minute
+
+	err = NewGeneratorWithConfig(config).GenerateContext(ctx, writer, valProvider)
+	if err != context.Canceled {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
+
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("want tmp dir of another writer kept: %v", err)
+	}
+	if err := os.Remove(other); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("want 2 complete blocks, got %d files", len(files))
+	}
+
+	for _, f := range files {
+		meta, err := ReadThanosMeta(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatalf("%s: ReadThanosMeta: %v", f.Name(), err)
+		}
+
+		if meta.Stats.NumSamples != 6*8 {
+			t.Errorf("%s: want %d samples, got %d", f.Name(), 6*8, meta.Stats.NumSamples)
+		}
+	}
+}
+
+func Test_generator_AlignBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, err := NewBlockWriter(dir)
+	if err != nil {
+		t.Fatalf("NewBlockWriter: %v", err)
+	}
+
+	config := DefaultGeneratorConfig(5 * time.Hour)
+	config.StartTime = time.Date(2019, time.September, 30, 1, 17, 0, 0, time.UTC)
+	config.AlignBlocks = true
+
+	valProvider := NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3})
+	if err := NewGeneratorWithConfig(config).Generate(writer, valProvider); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	metaFiles, err := filepath.Glob(filepath.Join(dir, "*", metaFilename))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+
+	// 20:17-22:00, 22:00-00:00 and 00:00-01:17 with the last sample.
+	if len(metaFiles) != 3 {
+		t.Fatalf("want 3 blocks, got %d", len(metaFiles))
+	}
+
+	blockRange := int64(2 * time.Hour / time.Millisecond)
+	var samples uint64
+	for _, f := range metaFiles {
+		meta, err := ReadThanosMeta(filepath.Dir(f))
+		if err != nil {
+			t.Fatalf("ReadThanosMeta: %v", err)
+		}
+
+		if meta.MinTime%blockRange != 0 || meta.MaxTime != meta.MinTime+blockRange {
+			t.Errorf("%s: block [%d, %d) not aligned to 2h", f, meta.MinTime, meta.MaxTime)
+		}
+		samples += meta.Stats.NumSamples
+	}
+
+	// Retention/SampleInterval+1 samples of each of 6 series.
+	if want := uint64(5*60*4+1) * 6; samples != want {
+		t.Errorf("want %d samples, got %d", want, samples)
+	}
+}
+
+func Test_generator_AlignBlocks_Validate(t *testing.T) {
+	config := DefaultGeneratorConfig(5 * time.Hour)
+	config.AlignBlocks = true
+
+	config.FlushInterval = time.Hour
+	if err := NewGeneratorWithConfig(config).Generate(&memWriter{}); err == nil {
+		t.Errorf("want error for block range %s", config.FlushInterval)
+	}
+
+	config.FlushInterval = 10 * time.Hour
+	if err := NewGeneratorWithConfig(config).Generate(&memWriter{}); err != nil {
+		t.Errorf("want no error for block range %s, got %v", config.FlushInterval, err)
+	}
+}
+
+func Test_SampleSeeker(t *testing.T) {
+	newProviders := func() map[string]ValProvider {
+		res := map[string]ValProvider{
+			"valProvider": NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3}),
+		}
+
+		var err error
+		if res["randValProvider"], err = NewRandValProvider(RandValProviderConfig{
+			Metrics:     []MetricConfig{{Name: "foo_total", Type: Counter}, {Name: "foo", Type: Gauge}},
+			TargetCount: 3,
+			Seed:        1,
+		}); err != nil {
+			t.Fatalf("NewRandValProvider: %v", err)
+		}
+
+		if res["histogramProvider"], err = NewHistogramProvider(HistogramProviderConfig{
+			Name:                  "foo_seconds",
+			TargetCount:           2,
+			Buckets:               BucketLayout{Type: LinearBuckets, Start: 0.1, Width: 0.1, Count: 5},
+			Observations:          randval.DistConfig{Type: randval.Normal, Mean: 0.3, StdDev: 0.1},
+			ObservationsPerSample: 10,
+			Seed:                  2,
+		}); err != nil {
+			t.Fatalf("NewHistogramProvider: %v", err)
+		}
+
+		if res["summaryProvider"], err = NewSummaryProvider(SummaryProviderConfig{
+			Name:                  "foo_seconds",
+			TargetCount:           2,
+			Observations:          randval.DistConfig{Type: randval.LogNormal, Mean: -2, StdDev: 1},
+			ObservationsPerSample: 10,
+			Seed:                  3,
+		}); err != nil {
+			t.Fatalf("NewSummaryProvider: %v", err)
+		}
+
+		for _, dist := range []LifetimeDist{ExponentialLifetime, FixedLifetime, NormalLifetime} {
+			targets := []labels.Labels{
+				labels.FromStrings("pod", "a", "namespace", "x"),
+				labels.FromStrings("pod", "b", "namespace", "x"),
+				labels.FromStrings("pod", "c", "namespace", "y"),
+			}
+
+			// Churn of the provider which is not SampleSeeker.
+			inner := NewLabelSchemaProvider(&countingProvider{
+				ValProvider: NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3}),
+			}, targets)
+			if res["churnProvider/"+string(dist)], err = NewChurnProvider(inner, ChurnConfig{
+				MeanLifetime:   10 * time.Minute,
+				LifetimeDist:   dist,
+				LifetimeStdDev: 2 * time.Minute,
+				SampleInterval: 15 * time.Second,
+				TargetLabel:    "pod",
+				Seed:           4,
+			}); err != nil {
+				t.Fatalf("NewChurnProvider: %v", err)
+			}
+		}
+
+		return res
+	}
+
+	// take returns the values and staleness markers of the next samples.
+	take := func(p ValProvider, samples int) []string {
+		var res []string
+		for i := 0; i < samples; i++ {
+			for v := range p.Next() {
+				res = append(res, fmt.Sprintf("%d %s %v", i, v.Labels(), v.Val()))
+			}
+			if terminator, ok := p.(SeriesTerminator); ok {
+				for _, l := range terminator.Terminated() {
+					res = append(res, fmt.Sprintf("%d %s stale", i, l))
+				}
+			}
+		}
+		return res
+	}
+
+	drained, seeked := newProviders(), newProviders()
+	for name, p := range drained {
+		take(p, 200)
+		want := take(p, 100)
+
+		s, ok := seeked[name].(SampleSeeker)
+		if !ok {
+			t.Fatalf("%s: want SampleSeeker", name)
+		}
+		if err := s.SeekSample(200); err != nil {
+			t.Fatalf("%s: SeekSample: %v", name, err)
+		}
+
+		got := take(seeked[name], 100)
+		if len(got) != len(want) {
+			t.Fatalf("%s: want %d values after seek, got %d", name, len(want), len(got))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%s: want %s after seek, got %s", name, want[i], got[i])
+			}
+		}
+
+		if err := s.SeekSample(100); err == nil {
+			t.Errorf("%s: want error seeking back", name)
+		}
+	}
+}
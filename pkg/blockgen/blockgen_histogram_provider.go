@@ -0,0 +1,256 @@
+package blockgen
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// BucketLayoutType is the way histogram bucket bounds are calculated.
+type BucketLayoutType string
+
+const (
+	// LinearBuckets are Count buckets: Start, Start+Width, Start+2*Width, ...
+	LinearBuckets BucketLayoutType = "linear"
+
+	// ExponentialBuckets are Count buckets: Start, Start*Factor, Start*Factor^2, ...
+	ExponentialBuckets BucketLayoutType = "exponential"
+
+	// ExplicitBuckets are bucket upper bounds listed in Bounds.
+	ExplicitBuckets BucketLayoutType = "explicit"
+)
+
+// BucketLayout configures the upper bounds of histogram buckets, not
+// including +Inf which is always added.
+type BucketLayout struct {
+	Type   BucketLayoutType `yaml:"type"`
+	Start  float64          `yaml:"start"`
+	Width  float64          `yaml:"width"`
+	Factor float64          `yaml:"factor"`
+	Count  int              `yaml:"count"`
+	Bounds []float64        `yaml:"bounds"`
+}
+
+// upperBounds returns sorted bucket upper bounds, without +Inf.
+func (l BucketLayout) upperBounds() ([]float64, error) {
+	var res []float64
+
+	switch l.Type {
+	case LinearBuckets:
+		if l.Count < 1 {
+			return nil, errors.New("linear buckets: count must be positive")
+		}
+		if l.Width <= 0 {
+			return nil, errors.New("linear buckets: width must be positive")
+		}
+		for i := 0; i < l.Count; i++ {
+			res = append(res, l.Start+float64(i)*l.Width)
+		}
+	case ExponentialBuckets:
+		if l.Count < 1 {
+			return nil, errors.New("exponential buckets: count must be positive")
+		}
+		if l.Start <= 0 {
+			return nil, errors.New("exponential buckets: start must be positive")
+		}
+		if l.Factor <= 1 {
+			return nil, errors.New("exponential buckets: factor must be greater than 1")
+		}
+		for i := 0; i < l.Count; i++ {
+			res = append(res, l.Start*math.Pow(l.Factor, float64(i)))
+		}
+	case ExplicitBuckets:
+		if len(l.Bounds) == 0 {
+			return nil, errors.New("explicit buckets: bounds must be set")
+		}
+		res = append(res, l.Bounds...)
+		sort.Float64s(res)
+		for i := 1; i < len(res); i++ {
+			if res[i] == res[i-1] {
+				return nil, errors.Errorf("explicit buckets: duplicate bound %v", res[i])
+			}
+		}
+	default:
+		return nil, errors.Errorf("unknown bucket layout type '%s'", l.Type)
+	}
+
+	return res, nil
+}
+
+// HistogramProviderConfig configures the `ValProvider` returned by `NewHistogramProvider`.
+//
+// For each target it produces the classic Prometheus histogram family:
+// `<Name>_bucket` series for every bucket including `le="+Inf"`,
+// `<Name>_sum` and `<Name>_count`.
+type HistogramProviderConfig struct {
+	// Name is the base name of the histogram, e.g. http_request_duration_seconds.
+	Name string `yaml:"name"`
+
+	// TargetCount is the number of simulated collection targets.
+	TargetCount int `yaml:"targetCount"`
+
+	// Buckets configures the bucket bounds.
+	Buckets BucketLayout `yaml:"buckets"`
+
+	// Observations is the distribution of the observed values, e.g. latencies.
+	// Negative observations are recorded as zero.
+	Observations randval.DistConfig `yaml:"observations"`
+
+	// ObservationsPerSample is the average number of observations
+	// made between two samples. The actual number is random in
+	// range [0, 2*ObservationsPerSample]. The observations are spread
+	// over the buckets in proportion to their distribution.
+	ObservationsPerSample int `yaml:"observationsPerSample"`
+
+	// Seed is the random seed.
+	Seed int64 `yaml:"seed"`
+}
+
+// NewHistogramProvider creates new ValProvider which produces histograms.
+// Bucket counts are cumulative, never decrease and the `+Inf` bucket
+// is always equal to `_count`.
+func NewHistogramProvider(config HistogramProviderConfig) (ValProvider, error) {
+	if config.Name == "" {
+		return nil, errors.New("name must be set")
+	}
+
+	if config.TargetCount <= 0 {
+		return nil, errors.New("targetCount must be positive")
+	}
+
+	if config.ObservationsPerSample < 0 {
+		return nil, errors.New("observationsPerSample must not be negative")
+	}
+
+	if err := config.Observations.Validate(); err != nil {
+		return nil, errors.Wrap(err, "observations")
+	}
+
+	bounds, err := config.Buckets.upperBounds()
+	if err != nil {
+		return nil, errors.Wrap(err, "buckets")
+	}
+
+	// Negative observations are recorded as zero, so they are in every bucket.
+	var fractions []float64
+	for _, b := range bounds {
+		f := 0.0
+		if b >= 0 {
+			f = config.Observations.CDF(b)
+		}
+		fractions = append(fractions, f)
+	}
+
+	var targets []*histogramTarget
+	for targetIndex := 0; targetIndex < config.TargetCount; targetIndex++ {
+		target := fmt.Sprintf("target_%d", targetIndex)
+
+		h := &histogramTarget{
+			sumLabels:   labels.FromStrings("__name__", config.Name+"_sum", "target", target),
+			countLabels: labels.FromStrings("__name__", config.Name+"_count", "target", target),
+			seed:        int64(randval.Uint64(config.Seed, int64(targetIndex))),
+		}
+
+		for _, b := range bounds {
+			h.bucketLabels = append(h.bucketLabels, labels.FromStrings(
+				"__name__", config.Name+"_bucket",
+				"le", formatFloatLabel(b),
+				"target", target,
+			))
+		}
+		h.bucketLabels = append(h.bucketLabels, labels.FromStrings(
+			"__name__", config.Name+"_bucket",
+			"le", "+Inf",
+			"target", target,
+		))
+
+		targets = append(targets, h)
+	}
+
+	return &histogramProvider{
+		config:    config,
+		fractions: fractions,
+		mean:      config.Observations.PositiveMean(),
+		targets:   targets,
+	}, nil
+}
+
+// formatFloatLabel formats `le` and `quantile` label values the same way
+// Prometheus client does.
+func formatFloatLabel(b float64) string {
+	return strconv.FormatFloat(b, 'g', -1, 64)
+}
+
+// histogramTarget is one histogram of one target.
+type histogramTarget struct {
+	bucketLabels []labels.Labels
+	sumLabels    labels.Labels
+	countLabels  labels.Labels
+
+	// seed is the random seed of the target.
+	seed int64
+}
+
+// histogramProvider is implementation of `ValProvider` for histograms.
+//
+// The histogram is not accumulated from the observations, it is calculated
+// from the sample index instead, so that seeking is cheap. The number of
+// observations by the sample i is `ObservationsPerSample * (i + 1 + u)`
+// where u is random in range [0, 1) for every target and sample, so
+// the number of observations between two samples is random in range
+// [0, 2*ObservationsPerSample]. The buckets have the same shares of them
+// as the distribution of observations.
+type histogramProvider struct {
+	config  HistogramProviderConfig
+	targets []*histogramTarget
+
+	// fractions are the shares of observations in every bucket, without +Inf.
+	fractions []float64
+
+	// mean is the mean observation.
+	mean float64
+
+	// pos is the index of the next sample.
+	pos int64
+}
+
+// Next implements ValProvider interface.
+func (g *histogramProvider) Next() <-chan Val {
+	c := make(chan Val)
+	sample := g.pos
+	g.pos++
+
+	go func() {
+		defer close(c)
+
+		perSample := float64(g.config.ObservationsPerSample)
+		for _, h := range g.targets {
+			x := float64(sample+1) + randval.Float64(h.seed, sample)
+			count := math.Floor(perSample * x)
+
+			// Cumulative buckets never decrease as the fractions and x grow.
+			for i, f := range g.fractions {
+				c <- &valAdapter{v: math.Floor(perSample * f * x), l: h.bucketLabels[i]}
+			}
+			c <- &valAdapter{v: count, l: h.bucketLabels[len(g.fractions)]}
+			c <- &valAdapter{v: g.mean * perSample * x, l: h.sumLabels}
+			c <- &valAdapter{v: count, l: h.countLabels}
+		}
+	}()
+
+	return c
+}
+
+// SeekSample implements SampleSeeker interface.
+func (g *histogramProvider) SeekSample(index int64) error {
+	if index < g.pos {
+		return errors.Errorf("cannot seek back from sample %d to %d", g.pos, index)
+	}
+
+	g.pos = index
+	return nil
+}
@@ -0,0 +1,66 @@
+package blockgen
+
+import (
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	"testing"
+)
+
+func Test_histogramProvider_Next(t *testing.T) {
+	config := HistogramProviderConfig{
+		Name:        "http_request_duration_seconds",
+		TargetCount: 2,
+		Buckets: BucketLayout{
+			Type:   ExponentialBuckets,
+			Start:  0.005,
+			Factor: 2,
+			Count:  10,
+		},
+		Observations: randval.DistConfig{
+			Type:    randval.Bimodal,
+			Mean:    0.05,
+			StdDev:  0.01,
+			Mean2:   1,
+			StdDev2: 0.2,
+			Weight2: 0.1,
+		},
+		ObservationsPerSample: 20,
+		Seed:                  1,
+	}
+
+	p, err := NewHistogramProvider(config)
+	if err != nil {
+		t.Fatalf("NewHistogramProvider: %v", err)
+	}
+
+	last := map[string]float64{}
+	for i := 0; i < 50; i++ {
+		// bucket values in order of emission per target
+		var buckets []float64
+		for v := range p.Next() {
+			l := v.Labels()
+			key := l.String()
+			if v.Val() < last[key] {
+				t.Fatalf("sample %d: %s went down from %v to %v", i, key, last[key], v.Val())
+			}
+			last[key] = v.Val()
+
+			switch l.Get("__name__") {
+			case "http_request_duration_seconds_bucket":
+				if n := len(buckets); n > 0 && v.Val() < buckets[n-1] {
+					t.Fatalf("sample %d: %s is less than previous bucket", i, key)
+				}
+				buckets = append(buckets, v.Val())
+			case "http_request_duration_seconds_count":
+				if inf := buckets[len(buckets)-1]; inf != v.Val() {
+					t.Fatalf("sample %d: +Inf bucket %v != count %v", i, inf, v.Val())
+				}
+				buckets = nil
+			}
+		}
+	}
+
+	// (10 buckets + Inf + sum + count) x 2 targets
+	if len(last) != 26 {
+		t.Errorf("want 26 series, got %d", len(last))
+	}
+}
@@ -1,6 +1,7 @@
 package blockgen
 
 import (
+	"context"
 	"github.com/prometheus/prometheus/tsdb/labels"
 	"time"
 )
@@ -18,6 +19,28 @@ type ValProvider interface {
 	Next() <-chan Val
 }
 
+// SampleSeeker is optionally implemented by ValProvider which can cheaply skip
+// samples. Providers which don't implement it are moved forward by
+// consuming their values.
+type SampleSeeker interface {
+	// SeekSample makes the next call to `Next` return values for the sample with
+	// given index, zero being the first sample. The result must be the same
+	// as if all the previous samples were consumed. The index must not
+	// be less than the index of the next sample.
+	SeekSample(index int64) error
+}
+
+// SeriesTerminator is optionally implemented by ValProvider to signal that
+// some series have ended, e.g. because the simulated target went away.
+type SeriesTerminator interface {
+	// Terminated returns the series which were produced by the previous
+	// call to `Next` but will not be produced anymore. It is called after
+	// the values of the latest `Next` are consumed. The generator writes
+	// staleness markers for these series with the latest timestamp, i.e.
+	// one sample interval after their last value, same as Prometheus does.
+	Terminated() []labels.Labels
+}
+
 // Writer is interface to write time series into Prometheus blocks.
 type Writer interface {
 	// Writes one value, into memory.
@@ -29,8 +52,48 @@ type Writer interface {
 	Flush() error
 }
 
+// Discarder is optionally implemented by Writer which can drop everything
+// written since the last `Flush`, e.g. when generation is cancelled.
+type Discarder interface {
+	// Discard drops the values written since the last Flush and cleans up
+	// any partially written output. More writes can continue after it.
+	Discard() error
+}
+
+// BlockRangeSetter is optionally implemented by Writer which can write
+// blocks with given time range rather than the range of written values.
+type BlockRangeSetter interface {
+	// SetBlockRange sets the time range [mint, maxt) of the block written
+	// by the next `Flush`. All values written until then must be in the
+	// range. It is called before the values of the block are written.
+	SetBlockRange(mint, maxt time.Time)
+}
+
+// WriterFactory creates new Writer, e.g. one for each parallel worker.
+type WriterFactory func() (Writer, error)
+
+// ValProviderFactory creates new list of ValProviders. Every call must
+// return providers which produce exactly the same values.
+type ValProviderFactory func() ([]ValProvider, error)
+
 // Generator generates synthetic time series using values produced by supplied
 // list of `ValProvider` and writes them to TSDB blocks using supplied `Writer`.
 type Generator interface {
 	Generate(writer Writer, valGenerators ...ValProvider) error
+
+	// GenerateContext is like Generate but stops between samples when the
+	// context is done. The values written since the last flush are then
+	// discarded if the writer is `Discarder`, and the context error is
+	// returned.
+	GenerateContext(ctx context.Context, writer Writer, valGenerators ...ValProvider) error
+
+	// GenerateParallel is like GenerateContext but generates blocks
+	// concurrently, each worker with its own writer and value providers.
+	// Every worker seeks its providers to the start of the block so the
+	// output is the same as of Generate.
+	GenerateParallel(ctx context.Context, newWriter WriterFactory, newValProviders ValProviderFactory) error
+
+	// Progress returns the progress of the current or last generation.
+	// It is safe to call concurrently with generation.
+	Progress() Progress
 }
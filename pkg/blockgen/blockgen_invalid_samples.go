@@ -0,0 +1,118 @@
+package blockgen
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"math"
+)
+
+// InvalidSamplePolicy is what block writers do with samples which TSDB
+// would not append: out of order ones, i.e. older than the latest sample
+// of the series, and duplicates of the latest sample.
+type InvalidSamplePolicy string
+
+const (
+	// FailInvalidSamples makes `Write` return `tsdb.ErrOutOfOrderSample`
+	// or `tsdb.ErrAmendSample`, same as TSDB appender does. Exact
+	// duplicates are dropped, TSDB allows them. This is the default.
+	FailInvalidSamples InvalidSamplePolicy = "fail"
+
+	// DropInvalidSamples drops all invalid samples silently.
+	DropInvalidSamples InvalidSamplePolicy = "drop"
+
+	// CountInvalidSamples drops all invalid samples, counts them by
+	// reason in `blockgen_invalid_samples_total` metric and logs the
+	// counts at every `Flush`.
+	CountInvalidSamples InvalidSamplePolicy = "count"
+)
+
+// Reasons of invalid samples, the values of `reason` label.
+const (
+	reasonOutOfOrder = "out_of_order"
+	reasonDuplicate  = "duplicate"
+	reasonAmend      = "amend"
+)
+
+// sampleChecker applies the InvalidSamplePolicy in block writers.
+type sampleChecker struct {
+	logger  log.Logger
+	policy  InvalidSamplePolicy
+	metrics *BlockWriterMetrics
+
+	// counts are the invalid samples by reason since the last flush.
+	counts map[string]int64
+}
+
+// newSampleChecker creates checker for the policy, default if empty.
+func newSampleChecker(logger log.Logger, policy InvalidSamplePolicy, metrics *BlockWriterMetrics) (*sampleChecker, error) {
+	switch policy {
+	case "":
+		policy = FailInvalidSamples
+	case FailInvalidSamples, DropInvalidSamples, CountInvalidSamples:
+	default:
+		return nil, errors.Errorf("invalid sample policy must be one of %s, %s or %s, got '%s'",
+			FailInvalidSamples, DropInvalidSamples, CountInvalidSamples, policy)
+	}
+
+	return &sampleChecker{
+		logger:  logger,
+		policy:  policy,
+		metrics: metrics,
+		counts:  map[string]int64{},
+	}, nil
+}
+
+// check returns true if the sample (t, v) of the series with the latest
+// sample (lastT, lastV) is to be appended. The error is returned only by
+// the fail policy.
+func (c *sampleChecker) check(l labels.Labels, lastT int64, lastV float64, t int64, v float64) (bool, error) {
+	var reason string
+	var err error
+
+	switch {
+	case t > lastT:
+		return true, nil
+	case t < lastT:
+		reason, err = reasonOutOfOrder, tsdb.ErrOutOfOrderSample
+	case math.Float64bits(v) != math.Float64bits(lastV):
+		reason, err = reasonAmend, tsdb.ErrAmendSample
+	default:
+		reason = reasonDuplicate
+	}
+
+	if err != nil && c.policy == FailInvalidSamples {
+		return false, errors.Wrapf(err, "series %s", l)
+	}
+
+	if c.policy == CountInvalidSamples {
+		c.counts[reason]++
+		if c.metrics != nil {
+			c.metrics.invalidSamples.WithLabelValues(reason).Inc()
+		}
+	}
+
+	return false, nil
+}
+
+// flush logs the counts since the last flush.
+func (c *sampleChecker) flush() {
+	if len(c.counts) == 0 {
+		return
+	}
+
+	level.Info(c.logger).Log(
+		"msg", "dropped invalid samples",
+		reasonOutOfOrder, c.counts[reasonOutOfOrder],
+		reasonDuplicate, c.counts[reasonDuplicate],
+		reasonAmend, c.counts[reasonAmend])
+
+	c.reset()
+}
+
+// reset forgets the counts since the last flush, e.g. on discard.
+func (c *sampleChecker) reset() {
+	c.counts = map[string]int64{}
+}
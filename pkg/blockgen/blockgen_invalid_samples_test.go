@@ -0,0 +1,116 @@
+package blockgen
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_InvalidSamplePolicy(t *testing.T) {
+	writers := map[string]func(BlockWriterConfig) (Writer, error){
+		"block":     NewBlockWriterWithConfig,
+		"streaming": NewStreamingBlockWriter,
+	}
+
+	for name, newWriter := range writers {
+		t.Run(name, func(t *testing.T) {
+			for _, policy := range []InvalidSamplePolicy{"", FailInvalidSamples, DropInvalidSamples, CountInvalidSamples} {
+				testInvalidSamplePolicy(t, newWriter, policy)
+			}
+
+			if _, err := newWriter(BlockWriterConfig{Dir: "unused", InvalidSamples: "ignore"}); err == nil {
+				t.Errorf("want error for unknown policy")
+			}
+		})
+	}
+}
+
+func testInvalidSamplePolicy(t *testing.T, newWriter func(BlockWriterConfig) (Writer, error), policy InvalidSamplePolicy) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	writer, err := newWriter(BlockWriterConfig{
+		Dir:            dir,
+		InvalidSamples: policy,
+		Metrics:        NewBlockWriterMetrics(reg),
+	})
+	if err != nil {
+		t.Fatalf("%s: create writer: %v", policy, err)
+	}
+
+	now := time.Now()
+	l := labels.FromStrings("__name__", "foo")
+	write := func(t time.Time, v float64) error {
+		return writer.Write(t, &valAdapter{v: v, l: l})
+	}
+
+	if err := write(now, 1); err != nil {
+		t.Fatalf("%s: Write: %v", policy, err)
+	}
+
+	// Exact duplicates are dropped by every policy.
+	if err := write(now, 1); err != nil {
+		t.Errorf("%s: want no error for duplicate, got %v", policy, err)
+	}
+
+	fail := policy == "" || policy == FailInvalidSamples
+
+	err = write(now.Add(-time.Minute), 2)
+	if fail && errors.Cause(err) != tsdb.ErrOutOfOrderSample {
+		t.Errorf("%s: want out of order error, got %v", policy, err)
+	}
+	if !fail && err != nil {
+		t.Errorf("%s: want no error for out of order sample, got %v", policy, err)
+	}
+
+	err = write(now, 3)
+	if fail && errors.Cause(err) != tsdb.ErrAmendSample {
+		t.Errorf("%s: want amend error, got %v", policy, err)
+	}
+	if !fail && err != nil {
+		t.Errorf("%s: want no error for amended sample, got %v", policy, err)
+	}
+
+	// The invalid samples must not break the series.
+	if err := write(now.Add(time.Minute), 4); err != nil {
+		t.Fatalf("%s: Write: %v", policy, err)
+	}
+
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("%s: Flush: %v", policy, err)
+	}
+
+	report, err := VerifyBlocks(dir, VerifyConfig{SampleInterval: time.Minute})
+	if err != nil {
+		t.Fatalf("%s: VerifyBlocks: %v", policy, err)
+	}
+	if !report.OK() || report.Samples != 2 {
+		t.Errorf("%s: want 2 valid samples, got %s", policy, report)
+	}
+
+	mfs := testMetricFamilies(t, reg)
+	counts := map[string]float64{}
+	for _, m := range mfs["blockgen_invalid_samples_total"].GetMetric() {
+		counts[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+	}
+
+	want := map[string]float64{}
+	if policy == CountInvalidSamples {
+		want = map[string]float64{reasonOutOfOrder: 1, reasonDuplicate: 1, reasonAmend: 1}
+	}
+
+	for _, reason := range []string{reasonOutOfOrder, reasonDuplicate, reasonAmend} {
+		if counts[reason] != want[reason] {
+			t.Errorf("%s: want %v %s samples counted, got %v", policy, want[reason], reason, counts[reason])
+		}
+	}
+}
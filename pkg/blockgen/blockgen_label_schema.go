@@ -0,0 +1,243 @@
+package blockgen
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"math/rand"
+	"sort"
+)
+
+// K8sSchemaConfig configures Kubernetes-like topology of simulated targets,
+// see `Targets`. Every target is one container and has labels `namespace`,
+// `deployment`, `pod`, `container`, `node`, `instance` and `job`.
+type K8sSchemaConfig struct {
+	// Namespaces is the number of namespaces.
+	Namespaces int `yaml:"namespaces"`
+
+	// NamespacePrefixes are used for namespace names in round-robin
+	// fashion, e.g. ["team-", "infra-"] gives team-0, infra-1, team-2 etc.
+	// Default is ["team-"].
+	NamespacePrefixes []string `yaml:"namespacePrefixes"`
+
+	// DeploymentsPerNamespace is the average number of deployments in
+	// a namespace. The total is Namespaces x DeploymentsPerNamespace.
+	DeploymentsPerNamespace int `yaml:"deploymentsPerNamespace"`
+
+	// PodsPerDeployment is the average number of pods in a deployment.
+	PodsPerDeployment int `yaml:"podsPerDeployment"`
+
+	// ContainersPerPod is the exact number of containers in every pod.
+	ContainersPerPod int `yaml:"containersPerPod"`
+
+	// Nodes is the number of nodes the pods are scheduled on.
+	Nodes int `yaml:"nodes"`
+
+	// ZipfS is the skew of the distribution of deployments between
+	// namespaces, pods between deployments and pods between nodes. Must
+	// be greater than 1 for skewed distribution, the larger the more
+	// skewed. Zero means uniform distribution.
+	ZipfS float64 `yaml:"zipfS"`
+
+	// Seed is the random seed.
+	Seed int64 `yaml:"seed"`
+}
+
+// Targets returns the label sets of the simulated targets, sorted.
+func (c K8sSchemaConfig) Targets() ([]labels.Labels, error) {
+	if c.Namespaces <= 0 {
+		return nil, errors.New("namespaces must be positive")
+	}
+
+	if c.DeploymentsPerNamespace <= 0 {
+		return nil, errors.New("deploymentsPerNamespace must be positive")
+	}
+
+	if c.PodsPerDeployment <= 0 {
+		return nil, errors.New("podsPerDeployment must be positive")
+	}
+
+	if c.ContainersPerPod <= 0 {
+		return nil, errors.New("containersPerPod must be positive")
+	}
+
+	if c.Nodes <= 0 {
+		return nil, errors.New("nodes must be positive")
+	}
+
+	if c.ZipfS != 0 && c.ZipfS <= 1 {
+		return nil, errors.New("zipfS must be greater than 1, or 0 for uniform")
+	}
+
+	prefixes := c.NamespacePrefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{"team-"}
+	}
+
+	random := rand.New(rand.NewSource(c.Seed))
+
+	deployments := c.spread(random, c.Namespaces*c.DeploymentsPerNamespace, c.Namespaces)
+	nodes := c.picker(random, c.Nodes)
+
+	var res []labels.Labels
+	for nsIndex, deploymentCount := range deployments {
+		namespace := fmt.Sprintf("%s%d", prefixes[nsIndex%len(prefixes)], nsIndex)
+		pods := c.spread(random, deploymentCount*c.PodsPerDeployment, deploymentCount)
+
+		for deploymentIndex, podCount := range pods {
+			deployment := fmt.Sprintf("app-%d", deploymentIndex)
+			replicaSet := fmt.Sprintf("%s-%08x", deployment, random.Uint32())
+
+			// Pod suffixes are random, re-rolled when taken.
+			taken := map[int]bool{}
+			for podIndex := 0; podIndex < podCount; podIndex++ {
+				suffix := random.Intn(1 << 20)
+				for taken[suffix] {
+					suffix = random.Intn(1 << 20)
+				}
+				taken[suffix] = true
+
+				pod := fmt.Sprintf("%s-%05x", replicaSet, suffix)
+				node := fmt.Sprintf("node-%d", nodes())
+				ip := fmt.Sprintf("10.%d.%d.%d", random.Intn(256), random.Intn(256), 1+random.Intn(254))
+
+				for containerIndex := 0; containerIndex < c.ContainersPerPod; containerIndex++ {
+					res = append(res, labels.FromStrings(
+						"namespace", namespace,
+						"deployment", deployment,
+						"pod", pod,
+						"container", fmt.Sprintf("container-%d", containerIndex),
+						"node", node,
+						"instance", fmt.Sprintf("%s:%d", ip, 8080+containerIndex),
+						"job", namespace+"/"+deployment,
+					))
+				}
+			}
+		}
+	}
+
+	sort.Sort(labels.Slice(res))
+	return res, nil
+}
+
+// spread distributes total items between n buckets, at least one in
+// each bucket, the rest according to the configured distribution.
+func (c K8sSchemaConfig) spread(random *rand.Rand, total int, n int) []int {
+	res := make([]int, n)
+	pick := c.picker(random, n)
+
+	for i := 0; i < total; i++ {
+		if i < n {
+			res[i]++
+		} else {
+			res[pick()]++
+		}
+	}
+
+	return res
+}
+
+// picker returns func giving random indexes in range [0, n).
+func (c K8sSchemaConfig) picker(random *rand.Rand, n int) func() int {
+	if c.ZipfS == 0 || n == 1 {
+		return func() int {
+			return random.Intn(n)
+		}
+	}
+
+	zipf := rand.NewZipf(random, c.ZipfS, 1, uint64(n-1))
+	return func() int {
+		return int(zipf.Uint64())
+	}
+}
+
+// NewLabelSchemaProvider wraps the provider to replace the `target` label
+// of its series with the given target label sets. The k-th distinct target
+// of the wrapped provider gets k-th label set, so the wrapped provider
+// should have exactly len(targets) targets. Targets beyond that keep their
+// original labels.
+func NewLabelSchemaProvider(provider ValProvider, targets []labels.Labels) ValProvider {
+	return &labelSchemaProvider{
+		provider: provider,
+		targets:  targets,
+		mapping:  map[string]labels.Labels{},
+		series:   map[uint64]labels.Labels{},
+	}
+}
+
+// labelSchemaProvider is implementation of `ValProvider` which relabels targets.
+type labelSchemaProvider struct {
+	provider ValProvider
+	targets  []labels.Labels
+
+	// mapping is from the `target` label value to target labels.
+	mapping map[string]labels.Labels
+
+	// series caches the resulting labels by hash of the original labels.
+	series map[uint64]labels.Labels
+
+	// pos is the index of the next sample.
+	pos int64
+}
+
+// Next implements ValProvider interface.
+func (g *labelSchemaProvider) Next() <-chan Val {
+	c := make(chan Val)
+	g.pos++
+
+	go func() {
+		defer close(c)
+
+		for v := range g.provider.Next() {
+			c <- &valAdapter{v: v.Val(), l: g.labels(v.Labels())}
+		}
+	}()
+
+	return c
+}
+
+// SeekSample implements SampleSeeker interface.
+func (g *labelSchemaProvider) SeekSample(index int64) error {
+	if index < g.pos {
+		return errors.Errorf("cannot seek back from sample %d to %d", g.pos, index)
+	}
+
+	if err := seek(g.provider, g.pos, index); err != nil {
+		return err
+	}
+
+	g.pos = index
+	return nil
+}
+
+// labels returns the series labels with target labels.
+func (g *labelSchemaProvider) labels(l labels.Labels) labels.Labels {
+	hash := l.Hash()
+	if res, found := g.series[hash]; found {
+		return res
+	}
+
+	name := l.Get("target")
+	target, found := g.mapping[name]
+	if !found {
+		if len(g.mapping) >= len(g.targets) {
+			g.series[hash] = l
+			return l
+		}
+
+		target = g.targets[len(g.mapping)]
+		g.mapping[name] = target
+	}
+
+	res := make(labels.Labels, 0, len(l)+len(target))
+	for _, label := range l {
+		if label.Name != "target" {
+			res = append(res, label)
+		}
+	}
+	res = append(res, target...)
+	sort.Sort(res)
+
+	g.series[hash] = res
+	return res
+}
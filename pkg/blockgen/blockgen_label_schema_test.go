@@ -0,0 +1,113 @@
+package blockgen
+
+import (
+	"testing"
+)
+
+func TestK8sSchemaConfig_Targets(t *testing.T) {
+	config := K8sSchemaConfig{
+		Namespaces:              20,
+		NamespacePrefixes:       []string{"team-", "infra-"},
+		DeploymentsPerNamespace: 10,
+		PodsPerDeployment:       5,
+		ContainersPerPod:        2,
+		Nodes:                   30,
+		ZipfS:                   1.5,
+		Seed:                    1,
+	}
+
+	targets, err := config.Targets()
+	if err != nil {
+		t.Fatalf("Targets: %v", err)
+	}
+
+	if want := 20 * 10 * 5 * 2; len(targets) != want {
+		t.Fatalf("want %d targets, got %d", want, len(targets))
+	}
+
+	perNamespace := map[string]int{}
+	unique := map[string]struct{}{}
+	for _, l := range targets {
+		for _, name := range []string{"namespace", "deployment", "pod", "container", "node", "instance", "job"} {
+			if l.Get(name) == "" {
+				t.Fatalf("target %s has no %s label", l, name)
+			}
+		}
+		perNamespace[l.Get("namespace")]++
+		unique[l.String()] = struct{}{}
+	}
+
+	if len(unique) != len(targets) {
+		t.Errorf("want %d unique targets, got %d", len(targets), len(unique))
+	}
+
+	if len(perNamespace) != 20 {
+		t.Errorf("want 20 namespaces, got %d", len(perNamespace))
+	}
+
+	// With skew the largest namespace is well above average of 100.
+	if n := perNamespace["team-0"]; n < 200 {
+		t.Errorf("want skewed namespace sizes, got %d targets in team-0", n)
+	}
+}
+
+func TestK8sSchemaConfig_Targets_UniquePods(t *testing.T) {
+	// Random 20 bit suffixes of this many pods would collide.
+	config := K8sSchemaConfig{
+		Namespaces:              1,
+		DeploymentsPerNamespace: 1,
+		PodsPerDeployment:       5000,
+		ContainersPerPod:        1,
+		Nodes:                   10,
+		Seed:                    1,
+	}
+
+	targets, err := config.Targets()
+	if err != nil {
+		t.Fatalf("Targets: %v", err)
+	}
+
+	pods := map[string]struct{}{}
+	for _, l := range targets {
+		pods[l.Get("pod")] = struct{}{}
+	}
+
+	if len(pods) != len(targets) {
+		t.Errorf("want %d unique pods, got %d", len(targets), len(pods))
+	}
+}
+
+func Test_labelSchemaProvider_Next(t *testing.T) {
+	config := K8sSchemaConfig{
+		Namespaces:              2,
+		DeploymentsPerNamespace: 2,
+		PodsPerDeployment:       2,
+		ContainersPerPod:        1,
+		Nodes:                   2,
+	}
+
+	targets, err := config.Targets()
+	if err != nil {
+		t.Fatalf("Targets: %v", err)
+	}
+
+	p := NewLabelSchemaProvider(NewValProvider(ValProviderConfig{
+		MetricCount: 3,
+		TargetCount: len(targets),
+	}), targets)
+
+	for i := 0; i < 2; i++ {
+		unique := map[string]struct{}{}
+		for v := range p.Next() {
+			l := v.Labels()
+			if l.Get("target") != "" || l.Get("pod") == "" {
+				t.Fatalf("target not relabeled: %s", l)
+			}
+			unique[l.String()] = struct{}{}
+		}
+
+		if len(unique) != 3*len(targets) {
+			t.Fatalf("want %d unique series, got %d", 3*len(targets), len(unique))
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package blockgen
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// BlockWriterMetrics are the metrics of block writers, see
+// `BlockWriterConfig.Metrics`. One instance is shared by all writers of
+// one generation, e.g. by parallel workers and replicas.
+type BlockWriterMetrics struct {
+	reg prometheus.Registerer
+
+	// writers is the number of writers created, used for `writer` label
+	// of TSDB internal metrics.
+	writers int64
+
+	samplesAppended  prometheus.Counter
+	headSeries       prometheus.Gauge
+	flushDuration    prometheus.Histogram
+	blockSize        prometheus.Histogram
+	compactionErrors prometheus.Counter
+	invalidSamples   *prometheus.CounterVec
+}
+
+// NewBlockWriterMetrics creates the metrics and registers them. The TSDB
+// internal metrics of every writer, e.g. `prometheus_tsdb_head_*`, are
+// also registered with `writer` label distinguishing the writers.
+func NewBlockWriterMetrics(reg prometheus.Registerer) *BlockWriterMetrics {
+	m := &BlockWriterMetrics{
+		reg: reg,
+		samplesAppended: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "blockgen_samples_appended_total",
+			Help: "Total number of samples appended to TSDB head.",
+		}),
+		headSeries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "blockgen_head_series",
+			Help: "Number of series in TSDB heads waiting to be flushed.",
+		}),
+		flushDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "blockgen_flush_duration_seconds",
+			Help:    "Duration of writing TSDB head into block on disk.",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 12),
+		}),
+		blockSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "blockgen_block_size_bytes",
+			Help:    "Size of written blocks on disk.",
+			Buckets: prometheus.ExponentialBuckets(1024*1024, 4, 10),
+		}),
+		compactionErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "blockgen_compaction_errors_total",
+			Help: "Total number of failures to write TSDB head into block.",
+		}),
+		invalidSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "blockgen_invalid_samples_total",
+			Help: "Total number of out of order and duplicate samples dropped by writers.",
+		}, []string{"reason"}),
+	}
+
+	reg.MustRegister(
+		m.samplesAppended,
+		m.headSeries,
+		m.flushDuration,
+		m.blockSize,
+		m.compactionErrors,
+		m.invalidSamples,
+	)
+
+	return m
+}
+
+// writerRegisterer returns registerer for TSDB internal metrics of the next writer.
+func (m *BlockWriterMetrics) writerRegisterer() prometheus.Registerer {
+	id := atomic.AddInt64(&m.writers, 1) - 1
+
+	return prometheus.WrapRegistererWith(prometheus.Labels{"writer": strconv.FormatInt(id, 10)}, m.reg)
+}
+
+// replacingRegisterer remembers the registered collectors so that they
+// can be unregistered together. This allows creating a new TSDB head
+// after every flush with the same metrics registered again.
+type replacingRegisterer struct {
+	reg        prometheus.Registerer
+	collectors []prometheus.Collector
+}
+
+// Register implements prometheus.Registerer interface.
+func (r *replacingRegisterer) Register(c prometheus.Collector) error {
+	if err := r.reg.Register(c); err != nil {
+		return err
+	}
+
+	r.collectors = append(r.collectors, c)
+	return nil
+}
+
+// MustRegister implements prometheus.Registerer interface.
+func (r *replacingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Unregister implements prometheus.Registerer interface.
+func (r *replacingRegisterer) Unregister(c prometheus.Collector) bool {
+	return r.reg.Unregister(c)
+}
+
+// unregisterAll unregisters all collectors registered so far.
+func (r *replacingRegisterer) unregisterAll() {
+	for _, c := range r.collectors {
+		r.reg.Unregister(c)
+	}
+
+	r.collectors = nil
+}
+
+// dirSize returns the total size of files in the dir.
+func dirSize(dir string) (int64, error) {
+	var res int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			res += info.Size()
+		}
+		return nil
+	})
+
+	return res, err
+}
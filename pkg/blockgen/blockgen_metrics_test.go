@@ -0,0 +1,94 @@
+package blockgen
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// testMetricFamilies gathers the registry into map by metric name.
+func testMetricFamilies(t *testing.T, reg *prometheus.Registry) map[string]*dto.MetricFamily {
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+
+	res := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		res[mf.GetName()] = mf
+	}
+	return res
+}
+
+func Test_blockWriter_Metrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	metrics := NewBlockWriterMetrics(reg)
+
+	// Two workers share the metrics, each with its own TSDB metrics.
+	newWriter := func() (Writer, error) {
+		return NewBlockWriterWithConfig(BlockWriterConfig{
+			Dir:     dir,
+			Metrics: metrics,
+		})
+	}
+
+	generatorConfig := DefaultGeneratorConfig(4 * time.Minute)
+	generatorConfig.FlushInterval = time.Minute
+	generatorConfig.Workers = 2
+
+	newValProviders := func() ([]ValProvider, error) {
+		return []ValProvider{NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3})}, nil
+	}
+
+	g := NewGeneratorWithConfig(generatorConfig)
+	if err := g.GenerateParallel(context.Background(), newWriter, newValProviders); err != nil {
+		t.Fatalf("GenerateParallel: %v", err)
+	}
+
+	mfs := testMetricFamilies(t, reg)
+
+	samples := mfs["blockgen_samples_appended_total"].GetMetric()[0].GetCounter().GetValue()
+	if int64(samples) != g.Progress().SamplesWritten {
+		t.Errorf("want %d samples appended, got %v", g.Progress().SamplesWritten, samples)
+	}
+
+	if v := mfs["blockgen_head_series"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("want no head series after flush, got %v", v)
+	}
+
+	// Four full blocks and one with the very last sample.
+	if n := mfs["blockgen_block_size_bytes"].GetMetric()[0].GetHistogram().GetSampleCount(); n != 5 {
+		t.Errorf("want 5 block sizes, got %d", n)
+	}
+
+	if n := mfs["blockgen_flush_duration_seconds"].GetMetric()[0].GetHistogram().GetSampleCount(); n != 5 {
+		t.Errorf("want 5 flush durations, got %d", n)
+	}
+
+	if v := mfs["blockgen_compaction_errors_total"].GetMetric()[0].GetCounter().GetValue(); v != 0 {
+		t.Errorf("want no compaction errors, got %v", v)
+	}
+
+	// TSDB internals are registered once per writer.
+	for _, name := range []string{"prometheus_tsdb_compactions_total", "prometheus_tsdb_head_series"} {
+		mf, found := mfs[name]
+		if !found {
+			t.Errorf("%s not registered", name)
+			continue
+		}
+
+		if n := len(mf.GetMetric()); n != 2 {
+			t.Errorf("%s: want 2 writers, got %d", name, n)
+		}
+	}
+}
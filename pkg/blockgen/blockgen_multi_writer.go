@@ -0,0 +1,186 @@
+package blockgen
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"regexp"
+	"time"
+)
+
+// WriterErrorPolicy is what `NewMultiWriter` does when one of its writers fails.
+type WriterErrorPolicy string
+
+const (
+	// FailFast returns the error, which stops the generation. This is the default.
+	FailFast WriterErrorPolicy = "failFast"
+
+	// LogAndContinue logs the errors and keeps writing into all writers,
+	// e.g. for remote write endpoint which is not essential for the run.
+	// The errors are logged once per flush, with their count.
+	LogAndContinue WriterErrorPolicy = "logAndContinue"
+)
+
+// MultiWriterConfig configures one writer of `NewMultiWriter`.
+type MultiWriterConfig struct {
+	// Name is the name of the writer in errors and logs.
+	Name string `yaml:"name"`
+
+	// ErrorPolicy is what to do when the writer fails.
+	ErrorPolicy WriterErrorPolicy `yaml:"errorPolicy"`
+
+	// Match makes the writer get only the series whose labels match all
+	// these regular expressions, e.g. `__name__: "foo_.*"`. The expressions
+	// are anchored, same as in Prometheus. If empty, it gets all series.
+	Match map[string]string `yaml:"match"`
+}
+
+// NewMultiWriter creates writer which writes every value into all given
+// writers, one per each of configs, e.g. to write blocks and also send the
+// samples to remote write in one go. `SetBlockRange` and `Discard` are
+// passed to the writers which implement them.
+func NewMultiWriter(logger log.Logger, writers []Writer, configs []MultiWriterConfig) (Writer, error) {
+	if len(writers) != len(configs) {
+		return nil, errors.Errorf("want %d writers, one per config, got %d", len(configs), len(writers))
+	}
+
+	names := map[string]struct{}{}
+	res := &multiWriter{logger: logger}
+	for i, c := range configs {
+		if _, found := names[c.Name]; found || c.Name == "" {
+			return nil, errors.Errorf("writer name '%s' must be unique and not empty", c.Name)
+		}
+		names[c.Name] = struct{}{}
+
+		switch c.ErrorPolicy {
+		case "":
+			c.ErrorPolicy = FailFast
+		case FailFast, LogAndContinue:
+		default:
+			return nil, errors.Errorf("writer %s: unknown error policy '%s'", c.Name, c.ErrorPolicy)
+		}
+
+		m := &multiWriterEntry{config: c, writer: writers[i]}
+		for name, expr := range c.Match {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return nil, errors.Wrapf(err, "writer %s: match %s", c.Name, name)
+			}
+			m.match = append(m.match, labelMatch{name: name, re: re})
+		}
+
+		res.writers = append(res.writers, m)
+	}
+
+	return res, nil
+}
+
+// labelMatch is the regular expression of one label.
+type labelMatch struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// multiWriterEntry is the state of one writer of multiWriter.
+type multiWriterEntry struct {
+	config MultiWriterConfig
+	writer Writer
+	match  []labelMatch
+
+	// errors are the errors ignored since the last flush, and err is the
+	// first of them.
+	errors int64
+	err    error
+}
+
+// multiWriter is implementation of Writer for several writers.
+type multiWriter struct {
+	logger  log.Logger
+	writers []*multiWriterEntry
+}
+
+// Write implements Writer interface.
+func (w *multiWriter) Write(t time.Time, v Val) error {
+	for _, m := range w.writers {
+		if !m.matches(v.Labels()) {
+			continue
+		}
+
+		if err := m.fail(m.writer.Write(t, v)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Flush implements Writer interface. With LogAndContinue, the errors
+// since the last flush are logged here.
+func (w *multiWriter) Flush() error {
+	for _, m := range w.writers {
+		if err := m.fail(m.writer.Flush()); err != nil {
+			return err
+		}
+
+		if m.errors > 0 {
+			level.Warn(w.logger).Log("msg", "writer failed", "writer", m.config.Name, "errors", m.errors, "err", m.err)
+			m.errors, m.err = 0, nil
+		}
+	}
+
+	return nil
+}
+
+// SetBlockRange implements BlockRangeSetter interface.
+func (w *multiWriter) SetBlockRange(mint, maxt time.Time) {
+	for _, m := range w.writers {
+		if s, ok := m.writer.(BlockRangeSetter); ok {
+			s.SetBlockRange(mint, maxt)
+		}
+	}
+}
+
+// Discard implements Discarder interface. All writers are discarded
+// even if some fail, the first error is returned.
+func (w *multiWriter) Discard() error {
+	var res error
+	for _, m := range w.writers {
+		if d, ok := m.writer.(Discarder); ok {
+			if err := m.fail(d.Discard()); err != nil && res == nil {
+				res = err
+			}
+		}
+	}
+
+	return res
+}
+
+// fail returns the error of the writer wrapped with its name, or counts
+// it and returns nil with LogAndContinue.
+func (m *multiWriterEntry) fail(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if m.config.ErrorPolicy == FailFast {
+		return errors.Wrapf(err, "writer %s", m.config.Name)
+	}
+
+	if m.errors == 0 {
+		m.err = err
+	}
+	m.errors++
+	return nil
+}
+
+// matches tells if the writer gets the series with the labels.
+func (m *multiWriterEntry) matches(l labels.Labels) bool {
+	for _, lm := range m.match {
+		if !lm.re.MatchString(l.Get(lm.name)) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,145 @@
+package blockgen
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingWriter fails every write and flush, for tests.
+type failingWriter struct {
+	writes  int
+	flushes int
+}
+
+func (w *failingWriter) Write(time.Time, Val) error {
+	w.writes++
+	return errors.New("write failed")
+}
+
+func (w *failingWriter) Flush() error {
+	w.flushes++
+	return errors.New("flush failed")
+}
+
+// discardWriter counts discards and fails them with err, for tests.
+type discardWriter struct {
+	memWriter
+	discards int
+	err      error
+}
+
+func (w *discardWriter) Discard() error {
+	w.discards++
+	return w.err
+}
+
+func Test_multiWriter(t *testing.T) {
+	all, foo, failing := &memWriter{}, &memWriter{}, &failingWriter{}
+
+	writer, err := NewMultiWriter(log.NewNopLogger(), []Writer{all, foo, failing}, []MultiWriterConfig{
+		{Name: "all"},
+		{Name: "foo", Match: map[string]string{"__name__": "foo_metric_total_0", "target": "target_[01]"}},
+		{Name: "failing", ErrorPolicy: LogAndContinue},
+	})
+	if err != nil {
+		t.Fatalf("NewMultiWriter: %v", err)
+	}
+
+	generatorConfig := DefaultGeneratorConfig(4 * time.Minute)
+	generatorConfig.FlushInterval = 2 * time.Minute
+
+	err = NewGeneratorWithConfig(generatorConfig).Generate(writer,
+		NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3}))
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	if len(all.samples) != 6 {
+		t.Errorf("want 6 series, got %d", len(all.samples))
+	}
+
+	if len(foo.samples) != 2 {
+		t.Errorf("want 2 matching series, got %v", foo.samples)
+	}
+
+	for key, samples := range foo.samples {
+		if !strings.Contains(key, "foo_metric_total_0") || strings.Contains(key, "target_2") {
+			t.Errorf("unexpected series %s", key)
+		}
+		if len(samples) != len(all.samples[key]) {
+			t.Errorf("%s: want %d samples, got %d", key, len(all.samples[key]), len(samples))
+		}
+	}
+
+	if all.flushes != failing.flushes || all.flushes == 0 {
+		t.Errorf("want %d flushes of failing writer, got %d", all.flushes, failing.flushes)
+	}
+
+	if failing.writes == 0 {
+		t.Errorf("want writes to continue after errors")
+	}
+}
+
+func Test_multiWriter_FailFast(t *testing.T) {
+	mem := &memWriter{}
+
+	writer, err := NewMultiWriter(log.NewNopLogger(), []Writer{&failingWriter{}, mem}, []MultiWriterConfig{
+		{Name: "failing"},
+		{Name: "mem"},
+	})
+	if err != nil {
+		t.Fatalf("NewMultiWriter: %v", err)
+	}
+
+	err = writer.Write(time.Now(), &valAdapter{1, labels.FromStrings("__name__", "foo")})
+	if err == nil || !strings.Contains(err.Error(), "writer failing") {
+		t.Errorf("want error of writer failing, got %v", err)
+	}
+
+	if len(mem.samples) != 0 {
+		t.Errorf("want no writes after error")
+	}
+
+	for _, configs := range [][]MultiWriterConfig{
+		{{Name: "a"}},
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: "a"}, {Name: "b", ErrorPolicy: "ignore"}},
+		{{Name: "a"}, {Name: "b", Match: map[string]string{"target": "("}}},
+	} {
+		if _, err := NewMultiWriter(log.NewNopLogger(), []Writer{mem, mem}, configs); err == nil {
+			t.Errorf("%+v: want error", configs)
+		}
+	}
+}
+
+func Test_multiWriter_Discard(t *testing.T) {
+	writers := []*discardWriter{
+		{err: errors.New("first failed")},
+		{err: errors.New("second failed")},
+		{},
+	}
+
+	writer, err := NewMultiWriter(log.NewNopLogger(), []Writer{writers[0], writers[1], writers[2]}, []MultiWriterConfig{
+		{Name: "first"},
+		{Name: "second"},
+		{Name: "third"},
+	})
+	if err != nil {
+		t.Fatalf("NewMultiWriter: %v", err)
+	}
+
+	err = writer.(Discarder).Discard()
+	if err == nil || !strings.Contains(err.Error(), "writer first") {
+		t.Errorf("want error of writer first, got %v", err)
+	}
+
+	for i, w := range writers {
+		if w.discards != 1 {
+			t.Errorf("writer %d: want 1 discard, got %d", i, w.discards)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package blockgen
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenMetricsConfig configures the writer returned by `NewOpenMetricsWriter`.
+type OpenMetricsConfig struct {
+	// Dir is the directory of the written files, created if missing.
+	Dir string `yaml:"dir"`
+
+	// Gzip compresses the files.
+	Gzip bool `yaml:"gzip"`
+}
+
+// Types of metric families in OpenMetrics text.
+const (
+	omCounter   = "counter"
+	omGauge     = "gauge"
+	omHistogram = "histogram"
+	omSummary   = "summary"
+)
+
+// NewOpenMetricsWriter creates writer which writes the samples into
+// OpenMetrics text files, one file for every `Flush` named by the time
+// range of its samples, e.g. `1569801600000-1569808799999.om`, or
+// `.om.gz` if gzipped. Every file can be given to `promtool tsdb
+// create-blocks-from openmetrics`.
+//
+// The types of metric families are guessed from the series names and
+// labels: `_bucket` series with `le` label are histograms, series with
+// `quantile` label are summaries, both with their `_sum` and `_count`,
+// `_total` series are counters and all the rest are gauges. Staleness
+// markers are not written, OpenMetrics has none.
+//
+// Metric families must not be interleaved in the file, so the samples are
+// written into a temporary file for every family as they come and the
+// files are joined on `Flush`. The samples of every family are in the
+// order they are written, i.e. by time.
+func NewOpenMetricsWriter(config OpenMetricsConfig) (Writer, error) {
+	if config.Dir == "" {
+		return nil, errors.New("dir must not be empty")
+	}
+
+	if err := os.MkdirAll(config.Dir, 0777); err != nil {
+		return nil, errors.Wrapf(err, "create dir %s", config.Dir)
+	}
+
+	return &openMetricsWriter{
+		config: config,
+		spills: map[string]*omSpill{},
+		names:  map[string]*omName{},
+	}, nil
+}
+
+// openMetricsWriter is implementation of Writer which writes OpenMetrics text.
+type openMetricsWriter struct {
+	config OpenMetricsConfig
+
+	// spills are the temporary files of the samples since the last flush,
+	// by the family the series seem to be part of, see `omSpillKey`.
+	spills map[string]*omSpill
+
+	// names are the metric names written since the last flush.
+	names map[string]*omName
+
+	// mint and maxt are the time range of the samples since the last flush.
+	mint int64
+	maxt int64
+}
+
+// omSpill is the temporary file of the samples of one or more families.
+type omSpill struct {
+	file *os.File
+	buf  *bufio.Writer
+
+	// names are the metric names in the file.
+	names []string
+}
+
+// omName is one metric name, the labels of any of its series tell the type.
+type omName struct {
+	labels labels.Labels
+	spill  *omSpill
+}
+
+// omSeries are the samples of one series.
+type omSeries struct {
+	labels  labels.Labels
+	samples []omSample
+}
+
+// omSample is one sample.
+type omSample struct {
+	t int64
+	v float64
+}
+
+// Write implements Writer interface.
+func (w *openMetricsWriter) Write(t time.Time, v Val) error {
+	if value.IsStaleNaN(v.Val()) {
+		return nil
+	}
+
+	l := v.Labels()
+	name := l.Get("__name__")
+	if name == "" {
+		return errors.Errorf("series %s has no metric name", l)
+	}
+
+	ts := timestamp.FromTime(t)
+	if len(w.names) == 0 || ts < w.mint {
+		w.mint = ts
+	}
+	if len(w.names) == 0 || ts > w.maxt {
+		w.maxt = ts
+	}
+
+	n, found := w.names[name]
+	if !found {
+		spill, err := w.spill(omSpillKey(l))
+		if err != nil {
+			return err
+		}
+
+		n = &omName{labels: l, spill: spill}
+		w.names[name] = n
+		spill.names = append(spill.names, name)
+	}
+
+	writeOMLine(n.spill.buf, l, ts, v.Val(), true)
+	return nil
+}
+
+// spill returns the temporary file for the key, created if missing.
+func (w *openMetricsWriter) spill(key string) (*omSpill, error) {
+	if s, found := w.spills[key]; found {
+		return s, nil
+	}
+
+	f, err := ioutil.TempFile(w.config.Dir, "openmetrics-*.tmp")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temporary file")
+	}
+
+	s := &omSpill{file: f, buf: bufio.NewWriter(f)}
+	w.spills[key] = s
+	return s, nil
+}
+
+// omSpillKey returns the name of the family the series seems to be part of.
+// Series which turn out to be in different families, e.g. gauges `foo` and
+// `foo_count`, are separated on `Flush`.
+func omSpillKey(l labels.Labels) string {
+	name := l.Get("__name__")
+	for _, suffix := range []string{"_bucket", "_sum", "_count", "_total"} {
+		if strings.HasSuffix(name, suffix) && l.Get("quantile") == "" {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+// Flush implements Writer interface.
+func (w *openMetricsWriter) Flush() error {
+	if len(w.names) == 0 {
+		return nil
+	}
+
+	name := fmt.Sprintf("%d-%d.om", w.mint, w.maxt)
+	if w.config.Gzip {
+		name += ".gz"
+	}
+
+	if err := w.writeFile(filepath.Join(w.config.Dir, name)); err != nil {
+		return err
+	}
+
+	return w.reset()
+}
+
+// Discard implements Discarder interface.
+func (w *openMetricsWriter) Discard() error {
+	return w.reset()
+}
+
+// reset removes the temporary files.
+func (w *openMetricsWriter) reset() error {
+	var res error
+	for _, s := range w.spills {
+		s.file.Close()
+		if err := os.Remove(s.file.Name()); err != nil && res == nil {
+			res = errors.Wrap(err, "remove temporary file")
+		}
+	}
+
+	w.spills = map[string]*omSpill{}
+	w.names = map[string]*omName{}
+	return res
+}
+
+// writeFile joins the temporary files into one file, via temporary file
+// renamed when complete.
+func (w *openMetricsWriter) writeFile(path string) (err error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "create file %s", tmp)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	var out io.Writer = f
+	var gz *gzip.Writer
+	if w.config.Gzip {
+		gz = gzip.NewWriter(f)
+		out = gz
+	}
+
+	for _, s := range w.spills {
+		if err := s.buf.Flush(); err != nil {
+			return errors.Wrapf(err, "write file %s", s.file.Name())
+		}
+	}
+
+	// The families are told by one series of every metric name.
+	series := map[uint64][]*omSeries{}
+	for _, n := range w.names {
+		hash := n.labels.Hash()
+		series[hash] = append(series[hash], &omSeries{labels: n.labels})
+	}
+
+	buf := bufio.NewWriter(out)
+	for _, family := range omFamilies(series) {
+		family.writeHeader(buf)
+
+		names := map[string]bool{}
+		spills := map[*omSpill]bool{}
+		for _, s := range family.series {
+			name := s.labels.Get("__name__")
+			names[name] = true
+			spills[w.names[name].spill] = true
+		}
+
+		for spill := range spills {
+			if err := copyOMSpill(buf, spill, names); err != nil {
+				return errors.Wrapf(err, "copy file %s", spill.file.Name())
+			}
+		}
+	}
+	buf.WriteString("# EOF\n")
+
+	if err := buf.Flush(); err != nil {
+		return errors.Wrapf(err, "write file %s", tmp)
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return errors.Wrapf(err, "compress file %s", tmp)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "close file %s", tmp)
+	}
+
+	return errors.Wrapf(os.Rename(tmp, path), "rename file %s", tmp)
+}
+
+// copyOMSpill copies the lines of the metric names from the temporary file.
+func copyOMSpill(w *bufio.Writer, s *omSpill, names map[string]bool) error {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	all := true
+	for _, name := range s.names {
+		all = all && names[name]
+	}
+	if all {
+		_, err := io.Copy(w, s.file)
+		return err
+	}
+
+	r := bufio.NewReader(s.file)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if names[line[:strings.IndexAny(line, "{ ")]] {
+			w.WriteString(line)
+		}
+	}
+}
+
+// omFamily is one metric family.
+type omFamily struct {
+	name   string
+	typ    string
+	series []*omSeries
+}
+
+// omFamilies groups the series into metric families sorted by name.
+func omFamilies(series map[uint64][]*omSeries) []*omFamily {
+	byName := map[string][]*omSeries{}
+	for _, ss := range series {
+		for _, s := range ss {
+			name := s.labels.Get("__name__")
+			byName[name] = append(byName[name], s)
+		}
+	}
+
+	families := map[string]*omFamily{}
+	add := func(name, typ string, series []*omSeries) {
+		f, found := families[name]
+		if !found {
+			f = &omFamily{name: name, typ: typ}
+			families[name] = f
+		}
+		f.series = append(f.series, series...)
+	}
+
+	// Histograms and summaries first, they take their _sum and _count.
+	for name, ss := range byName {
+		switch {
+		case strings.HasSuffix(name, "_bucket") && ss[0].labels.Get("le") != "":
+			add(strings.TrimSuffix(name, "_bucket"), omHistogram, ss)
+		case ss[0].labels.Get("quantile") != "":
+			add(name, omSummary, ss)
+		default:
+			continue
+		}
+		delete(byName, name)
+	}
+
+	for name, ss := range byName {
+		for _, suffix := range []string{"_sum", "_count"} {
+			base := strings.TrimSuffix(name, suffix)
+			if f, found := families[base]; found && base != name && f.typ != omCounter && f.typ != omGauge {
+				add(base, f.typ, ss)
+				delete(byName, name)
+			}
+		}
+	}
+
+	for name, ss := range byName {
+		if strings.HasSuffix(name, "_total") {
+			add(strings.TrimSuffix(name, "_total"), omCounter, ss)
+		} else {
+			add(name, omGauge, ss)
+		}
+	}
+
+	res := make([]*omFamily, 0, len(families))
+	for _, f := range families {
+		res = append(res, f)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+
+	return res
+}
+
+// omLine is one sample line of the family.
+type omLine struct {
+	series *omSeries
+	t      int64
+	v      float64
+}
+
+// write writes the family, with timestamps if asked to. The samples of one metric, i.e. the series
+// with the same labels apart from the name and `le` or `quantile`, are
+// together and ordered by time. The samples of one histogram or summary
+// at one time are together too, with buckets or quantiles first.
+func (f *omFamily) write(w *bufio.Writer, timestamps bool) {
+	f.writeHeader(w)
+
+	metrics := map[string][]*omSeries{}
+	for _, s := range f.series {
+		key := omMetricLabels(s.labels).String()
+		metrics[key] = append(metrics[key], s)
+	}
+
+	keys := make([]string, 0, len(metrics))
+	for key := range metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := metrics[key]
+		sort.Slice(series, func(i, j int) bool {
+			return omSeriesLess(series[i].labels, series[j].labels)
+		})
+
+		var lines []omLine
+		for _, s := range series {
+			for _, sample := range s.samples {
+				lines = append(lines, omLine{series: s, t: sample.t, v: sample.v})
+			}
+		}
+
+		// Stable keeps the order of series at the same time.
+		sort.SliceStable(lines, func(i, j int) bool {
+			return lines[i].t < lines[j].t
+		})
+
+		for _, line := range lines {
+			writeOMLine(w, line.series.labels, line.t, line.v, timestamps)
+		}
+	}
+}
+
+// writeHeader writes the HELP and TYPE of the family.
+func (f *omFamily) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s Generated by blockgen.\n", f.name)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+}
+
+// omMetricLabels returns the labels of the metric the series is part of.
+func omMetricLabels(l labels.Labels) labels.Labels {
+	res := make(labels.Labels, 0, len(l))
+	for _, lbl := range l {
+		if lbl.Name != "__name__" && lbl.Name != "le" && lbl.Name != "quantile" {
+			res = append(res, lbl)
+		}
+	}
+	return res
+}
+
+// omSeriesLess orders the series of one metric: buckets by `le`,
+// quantiles by `quantile`, then `_sum` and `_count`.
+func omSeriesLess(a, b labels.Labels) bool {
+	ra, rb := omSeriesRank(a), omSeriesRank(b)
+	if ra != rb {
+		return ra < rb
+	}
+
+	for _, name := range []string{"le", "quantile"} {
+		va, vb := a.Get(name), b.Get(name)
+		if va == vb {
+			continue
+		}
+
+		fa, erra := strconv.ParseFloat(va, 64)
+		fb, errb := strconv.ParseFloat(vb, 64)
+		if erra == nil && errb == nil {
+			return fa < fb
+		}
+		return va < vb
+	}
+
+	return labels.Compare(a, b) < 0
+}
+
+// omSeriesRank is the position of the series in one metric.
+func omSeriesRank(l labels.Labels) int {
+	name := l.Get("__name__")
+	switch {
+	case strings.HasSuffix(name, "_sum"):
+		return 1
+	case strings.HasSuffix(name, "_count"):
+		return 2
+	default:
+		return 0
+	}
+}
+
+// writeOMLine writes one sample, with the timestamp in seconds if asked to.
+func writeOMLine(w *bufio.Writer, lset labels.Labels, t int64, v float64, timestamp bool) {
+	w.WriteString(lset.Get("__name__"))
+
+	first := true
+	for _, l := range lset {
+		if l.Name == "__name__" {
+			continue
+		}
+
+		if first {
+			w.WriteByte('{')
+			first = false
+		} else {
+			w.WriteByte(',')
+		}
+
+		w.WriteString(l.Name)
+		w.WriteString(`="`)
+		w.WriteString(escapeOMLabelValue(l.Value))
+		w.WriteByte('"')
+	}
+	if !first {
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatOMFloat(v))
+	if timestamp {
+		w.WriteByte(' ')
+		w.WriteString(strconv.FormatFloat(float64(t)/1000, 'f', -1, 64))
+	}
+	w.WriteByte('\n')
+}
+
+// omLabelValueEscaper escapes label values as OpenMetrics requires.
+var omLabelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// escapeOMLabelValue escapes the label value.
+func escapeOMLabelValue(v string) string {
+	return omLabelValueEscaper.Replace(v)
+}
+
+// formatOMFloat formats the value, including `+Inf`, `-Inf` and `NaN`.
+func formatOMFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,274 @@
+package blockgen
+
+import (
+	"compress/gzip"
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readOpenMetrics parses the file with Prometheus parser and returns
+// the samples by series and the types by family.
+func readOpenMetrics(t *testing.T, path string) (map[string][]float64, map[string]textparse.MetricType) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip %s: %v", path, err)
+		}
+		r = gz
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+
+	if !strings.HasSuffix(string(b), "# EOF\n") {
+		t.Fatalf("%s: want # EOF at the end", path)
+	}
+
+	samples := map[string][]float64{}
+	types := map[string]textparse.MetricType{}
+
+	p := textparse.NewOpenMetricsParser(b)
+	for {
+		entry, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("parse %s: %v", path, err)
+		}
+
+		switch entry {
+		case textparse.EntryType:
+			name, typ := p.Type()
+			types[string(name)] = typ
+		case textparse.EntrySeries:
+			_, ts, v := p.Series()
+			if ts == nil {
+				t.Fatalf("%s: sample without timestamp", path)
+			}
+
+			var pl promlabels.Labels
+			p.Metric(&pl)
+
+			// The same key as of tsdb labels, e.g. in memWriter.
+			l := labels.FromMap(pl.Map())
+			samples[l.String()] = append(samples[l.String()], v)
+		}
+	}
+
+	return samples, types
+}
+
+func Test_openMetricsWriter(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "thanos-data-test")
+		if err != nil {
+			t.Fatalf("create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		writer, err := NewOpenMetricsWriter(OpenMetricsConfig{Dir: dir, Gzip: gz})
+		if err != nil {
+			t.Fatalf("NewOpenMetricsWriter: %v", err)
+		}
+
+		histogram, err := NewHistogramProvider(HistogramProviderConfig{
+			Name:                  "http_request_duration_seconds",
+			TargetCount:           2,
+			Buckets:               BucketLayout{Type: ExponentialBuckets, Start: 0.01, Factor: 2, Count: 5},
+			Observations:          randval.DistConfig{Type: randval.Normal, Mean: 0.1, StdDev: 0.02},
+			ObservationsPerSample: 10,
+		})
+		if err != nil {
+			t.Fatalf("NewHistogramProvider: %v", err)
+		}
+
+		summary, err := NewSummaryProvider(SummaryProviderConfig{
+			Name:                  "rpc_duration_seconds",
+			TargetCount:           2,
+			Quantiles:             []float64{0.5, 0.99},
+			Observations:          randval.DistConfig{Type: randval.Normal, Mean: 0.2, StdDev: 0.05},
+			ObservationsPerSample: 10,
+		})
+		if err != nil {
+			t.Fatalf("NewSummaryProvider: %v", err)
+		}
+
+		counters, err := NewRandValProvider(RandValProviderConfig{
+			TargetCount: 2,
+			Metrics:     []MetricConfig{{Name: "foo_requests_total", Type: Counter}},
+		})
+		if err != nil {
+			t.Fatalf("NewRandValProvider: %v", err)
+		}
+
+		mem := &memWriter{}
+		generatorConfig := DefaultGeneratorConfig(4 * time.Minute)
+		generatorConfig.FlushInterval = 2 * time.Minute
+
+		err = NewGeneratorWithConfig(generatorConfig).Generate(&teeWriter{writer, mem},
+			NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 2}), histogram, summary, counters)
+		if err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+
+		files, err := filepath.Glob(filepath.Join(dir, "*"))
+		if err != nil {
+			t.Fatalf("Glob: %v", err)
+		}
+
+		// Two full flushes and one with the very last sample.
+		if len(files) != 3 {
+			t.Fatalf("want 3 files, got %v", files)
+		}
+
+		got := map[string][]float64{}
+		types := map[string]textparse.MetricType{}
+		for _, file := range files {
+			if gz != strings.HasSuffix(file, ".om.gz") {
+				t.Errorf("unexpected file name %s", file)
+			}
+
+			samples, fileTypes := readOpenMetrics(t, file)
+			for key, values := range samples {
+				got[key] = append(got[key], values...)
+			}
+			for name, typ := range fileTypes {
+				types[name] = typ
+			}
+		}
+
+		if len(got) != len(mem.samples) {
+			t.Errorf("want %d series, got %d", len(mem.samples), len(got))
+		}
+
+		for key, want := range mem.samples {
+			if len(got[key]) != len(want) {
+				t.Errorf("%s: want %d samples, got %d", key, len(want), len(got[key]))
+				continue
+			}
+
+			for i := range want {
+				if math.Float64bits(want[i]) != math.Float64bits(got[key][i]) {
+					t.Errorf("%s: sample %d: want %v, got %v", key, i, want[i], got[key][i])
+					break
+				}
+			}
+		}
+
+		wantTypes := map[string]textparse.MetricType{
+			"http_request_duration_seconds": textparse.MetricTypeHistogram,
+			"rpc_duration_seconds":          textparse.MetricTypeSummary,
+			"foo_requests":                  textparse.MetricTypeCounter,
+			"foo_metric_total_0":            textparse.MetricTypeGauge,
+		}
+		for name, typ := range wantTypes {
+			if types[name] != typ {
+				t.Errorf("%s: want type %s, got %s", name, typ, types[name])
+			}
+		}
+	}
+}
+
+func Test_openMetricsWriter_SharedSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, err := NewOpenMetricsWriter(OpenMetricsConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewOpenMetricsWriter: %v", err)
+	}
+
+	// Gauges foo and foo_count share the temporary file but not the family.
+	start := time.Date(2019, time.September, 30, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		ts := start.Add(time.Duration(i) * 15 * time.Second)
+		for _, name := range []string{"foo", "foo_count"} {
+			v := &valAdapter{v: float64(i), l: labels.FromStrings("__name__", name, "target", "a")}
+			if err := writer.Write(ts, v); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+	}
+
+	if err := writer.(Discarder).Discard(); err != nil {
+		t.Fatalf("Discard: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Fatalf("want no files after Discard, got %v", files)
+	}
+
+	for i := 0; i < 10; i++ {
+		ts := start.Add(time.Duration(i) * 15 * time.Second)
+		for _, name := range []string{"foo_count", "foo"} {
+			v := &valAdapter{v: float64(i), l: labels.FromStrings("__name__", name, "target", "a")}
+			if err := writer.Write(ts, v); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("want 1 file, got %v, %v", files, err)
+	}
+
+	samples, types := readOpenMetrics(t, files[0])
+	for _, name := range []string{"foo", "foo_count"} {
+		if types[name] != textparse.MetricTypeGauge {
+			t.Errorf("%s: want gauge, got %s", name, types[name])
+		}
+
+		key := labels.FromStrings("__name__", name, "target", "a").String()
+		if len(samples[key]) != 10 {
+			t.Errorf("%s: want 10 samples, got %v", key, samples[key])
+		}
+	}
+}
+
+// teeWriter writes into all the writers, for tests.
+type teeWriter []Writer
+
+func (w teeWriter) Write(t time.Time, v Val) error {
+	for _, writer := range w {
+		if err := writer.Write(t, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w teeWriter) Flush() error {
+	for _, writer := range w {
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
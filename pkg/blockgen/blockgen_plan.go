@@ -0,0 +1,354 @@
+package blockgen
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// planSizes are the sizes `EstimatePlan` is based on, see `PlanConfig`.
+type planSizes struct {
+	bytesPerSeries     float64
+	bytesPerSample     float64
+	headBytesPerSeries float64
+	headBytesPerSample float64
+}
+
+var (
+	// defaultPlanSizes are measured by `CalibratePlan` with the values of
+	// `NewValProvider`, apart from the head memory per series which is
+	// too small to measure reliably. The block writer of `NewBlockWriter`
+	// writes every sample into its own chunk, hence the large sample size.
+	defaultPlanSizes = planSizes{
+		bytesPerSeries:     47,
+		bytesPerSample:     27,
+		headBytesPerSeries: 500,
+		headBytesPerSample: 41,
+	}
+
+	// defaultStreamingPlanSizes are the same for `NewStreamingBlockWriter`,
+	// which writes full chunks and keeps only the open ones in memory.
+	defaultStreamingPlanSizes = planSizes{
+		bytesPerSeries:     72,
+		bytesPerSample:     2.1,
+		headBytesPerSeries: 470,
+		headBytesPerSample: 4.2,
+	}
+)
+
+// PlanConfig is what `EstimatePlan` needs apart from the generator config.
+type PlanConfig struct {
+	// Series is the number of series written at every sample.
+	Series int64
+
+	// SeriesLifetime is the mean lifetime of series if they churn, see
+	// `ChurnConfig.MeanLifetime`. Zero if series don't churn.
+	SeriesLifetime time.Duration
+
+	// Streaming is true if blocks are written by `NewStreamingBlockWriter`
+	// rather than `NewBlockWriter`.
+	Streaming bool
+
+	// Replicas is the number of replicas, each having its own blocks.
+	// Default is 1.
+	Replicas int
+
+	// DownsampleResolutions are the resolutions of downsampled blocks
+	// written along with the raw ones, see `DownsampleConfig`.
+	DownsampleResolutions []time.Duration
+
+	// BytesPerSeries and BytesPerSample are the block size of every series
+	// and every sample, including the index and chunk overhead.
+	// HeadBytesPerSeries and HeadBytesPerSample are the same for the
+	// memory of the block writer. The defaults, used if zero, are for the
+	// values of `NewValProvider`. The sizes depend on the values and labels
+	// and are best measured by `CalibratePlan`.
+	BytesPerSeries     float64
+	BytesPerSample     float64
+	HeadBytesPerSeries float64
+	HeadBytesPerSample float64
+}
+
+// Plan is the estimate of the generator output returned by `EstimatePlan`.
+// Sizes are in bytes.
+type Plan struct {
+	// Blocks is the number of raw blocks of every replica.
+	Blocks int
+
+	// SeriesPerBlock, SamplesPerBlock and BlockSize are of the largest block.
+	SeriesPerBlock  int64
+	SamplesPerBlock int64
+	BlockSize       int64
+
+	// Samples is the number of raw samples of all blocks and replicas.
+	Samples int64
+
+	// DiskSize is the size of all blocks of all replicas, including
+	// DownsampledSize which is the size of downsampled blocks.
+	DiskSize        int64
+	DownsampledSize int64
+
+	// HeadMemory is the peak memory used by the writers of all workers.
+	HeadMemory int64
+}
+
+// EstimateValProviderPlan estimates the output of the generator with
+// the value provider returned by `NewValProvider`, see `EstimatePlan`.
+func EstimateValProviderPlan(genConfig GeneratorConfig, valConfig ValProviderConfig) (*Plan, error) {
+	return EstimatePlan(genConfig, PlanConfig{
+		Series: int64(valConfig.MetricCount) * int64(valConfig.TargetCount),
+	})
+}
+
+// EstimatePlan estimates the number of blocks, series, samples, disk size
+// and peak memory of the generator run with given config, without
+// generating anything. Every series is expected to have one sample at
+// every sample interval. The memory is only what the block writers need
+// for the series and samples, the Go runtime may need about twice as much.
+func EstimatePlan(genConfig GeneratorConfig, config PlanConfig) (*Plan, error) {
+	g := &generator{config: genConfig}
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Series <= 0 {
+		return nil, errors.New("series must be positive")
+	}
+
+	sizes := config.sizes()
+
+	replicas := int64(config.Replicas)
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	workers := int64(genConfig.Workers)
+	if workers < 1 {
+		workers = 1
+	}
+
+	res := &Plan{}
+	for _, r := range g.ranges() {
+		steps := r.to - r.from
+
+		// Churned series are replaced during the block.
+		series := config.Series
+		if config.SeriesLifetime > 0 {
+			covered := time.Duration(steps) * genConfig.SampleInterval
+			series += int64(float64(config.Series) * float64(covered) / float64(config.SeriesLifetime))
+		}
+
+		samples := config.Series * steps
+		size := int64(float64(series)*sizes.bytesPerSeries + float64(samples)*sizes.bytesPerSample)
+
+		// The streaming writer keeps only the open chunk of every series.
+		memSamples := samples
+		if config.Streaming && steps > samplesPerChunk {
+			memSamples = config.Series * samplesPerChunk
+		}
+		memory := int64(float64(series)*sizes.headBytesPerSeries + float64(memSamples)*sizes.headBytesPerSample)
+
+		res.Blocks++
+		res.Samples += samples
+		res.DiskSize += size
+
+		if samples > res.SamplesPerBlock {
+			res.SeriesPerBlock = series
+			res.SamplesPerBlock = samples
+			res.BlockSize = size
+		}
+
+		if memory > res.HeadMemory {
+			res.HeadMemory = memory
+		}
+
+		// Five aggregates for every window of every series, in full chunks.
+		for _, resolution := range config.DownsampleResolutions {
+			windows := int64(math.Ceil(float64(time.Duration(steps)*genConfig.SampleInterval) / float64(resolution)))
+			if windows < 1 {
+				windows = 1
+			}
+
+			res.DownsampledSize += int64(float64(series)*defaultStreamingPlanSizes.bytesPerSeries +
+				float64(series*windows*5)*sizes.bytesPerSample)
+		}
+	}
+
+	res.Samples *= replicas
+	res.DownsampledSize *= replicas
+	res.DiskSize = res.DiskSize*replicas + res.DownsampledSize
+	res.HeadMemory *= workers * replicas
+
+	return res, nil
+}
+
+// sizes returns the configured sizes with defaults.
+func (c *PlanConfig) sizes() planSizes {
+	res := defaultPlanSizes
+	if c.Streaming {
+		res = defaultStreamingPlanSizes
+	}
+
+	if c.BytesPerSeries > 0 {
+		res.bytesPerSeries = c.BytesPerSeries
+	}
+	if c.BytesPerSample > 0 {
+		res.bytesPerSample = c.BytesPerSample
+	}
+	if c.HeadBytesPerSeries > 0 {
+		res.headBytesPerSeries = c.HeadBytesPerSeries
+	}
+	if c.HeadBytesPerSample > 0 {
+		res.headBytesPerSample = c.HeadBytesPerSample
+	}
+
+	return res
+}
+
+// CalibratePlan generates two small blocks of the values from the
+// providers into temporary directory, measures their sizes and the memory
+// used by the block writer and sets the sizes of the plan config. One
+// block has all series with one chunk of samples, the other one has only
+// the last sample of every series. The writer is the one of
+// `config.Streaming`. Generating takes the time of 121 samples.
+//
+// The memory is measured from the Go heap, so nothing else should run at
+// the same time. It is not reliable with less than thousands of series.
+func CalibratePlan(ctx context.Context, genConfig GeneratorConfig, config *PlanConfig, valProviders ...ValProvider) error {
+	dir, err := ioutil.TempDir("", "blockgen-calibrate")
+	if err != nil {
+		return errors.Wrap(err, "create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	newWriter := NewBlockWriterWithConfig
+	if config.Streaming {
+		newWriter = NewStreamingBlockWriter
+	}
+
+	writer, err := newWriter(BlockWriterConfig{Dir: dir})
+	if err != nil {
+		return errors.Wrap(err, "create block writer")
+	}
+
+	// One chunk of samples in one block, and the last sample in another.
+	genConfig.Retention = samplesPerChunk * genConfig.SampleInterval
+	genConfig.FlushInterval = genConfig.Retention
+	genConfig.AlignBlocks = false
+	genConfig.Workers = 1
+
+	heap := &heapWriter{Writer: writer, before: heapInUse()}
+	if err := NewGeneratorWithConfig(genConfig).GenerateContext(ctx, heap, valProviders...); err != nil {
+		return errors.Wrap(err, "generate")
+	}
+
+	ids, err := blockIDs(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) != 2 || len(heap.heads) != 2 {
+		return errors.Errorf("want two calibration blocks, got %d", len(ids))
+	}
+
+	var blocks []calibrationBlock
+	for _, id := range ids {
+		b, err := readCalibrationBlock(filepath.Join(dir, id.String()))
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, b)
+	}
+
+	// The small block is the last one, the same as the heap measurements.
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].samples > blocks[j].samples
+	})
+
+	large, small := blocks[0], blocks[1]
+	if small.series == 0 || large.samples <= small.samples {
+		return errors.New("not enough samples generated")
+	}
+
+	// Two blocks give two equations of size = series*a + samples*b.
+	samples := float64(large.samples - small.samples)
+	config.BytesPerSample = math.Max(0, float64(large.size-small.size)/samples)
+	config.BytesPerSeries = math.Max(0, float64(small.size)/float64(small.series)-config.BytesPerSample)
+
+	head, smallHead := float64(heap.heads[0]), float64(heap.heads[1])
+	config.HeadBytesPerSample = math.Max(0, (head-smallHead)/samples)
+	config.HeadBytesPerSeries = math.Max(0, smallHead/float64(small.series)-config.HeadBytesPerSample)
+
+	return nil
+}
+
+// calibrationBlock is the size of the block generated by `CalibratePlan`.
+type calibrationBlock struct {
+	series  uint64
+	samples uint64
+	size    int64
+}
+
+// readCalibrationBlock reads the stats and the size of the block.
+func readCalibrationBlock(dir string) (calibrationBlock, error) {
+	meta, err := ReadThanosMeta(dir)
+	if err != nil {
+		return calibrationBlock{}, err
+	}
+
+	res := calibrationBlock{
+		series:  meta.Stats.NumSeries,
+		samples: meta.Stats.NumSamples,
+	}
+
+	for _, f := range []string{chunksDirname, indexFilename} {
+		size, err := dirSize(filepath.Join(dir, f))
+		if err != nil {
+			return calibrationBlock{}, errors.Wrapf(err, "size of %s", f)
+		}
+		res.size += size
+	}
+
+	return res, nil
+}
+
+// heapWriter is Writer which measures the heap growth until every Flush.
+type heapWriter struct {
+	Writer
+
+	// before is the heap in use after the previous Flush, heads are the
+	// growths until every Flush.
+	before uint64
+	heads  []uint64
+}
+
+// Flush implements Writer interface.
+func (w *heapWriter) Flush() error {
+	head := uint64(0)
+	if now := heapInUse(); now > w.before {
+		head = now - w.before
+	}
+	w.heads = append(w.heads, head)
+
+	if err := w.Writer.Flush(); err != nil {
+		return err
+	}
+
+	w.before = heapInUse()
+	return nil
+}
+
+// heapInUse returns the Go heap in use after garbage collection.
+func heapInUse() uint64 {
+	runtime.GC()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
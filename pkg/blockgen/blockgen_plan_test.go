@@ -0,0 +1,154 @@
+package blockgen
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEstimatePlan(t *testing.T) {
+	genConfig := DefaultGeneratorConfig(10 * time.Hour)
+	genConfig.Workers = 2
+
+	plan, err := EstimatePlan(genConfig, PlanConfig{
+		Series:                100,
+		Replicas:              2,
+		DownsampleResolutions: []time.Duration{ResLevel1},
+		BytesPerSeries:        100,
+		BytesPerSample:        2,
+		HeadBytesPerSeries:    1000,
+		HeadBytesPerSample:    10,
+	})
+	if err != nil {
+		t.Fatalf("EstimatePlan: %v", err)
+	}
+
+	// 5 blocks of 2h and the last sample.
+	if plan.Blocks != 6 {
+		t.Errorf("want 6 blocks, got %d", plan.Blocks)
+	}
+
+	if plan.SeriesPerBlock != 100 || plan.SamplesPerBlock != 100*480 {
+		t.Errorf("want 100 series and 48000 samples per block, got %d and %d", plan.SeriesPerBlock, plan.SamplesPerBlock)
+	}
+
+	if want := int64(2 * 100 * 2401); plan.Samples != want {
+		t.Errorf("want %d samples, got %d", want, plan.Samples)
+	}
+
+	if want := int64(100*100 + 48000*2); plan.BlockSize != want {
+		t.Errorf("want block size %d, got %d", want, plan.BlockSize)
+	}
+
+	// 2 workers of 2 replicas, each with head of one block.
+	if want := int64(4 * (100*1000 + 48000*10)); plan.HeadMemory != want {
+		t.Errorf("want head memory %d, got %d", want, plan.HeadMemory)
+	}
+
+	// 24 windows x 5 aggregates per series in 2h blocks, one in the last.
+	seriesSize := int64(100 * defaultStreamingPlanSizes.bytesPerSeries)
+	wantDownsampled := 2 * (5*(seriesSize+100*24*5*2) + seriesSize + 100*5*2)
+	if plan.DownsampledSize != wantDownsampled {
+		t.Errorf("want downsampled size %d, got %d", wantDownsampled, plan.DownsampledSize)
+	}
+
+	if want := 2*(5*plan.BlockSize+100*100+100*2) + wantDownsampled; plan.DiskSize != want {
+		t.Errorf("want disk size %d, got %d", want, plan.DiskSize)
+	}
+
+	// Churn adds series replacing the dead ones.
+	churned, err := EstimatePlan(genConfig, PlanConfig{Series: 100, SeriesLifetime: time.Hour})
+	if err != nil {
+		t.Fatalf("EstimatePlan: %v", err)
+	}
+
+	if churned.SeriesPerBlock != 300 || churned.SamplesPerBlock != 48000 {
+		t.Errorf("want 300 series and 48000 samples per block with churn, got %d and %d",
+			churned.SeriesPerBlock, churned.SamplesPerBlock)
+	}
+
+	// The streaming writer keeps only one chunk per series in memory.
+	streaming, err := EstimatePlan(genConfig, PlanConfig{Series: 100, Streaming: true, HeadBytesPerSeries: 1000, HeadBytesPerSample: 10})
+	if err != nil {
+		t.Fatalf("EstimatePlan: %v", err)
+	}
+
+	if want := int64(2 * (100*1000 + 100*120*10)); streaming.HeadMemory != want {
+		t.Errorf("want streaming head memory %d, got %d", want, streaming.HeadMemory)
+	}
+
+	if _, err := EstimatePlan(genConfig, PlanConfig{}); err == nil {
+		t.Errorf("want error without series")
+	}
+}
+
+func TestCalibratePlan(t *testing.T) {
+	valConfig := ValProviderConfig{MetricCount: 10, TargetCount: 10}
+
+	genConfig := DefaultGeneratorConfig(4 * time.Hour)
+	genConfig.StartTime = time.Date(2019, time.September, 30, 0, 0, 0, 0, time.UTC)
+
+	for _, streaming := range []bool{false, true} {
+		planConfig := PlanConfig{Series: 100, Streaming: streaming}
+		if err := CalibratePlan(context.Background(), genConfig, &planConfig, NewValProvider(valConfig)); err != nil {
+			t.Fatalf("CalibratePlan: %v", err)
+		}
+
+		// The defaults are for the values of this provider.
+		if want := planConfig.sizes(); math.Abs(planConfig.BytesPerSample-want.bytesPerSample) > 0.1*want.bytesPerSample {
+			t.Errorf("streaming %v: want about %v bytes per sample, got %v", streaming, want.bytesPerSample, planConfig.BytesPerSample)
+		}
+
+		plan, err := EstimatePlan(genConfig, planConfig)
+		if err != nil {
+			t.Fatalf("EstimatePlan: %v", err)
+		}
+
+		dir, err := ioutil.TempDir("", "thanos-data-test")
+		if err != nil {
+			t.Fatalf("create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		newWriter := NewBlockWriterWithConfig
+		if streaming {
+			newWriter = NewStreamingBlockWriter
+		}
+
+		writer, err := newWriter(BlockWriterConfig{Dir: dir})
+		if err != nil {
+			t.Fatalf("create writer: %v", err)
+		}
+
+		if err := NewGeneratorWithConfig(genConfig).Generate(writer, NewValProvider(valConfig)); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+
+		ids, err := blockIDs(dir)
+		if err != nil {
+			t.Fatalf("blockIDs: %v", err)
+		}
+
+		if len(ids) != plan.Blocks {
+			t.Errorf("streaming %v: want %d blocks, got %d", streaming, plan.Blocks, len(ids))
+		}
+
+		var size int64
+		for _, id := range ids {
+			b, err := readCalibrationBlock(filepath.Join(dir, id.String()))
+			if err != nil {
+				t.Fatalf("readCalibrationBlock: %v", err)
+			}
+			size += b.size
+		}
+
+		// Within 10% of the actual size of chunks and index.
+		if math.Abs(float64(plan.DiskSize-size)) > 0.1*float64(size) {
+			t.Errorf("streaming %v: want disk size about %d, got %d", streaming, size, plan.DiskSize)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package blockgen
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Progress is the snapshot of generation progress, see `Generator.Progress`.
+type Progress struct {
+	// SamplesWritten is the number of values given to writers.
+	SamplesWritten int64
+
+	// BlocksFlushed is the number of flushed blocks out of BlocksTotal.
+	BlocksFlushed int64
+	BlocksTotal   int64
+
+	// Covered is the simulated time covered so far out of Retention.
+	Covered   time.Duration
+	Retention time.Duration
+
+	// Elapsed is the wall clock time since the generation started.
+	Elapsed time.Duration
+
+	// SamplesPerSecond is the average write rate so far.
+	SamplesPerSecond float64
+
+	// ETA is the estimated wall clock time left, zero if unknown.
+	ETA time.Duration
+
+	// Done is true when the generation finished, successfully or not.
+	Done bool
+}
+
+// Percent returns how much is done, in percents.
+func (p Progress) Percent() float64 {
+	if p.Retention <= 0 {
+		return 0
+	}
+
+	return 100 * float64(p.Covered) / float64(p.Retention)
+}
+
+// progressTracker keeps progress counters, safe for concurrent use.
+type progressTracker struct {
+	// start is the time.Time when generation started, it keeps the
+	// monotonic clock reading so Elapsed is not affected by clock changes.
+	start atomic.Value
+	done  int32
+
+	samplesWritten int64
+	blocksFlushed  int64
+	steps          int64
+}
+
+// reset marks the start of the generation.
+func (t *progressTracker) reset() {
+	t.start.Store(time.Now())
+	atomic.StoreInt32(&t.done, 0)
+	atomic.StoreInt64(&t.samplesWritten, 0)
+	atomic.StoreInt64(&t.blocksFlushed, 0)
+	atomic.StoreInt64(&t.steps, 0)
+}
+
+// finish marks the end of the generation.
+func (t *progressTracker) finish() {
+	atomic.StoreInt32(&t.done, 1)
+}
+
+// step records one sample interval with given number of written samples.
+func (t *progressTracker) step(samples int64) {
+	atomic.AddInt64(&t.samplesWritten, samples)
+	atomic.AddInt64(&t.steps, 1)
+}
+
+// flushed records one flushed block.
+func (t *progressTracker) flushed() {
+	atomic.AddInt64(&t.blocksFlushed, 1)
+}
+
+// Progress implements Generator interface.
+func (g *generator) Progress() Progress {
+	t := &g.progress
+	c := &g.config
+
+	res := Progress{
+		SamplesWritten: atomic.LoadInt64(&t.samplesWritten),
+		BlocksFlushed:  atomic.LoadInt64(&t.blocksFlushed),
+		Retention:      c.Retention,
+		Done:           atomic.LoadInt32(&t.done) == 1,
+	}
+
+	start, ok := t.start.Load().(time.Time)
+	if !ok {
+		return res
+	}
+
+	// Generation only starts with valid config so ranges are safe to use.
+	res.BlocksTotal = int64(len(g.ranges()))
+
+	// The very last sample is at Retention so there is one more step.
+	steps := atomic.LoadInt64(&t.steps)
+	if steps > 0 {
+		res.Covered = time.Duration(steps-1) * c.SampleInterval
+	}
+	res.Elapsed = time.Since(start)
+
+	if seconds := res.Elapsed.Seconds(); seconds > 0 {
+		res.SamplesPerSecond = float64(res.SamplesWritten) / seconds
+	}
+
+	if res.Covered > 0 && !res.Done {
+		left := float64(res.Retention-res.Covered) / float64(res.Covered)
+		res.ETA = time.Duration(left * float64(res.Elapsed))
+	}
+
+	return res
+}
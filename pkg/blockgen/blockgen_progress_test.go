@@ -0,0 +1,63 @@
+package blockgen
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_generator_Progress(t *testing.T) {
+	config := DefaultGeneratorConfig(4 * time.Hour)
+	config.Workers = 2
+
+	g := NewGeneratorWithConfig(config)
+
+	if p := g.Progress(); p.Elapsed != 0 || p.Done || p.BlocksTotal != 0 {
+		t.Fatalf("expected empty progress before start, got %+v", p)
+	}
+
+	var mtx sync.Mutex
+	var writers []*memWriter
+	newWriter := func() (Writer, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		w := &memWriter{}
+		writers = append(writers, w)
+		return w, nil
+	}
+
+	if err := g.GenerateParallel(context.Background(), newWriter, newTestValProviders); err != nil {
+		t.Fatalf("GenerateParallel: %v", err)
+	}
+
+	samples := int64(0)
+	for _, w := range writers {
+		for _, values := range w.samples {
+			samples += int64(len(values))
+		}
+	}
+
+	p := g.Progress()
+	if !p.Done {
+		t.Errorf("expected done")
+	}
+
+	// Two full blocks and the last sample.
+	if p.BlocksTotal != 3 || p.BlocksFlushed != 3 {
+		t.Errorf("expected 3/3 blocks, got %d/%d", p.BlocksFlushed, p.BlocksTotal)
+	}
+
+	if p.SamplesWritten != samples {
+		t.Errorf("expected %d samples, got %d", samples, p.SamplesWritten)
+	}
+
+	if p.Covered != p.Retention || p.Percent() != 100 {
+		t.Errorf("expected %s covered, got %s (%.1f%%)", p.Retention, p.Covered, p.Percent())
+	}
+
+	if p.ETA != 0 {
+		t.Errorf("expected no ETA when done, got %s", p.ETA)
+	}
+}
@@ -0,0 +1,166 @@
+package blockgen
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	"github.com/prometheus/prometheus/tsdb/labels"
+)
+
+// MetricType is the type of the generated metric.
+type MetricType string
+
+const (
+	// Counter is the metric which only goes up, apart from resets.
+	Counter MetricType = "counter"
+
+	// Gauge is the metric which goes up and down.
+	Gauge MetricType = "gauge"
+)
+
+// MetricConfig configures one metric generated by `RandValProvider`.
+type MetricConfig struct {
+	// Name is the metric name, the value of `__name__` label.
+	Name string `yaml:"name"`
+
+	// Type is either "counter" or "gauge".
+	Type MetricType `yaml:"type"`
+
+	// ValueModel configures the value sequences, `randval.DefaultConfig`
+	// if not set. The ChangeRandSeed is ignored as every series gets its
+	// own seed, see `RandValProviderConfig.Seed`.
+	ValueModel *randval.Config `yaml:"valueModel"`
+}
+
+// RandValProviderConfig configures the `ValProvider` returned by `NewRandValProvider`.
+// The number of series per sampling interval will be (len(Metrics) x TargetCount).
+type RandValProviderConfig struct {
+	// Metrics is the list of metrics each target produces.
+	Metrics []MetricConfig `yaml:"metrics"`
+
+	// TargetCount is the number of simulated collection targets.
+	TargetCount int `yaml:"targetCount"`
+
+	// Seed is the base random seed. The seed of each series is derived
+	// from this and the series labels so that runs are reproducible.
+	Seed int64 `yaml:"seed"`
+}
+
+// NewRandValProvider creates new ValProvider which produces counters and
+// gauges using `randval` sequences. Unlike `NewValProvider`, every series
+// keeps its own sequence across `Next` calls, so counters do not go down.
+func NewRandValProvider(config RandValProviderConfig) (ValProvider, error) {
+	if config.TargetCount <= 0 {
+		return nil, errors.New("targetCount must be positive")
+	}
+
+	if len(config.Metrics) == 0 {
+		return nil, errors.New("at least one metric required")
+	}
+
+	var series []*randValSeries
+	for _, m := range config.Metrics {
+		if m.Name == "" {
+			return nil, errors.New("metric name must be set")
+		}
+
+		var newSeq func(randval.Config) randval.ValSeq
+		switch m.Type {
+		case Counter:
+			newSeq = randval.NewRandCounterVal
+		case Gauge:
+			newSeq = randval.NewRandGaugeVal
+		default:
+			return nil, errors.Errorf("metric %s: unknown type '%s'", m.Name, m.Type)
+		}
+
+		model := randval.DefaultConfig()
+		if m.ValueModel != nil {
+			model = *m.ValueModel
+		}
+
+		if model.MaxValue <= model.MinValue {
+			return nil, errors.Errorf("metric %s: maxValue must be greater than minValue", m.Name)
+		}
+
+		if model.MaxChangeValue <= 0 {
+			return nil, errors.Errorf("metric %s: changeBaseValue must be positive", m.Name)
+		}
+
+		for targetIndex := 0; targetIndex < config.TargetCount; targetIndex++ {
+			ourLabels := labels.FromStrings(
+				"__name__", m.Name,
+				"target", fmt.Sprintf("target_%d", targetIndex),
+			)
+
+			seqConfig := model
+			seqConfig.ChangeRandSeed = seriesSeed(config.Seed, ourLabels)
+
+			series = append(series, &randValSeries{
+				labels: ourLabels,
+				seq:    newSeq(seqConfig),
+			})
+		}
+	}
+
+	return &randValProvider{
+		series: series,
+	}, nil
+}
+
+// seriesSeed derives the random seed for the series with given labels.
+func seriesSeed(seed int64, l labels.Labels) int64 {
+	return seed ^ int64(l.Hash())
+}
+
+// randValSeries is one series and its value sequence.
+type randValSeries struct {
+	labels labels.Labels
+	seq    randval.ValSeq
+}
+
+// randValProvider is implementation of `ValProvider` using `randval`.
+type randValProvider struct {
+	series []*randValSeries
+
+	// pos is the index of the next sample.
+	pos int64
+}
+
+// Next implements ValProvider interface.
+func (g *randValProvider) Next() <-chan Val {
+	c := make(chan Val)
+	g.pos++
+
+	go func() {
+		defer close(c)
+
+		for _, s := range g.series {
+			c <- &valAdapter{v: s.seq.Next().Val, l: s.labels}
+		}
+	}()
+
+	return c
+}
+
+// SeekSample implements SampleSeeker interface.
+func (g *randValProvider) SeekSample(index int64) error {
+	if index < g.pos {
+		return errors.Errorf("cannot seek back from sample %d to %d", g.pos, index)
+	}
+
+	// Sample 0 is the sequence number 1.
+	for _, s := range g.series {
+		if seeker, ok := s.seq.(randval.SeqSeeker); ok {
+			seeker.SeekSeq(index + 1)
+			continue
+		}
+
+		for i := g.pos; i < index; i++ {
+			s.seq.Next()
+		}
+	}
+	g.pos = index
+
+	return nil
+}
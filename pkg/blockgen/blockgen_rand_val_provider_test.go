@@ -0,0 +1,97 @@
+package blockgen
+
+import (
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	"testing"
+)
+
+func newTestRandValProvider(t *testing.T) ValProvider {
+	config := RandValProviderConfig{
+		Metrics: []MetricConfig{
+			{
+				Name: "foo_total",
+				Type: Counter,
+				ValueModel: &randval.Config{
+					MinValue:       0,
+					MaxValue:       1e9,
+					MaxChangeValue: 10,
+				},
+			},
+			{
+				Name: "foo_gauge",
+				Type: Gauge,
+			},
+		},
+		TargetCount: 3,
+		Seed:        42,
+	}
+
+	p, err := NewRandValProvider(config)
+	if err != nil {
+		t.Fatalf("NewRandValProvider: %v", err)
+	}
+
+	return p
+}
+
+func Test_randValProvider_Next(t *testing.T) {
+	a := newTestRandValProvider(t)
+	b := newTestRandValProvider(t)
+
+	last := map[string]float64{}
+	for i := 0; i < 100; i++ {
+		bc := b.Next()
+		for av := range a.Next() {
+			bv := <-bc
+
+			key := av.Labels().String()
+			if key != bv.Labels().String() || av.Val() != bv.Val() {
+				t.Fatalf("sample %d: not reproducible: %s=%v vs %s=%v", i, key, av.Val(), bv.Labels(), bv.Val())
+			}
+
+			if av.Labels().Get("__name__") == "foo_total" && av.Val() < last[key] {
+				t.Fatalf("sample %d: counter %s went down from %v to %v", i, key, last[key], av.Val())
+			}
+			last[key] = av.Val()
+		}
+	}
+
+	if len(last) != 6 {
+		t.Errorf("want 6 series, got %d", len(last))
+	}
+}
+
+func Test_randValProvider_ValueModel(t *testing.T) {
+	p, err := NewRandValProvider(RandValProviderConfig{
+		Metrics:     []MetricConfig{{Name: "foo_total", Type: Counter}},
+		TargetCount: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewRandValProvider: %v", err)
+	}
+
+	// The default value model makes the counter go up.
+	var last float64
+	for i := 0; i < 10; i++ {
+		for v := range p.Next() {
+			last = v.Val()
+		}
+	}
+	if last <= 0 {
+		t.Errorf("want counter to go up with default value model, got %v", last)
+	}
+
+	for _, model := range []randval.Config{
+		{MinValue: 10, MaxValue: 10, MaxChangeValue: 1},
+		{MaxValue: 100},
+	} {
+		model := model
+		_, err := NewRandValProvider(RandValProviderConfig{
+			Metrics:     []MetricConfig{{Name: "foo_total", Type: Counter, ValueModel: &model}},
+			TargetCount: 1,
+		})
+		if err == nil {
+			t.Errorf("%+v: want error", model)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package blockgen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Defaults of `RemoteWriteConfig`, the same as of Prometheus remote write.
+const (
+	DefaultRemoteWriteBatchSize  = 500
+	DefaultRemoteWriteShards     = 1
+	DefaultRemoteWriteMaxRetries = 3
+	DefaultRemoteWriteMinBackoff = 30 * time.Millisecond
+	DefaultRemoteWriteMaxBackoff = 5 * time.Second
+	DefaultRemoteWriteTimeout    = 30 * time.Second
+)
+
+// maxErrMsgLen is the max length of the response body in errors.
+const maxErrMsgLen = 256
+
+// RemoteWriteConfig configures the writer returned by `NewRemoteWriter`.
+// The defaults are used for zero values.
+type RemoteWriteConfig struct {
+	// URL is the remote write endpoint, e.g. http://receive:19291/api/v1/receive.
+	URL string `yaml:"url"`
+
+	// Headers are added to every request, e.g. `THANOS-TENANT`.
+	Headers map[string]string `yaml:"headers"`
+
+	// BatchSize is the max number of samples in one request.
+	BatchSize int `yaml:"batchSize"`
+
+	// Shards is the number of requests sent concurrently. Every series
+	// always goes to the same shard, so its samples are sent in order.
+	Shards int `yaml:"shards"`
+
+	// MaxRetries is the number of retries of requests failed with 5xx,
+	// 429 or network error, `DefaultRemoteWriteMaxRetries` if not set and
+	// no retries if zero. The backoff doubles from MinBackoff up to
+	// MaxBackoff with every retry.
+	MaxRetries *int          `yaml:"maxRetries"`
+	MinBackoff time.Duration `yaml:"minBackoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+
+	// Timeout is the timeout of one request.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// NewRemoteWriter creates writer which sends the samples to Prometheus
+// remote write endpoint, e.g. Thanos Receive or Cortex, as snappy
+// compressed protobuf `WriteRequest`s. The samples are sent in batches
+// while written, and all the remaining ones at every `Flush`, which
+// returns once all of them are accepted. The first failed request is
+// returned by the next `Write` or `Flush`. `Discard` drops the samples
+// not sent yet and cancels the requests in flight, the sent ones can't be
+// taken back.
+func NewRemoteWriter(config RemoteWriteConfig) (Writer, error) {
+	if config.URL == "" {
+		return nil, errors.New("url must not be empty")
+	}
+
+	if config.BatchSize < 0 || config.Shards < 0 || config.MinBackoff < 0 || config.MaxBackoff < 0 || config.Timeout < 0 {
+		return nil, errors.New("batchSize, shards, backoffs and timeout must not be negative")
+	}
+
+	maxRetries := DefaultRemoteWriteMaxRetries
+	if config.MaxRetries != nil {
+		maxRetries = *config.MaxRetries
+	}
+	if maxRetries < 0 {
+		return nil, errors.New("maxRetries must not be negative")
+	}
+
+	if config.BatchSize == 0 {
+		config.BatchSize = DefaultRemoteWriteBatchSize
+	}
+	if config.Shards == 0 {
+		config.Shards = DefaultRemoteWriteShards
+	}
+	if config.MinBackoff == 0 {
+		config.MinBackoff = DefaultRemoteWriteMinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = DefaultRemoteWriteMaxBackoff
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultRemoteWriteTimeout
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.URL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid url")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, errors.Errorf("url must be http or https, got %s", config.URL)
+	}
+
+	w := &remoteWriter{
+		logger:     log.NewLogfmtLogger(os.Stderr),
+		config:     config,
+		maxRetries: maxRetries,
+		client:     &http.Client{Timeout: config.Timeout},
+		shards:     make([]*remoteShard, config.Shards),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	for i := range w.shards {
+		w.shards[i] = &remoteShard{}
+	}
+
+	return w, nil
+}
+
+// remoteWriter is implementation of Writer which sends samples to remote write endpoint.
+type remoteWriter struct {
+	logger     log.Logger
+	config     RemoteWriteConfig
+	maxRetries int
+	client     *http.Client
+	shards     []*remoteShard
+
+	// ctx is the context of the requests, cancelled by drop to stop
+	// the requests in flight and their backoff.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// sent and retries are counted since the last flush.
+	sent    int64
+	retries int64
+}
+
+// remoteShard is the batch being filled and the request being sent.
+type remoteShard struct {
+	batch []prompb.TimeSeries
+
+	// done receives the result of the request in flight, nil if none.
+	done chan remoteResult
+}
+
+// remoteResult is the result of one request.
+type remoteResult struct {
+	samples int
+	retries int
+	err     error
+}
+
+// Write implements Writer interface.
+func (w *remoteWriter) Write(t time.Time, v Val) error {
+	l := v.Labels()
+	s := w.shards[l.Hash()%uint64(len(w.shards))]
+
+	pl := make([]prompb.Label, 0, len(l))
+	for _, lbl := range l {
+		pl = append(pl, prompb.Label{Name: lbl.Name, Value: lbl.Value})
+	}
+
+	s.batch = append(s.batch, prompb.TimeSeries{
+		Labels:  pl,
+		Samples: []prompb.Sample{{Value: v.Val(), Timestamp: timestamp.FromTime(t)}},
+	})
+
+	if len(s.batch) < w.config.BatchSize {
+		return nil
+	}
+
+	return w.send(s)
+}
+
+// send waits for the request in flight of the shard, and sends the
+// batch of the shard concurrently.
+func (w *remoteWriter) send(s *remoteShard) error {
+	if err := w.wait(s); err != nil {
+		return err
+	}
+
+	batch := s.batch
+	s.batch = nil
+	s.done = make(chan remoteResult, 1)
+
+	go func(ctx context.Context, done chan<- remoteResult) {
+		retries, err := w.store(ctx, batch)
+		done <- remoteResult{samples: len(batch), retries: retries, err: err}
+	}(w.ctx, s.done)
+
+	return nil
+}
+
+// wait waits for the request in flight of the shard, if any.
+func (w *remoteWriter) wait(s *remoteShard) error {
+	if s.done == nil {
+		return nil
+	}
+
+	res := <-s.done
+	s.done = nil
+
+	w.sent += int64(res.samples)
+	w.retries += int64(res.retries)
+	return res.err
+}
+
+// Flush implements Writer interface.
+func (w *remoteWriter) Flush() error {
+	for _, s := range w.shards {
+		if len(s.batch) == 0 {
+			continue
+		}
+
+		if err := w.send(s); err != nil {
+			w.drop()
+			return err
+		}
+	}
+
+	if err := w.waitAll(); err != nil {
+		return err
+	}
+
+	level.Info(w.logger).Log("msg", "remote write flushed", "url", w.config.URL, "samples", w.sent, "retries", w.retries)
+
+	w.sent = 0
+	w.retries = 0
+	return nil
+}
+
+// Discard implements Discarder interface.
+func (w *remoteWriter) Discard() error {
+	w.drop()
+	w.sent = 0
+	w.retries = 0
+	return nil
+}
+
+// drop drops the batches not sent yet and cancels the requests in flight.
+func (w *remoteWriter) drop() {
+	for _, s := range w.shards {
+		s.batch = nil
+	}
+
+	w.cancel()
+	if err := w.waitAll(); err != nil && errors.Cause(err) != context.Canceled {
+		level.Warn(w.logger).Log("msg", "remote write failed", "err", err)
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+}
+
+// waitAll waits for the requests in flight of all shards and returns
+// the first error.
+func (w *remoteWriter) waitAll() error {
+	var res error
+	for _, s := range w.shards {
+		if err := w.wait(s); err != nil && res == nil {
+			res = err
+		}
+	}
+
+	return res
+}
+
+// store sends the batch, retrying with backoff, and returns the number
+// of retries.
+func (w *remoteWriter) store(ctx context.Context, batch []prompb.TimeSeries) (int, error) {
+	data, err := (&prompb.WriteRequest{Timeseries: batch}).Marshal()
+	if err != nil {
+		return 0, errors.Wrap(err, "marshal write request")
+	}
+	body := snappy.Encode(nil, data)
+
+	backoff := w.config.MinBackoff
+	for retries := 0; ; retries++ {
+		recoverable, err := w.post(ctx, body)
+		if err == nil {
+			return retries, nil
+		}
+
+		if ctx.Err() != nil {
+			return retries, errors.Wrapf(ctx.Err(), "remote write to %s", w.config.URL)
+		}
+
+		if !recoverable || retries >= w.maxRetries {
+			return retries, errors.Wrapf(err, "remote write to %s", w.config.URL)
+		}
+
+		level.Debug(w.logger).Log("msg", "retrying remote write", "err", err, "backoff", backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return retries, errors.Wrapf(ctx.Err(), "remote write to %s", w.config.URL)
+		}
+
+		backoff *= 2
+		if backoff > w.config.MaxBackoff {
+			backoff = w.config.MaxBackoff
+		}
+	}
+}
+
+// post sends one request. The error is recoverable if the request can
+// be retried.
+func (w *remoteWriter) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "blockgen")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range w.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+
+	line := ""
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxErrMsgLen))
+	if scanner.Scan() {
+		line = scanner.Text()
+	}
+
+	recoverable := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+	return recoverable, errors.Errorf("server returned HTTP status %s: %s", resp.Status, line)
+}
@@ -0,0 +1,207 @@
+package blockgen
+
+import (
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testReceiver is remote write endpoint which decodes and counts samples.
+type testReceiver struct {
+	mtx      sync.Mutex
+	requests int
+	samples  map[string][]prompb.Sample
+	tenants  map[string]bool
+
+	// failures is the number of requests to fail with status.
+	failures int
+	status   int
+}
+
+func (r *testReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.requests++
+	if r.failures > 0 {
+		r.failures--
+		http.Error(w, "failure", r.status)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var wr prompb.WriteRequest
+	if err := wr.Unmarshal(data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.samples == nil {
+		r.samples = map[string][]prompb.Sample{}
+		r.tenants = map[string]bool{}
+	}
+	r.tenants[req.Header.Get("THANOS-TENANT")] = true
+
+	for _, ts := range wr.Timeseries {
+		var l labels.Labels
+		for _, lbl := range ts.Labels {
+			l = append(l, labels.Label{Name: lbl.Name, Value: lbl.Value})
+		}
+		r.samples[l.String()] = append(r.samples[l.String()], ts.Samples...)
+	}
+}
+
+func Test_remoteWriter(t *testing.T) {
+	receiver := &testReceiver{failures: 2, status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	writer, err := NewRemoteWriter(RemoteWriteConfig{
+		URL:        srv.URL,
+		Headers:    map[string]string{"THANOS-TENANT": "blockgen"},
+		BatchSize:  7,
+		Shards:     3,
+		MinBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewRemoteWriter: %v", err)
+	}
+
+	generatorConfig := DefaultGeneratorConfig(9 * time.Minute)
+	generatorConfig.FlushInterval = 3 * time.Minute
+	valProvider := NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3})
+
+	g := NewGeneratorWithConfig(generatorConfig)
+	if err := g.Generate(writer, valProvider); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	if len(receiver.samples) != 6 {
+		t.Errorf("want 6 series, got %d", len(receiver.samples))
+	}
+
+	received := 0
+	for key, samples := range receiver.samples {
+		received += len(samples)
+		for i := 1; i < len(samples); i++ {
+			if samples[i].Timestamp <= samples[i-1].Timestamp {
+				t.Fatalf("%s: samples out of order at %d", key, i)
+			}
+		}
+	}
+
+	if int64(received) != g.Progress().SamplesWritten {
+		t.Errorf("want %d samples, got %d", g.Progress().SamplesWritten, received)
+	}
+
+	if len(receiver.tenants) != 1 || !receiver.tenants["blockgen"] {
+		t.Errorf("want tenant header in all requests, got %v", receiver.tenants)
+	}
+}
+
+func Test_remoteWriter_Errors(t *testing.T) {
+	receiver := &testReceiver{failures: 1, status: http.StatusBadRequest}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	writer, err := NewRemoteWriter(RemoteWriteConfig{URL: srv.URL, MinBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewRemoteWriter: %v", err)
+	}
+
+	v := &valAdapter{v: 1, l: labels.FromStrings("__name__", "foo")}
+
+	// Client errors are not retried.
+	if err := writer.Write(time.Now(), v); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := writer.Flush(); err == nil {
+		t.Errorf("want error for bad request")
+	}
+	if receiver.requests != 1 {
+		t.Errorf("want 1 request, got %d", receiver.requests)
+	}
+
+	// Too many requests are retried until MaxRetries.
+	receiver.failures, receiver.status = 10, http.StatusTooManyRequests
+	if err := writer.Write(time.Now(), v); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := writer.Flush(); err == nil {
+		t.Errorf("want error after retries")
+	}
+	if want := 1 + 1 + DefaultRemoteWriteMaxRetries; receiver.requests != want {
+		t.Errorf("want %d requests, got %d", want, receiver.requests)
+	}
+
+	// Zero means no retries.
+	noRetries := 0
+	writer, err = NewRemoteWriter(RemoteWriteConfig{URL: srv.URL, MaxRetries: &noRetries})
+	if err != nil {
+		t.Fatalf("NewRemoteWriter: %v", err)
+	}
+	receiver.requests = 0
+	if err := writer.Write(time.Now(), v); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := writer.Flush(); err == nil {
+		t.Errorf("want error without retries")
+	}
+	if receiver.requests != 1 {
+		t.Errorf("want 1 request, got %d", receiver.requests)
+	}
+
+	negative := -1
+	for _, config := range []RemoteWriteConfig{{}, {URL: "ftp://foo"}, {URL: srv.URL, Shards: -1}, {URL: srv.URL, MaxRetries: &negative}} {
+		if _, err := NewRemoteWriter(config); err == nil {
+			t.Errorf("want error for config %+v", config)
+		}
+	}
+}
+
+func Test_remoteWriter_Discard(t *testing.T) {
+	receiver := &testReceiver{failures: 1000, status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	writer, err := NewRemoteWriter(RemoteWriteConfig{URL: srv.URL, BatchSize: 1, MinBackoff: time.Hour})
+	if err != nil {
+		t.Fatalf("NewRemoteWriter: %v", err)
+	}
+
+	// The batch is sent right away and the retry waits for the backoff.
+	if err := writer.Write(time.Now(), &valAdapter{v: 1, l: labels.FromStrings("__name__", "foo")}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- writer.(Discarder).Discard()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Discard: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Discard did not cancel the backoff")
+	}
+}
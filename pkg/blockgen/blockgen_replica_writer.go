@@ -0,0 +1,232 @@
+package blockgen
+
+import (
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ReplicaConfig configures one replica, see `ReplicationConfig`.
+type ReplicaConfig struct {
+	// Name is the name of the replica and its output subdirectory, so it
+	// can't contain path separators.
+	Name string `yaml:"name"`
+
+	// ExternalLabels are added to the external labels of the writer,
+	// e.g. replica=a or cluster=eu.
+	ExternalLabels map[string]string `yaml:"externalLabels"`
+}
+
+// BlockWriterConfig returns the config of the replica block writer based
+// on the given one: the output is in the subdirectory named after the
+// replica and external labels are merged.
+func (r ReplicaConfig) BlockWriterConfig(base BlockWriterConfig) BlockWriterConfig {
+	res := base
+	res.Dir = filepath.Join(base.Dir, r.Name)
+	res.ExternalLabels = map[string]string{}
+
+	for k, v := range base.ExternalLabels {
+		res.ExternalLabels[k] = v
+	}
+
+	for k, v := range r.ExternalLabels {
+		res.ExternalLabels[k] = v
+	}
+
+	return res
+}
+
+// ReplicationConfig configures the writer returned by `NewReplicaWriter`.
+type ReplicationConfig struct {
+	// Replicas to produce, one block stream for each.
+	Replicas []ReplicaConfig `yaml:"replicas"`
+
+	// TimestampJitter is the maximum difference of sample timestamps
+	// between replicas. Every sample timestamp is moved by random
+	// offset in range [-TimestampJitter, +TimestampJitter]. Must be
+	// less than half of the sample interval to keep samples in order.
+	TimestampJitter time.Duration `yaml:"timestampJitter"`
+
+	// ValueJitter is the maximum relative difference of values between
+	// replicas, e.g. 0.01 is 1%. All values of a series in a replica are
+	// scaled by the same random factor so that counters stay monotonic.
+	ValueJitter float64 `yaml:"valueJitter"`
+
+	// Seed is the random seed.
+	Seed int64 `yaml:"seed"`
+}
+
+// Validate checks the config is usable.
+func (c ReplicationConfig) Validate() error {
+	if c.TimestampJitter < 0 {
+		return errors.New("timestampJitter must not be negative")
+	}
+
+	if c.ValueJitter < 0 || c.ValueJitter >= 1 {
+		return errors.New("valueJitter must be in range [0, 1)")
+	}
+
+	names := map[string]struct{}{}
+	for _, r := range c.Replicas {
+		if _, found := names[r.Name]; found || r.Name == "" {
+			return errors.Errorf("replica name '%s' must be unique and not empty", r.Name)
+		}
+		names[r.Name] = struct{}{}
+
+		// The name is the subdirectory, it must not point elsewhere.
+		if strings.ContainsAny(r.Name, `/\`) || r.Name == "." || r.Name == ".." {
+			return errors.Errorf("replica name '%s' must not contain path separators or be . or ..", r.Name)
+		}
+	}
+
+	return nil
+}
+
+// NewReplicaWriter creates writer which writes every value to all given
+// writers, one per each of `config.Replicas`, with optional jitter. This is
+// to produce the same data for several replicas or clusters in one go, e.g.
+// for testing deduplication.
+func NewReplicaWriter(writers []Writer, config ReplicationConfig) (Writer, error) {
+	if len(writers) != len(config.Replicas) {
+		return nil, errors.Errorf("want %d writers, one per replica, got %d", len(config.Replicas), len(writers))
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	res := &replicaWriter{config: config}
+	for i, r := range config.Replicas {
+		res.replicas = append(res.replicas, &replica{
+			name:    r.Name,
+			seed:    config.Seed + int64(i),
+			writer:  writers[i],
+			factors: map[uint64]float64{},
+		})
+	}
+
+	return res, nil
+}
+
+// replica is the state of one replica.
+type replica struct {
+	name   string
+	seed   int64
+	writer Writer
+
+	// factors are value scale factors by series hash.
+	factors map[uint64]float64
+}
+
+// replicaWriter is implementation of Writer for replicas.
+type replicaWriter struct {
+	config   ReplicationConfig
+	replicas []*replica
+
+	// mint and maxt are the block range set by SetBlockRange, zero if not set.
+	mint time.Time
+	maxt time.Time
+}
+
+// Write implements Writer interface.
+func (w *replicaWriter) Write(t time.Time, v Val) error {
+	for _, r := range w.replicas {
+		rt := t
+		if jitter := w.config.TimestampJitter; jitter > 0 {
+			rt = w.clamp(t.Add(r.jitter(v.Labels(), t, jitter)))
+		}
+
+		rv := v
+		if w.config.ValueJitter > 0 && !math.IsNaN(v.Val()) {
+			rv = &valAdapter{v: v.Val() * r.factor(v.Labels(), w.config.ValueJitter), l: v.Labels()}
+		}
+
+		if err := r.writer.Write(rt, rv); err != nil {
+			return errors.Wrapf(err, "replica %s", r.name)
+		}
+	}
+
+	return nil
+}
+
+// Flush implements Writer interface.
+func (w *replicaWriter) Flush() error {
+	for _, r := range w.replicas {
+		if err := r.writer.Flush(); err != nil {
+			return errors.Wrapf(err, "replica %s", r.name)
+		}
+	}
+
+	return nil
+}
+
+// SetBlockRange implements BlockRangeSetter interface. The jitter never
+// moves samples out of the block range.
+func (w *replicaWriter) SetBlockRange(mint, maxt time.Time) {
+	w.mint, w.maxt = mint, maxt
+
+	for _, r := range w.replicas {
+		if s, ok := r.writer.(BlockRangeSetter); ok {
+			s.SetBlockRange(mint, maxt)
+		}
+	}
+}
+
+// clamp moves the time into the block range, if set.
+func (w *replicaWriter) clamp(t time.Time) time.Time {
+	if w.maxt.IsZero() {
+		return t
+	}
+
+	if t.Before(w.mint) {
+		return w.mint
+	}
+
+	// The range is half-open and tsdb has millisecond precision.
+	if last := w.maxt.Add(-time.Millisecond); t.After(last) {
+		return last
+	}
+
+	return t
+}
+
+// Discard implements Discarder interface.
+func (w *replicaWriter) Discard() error {
+	for _, r := range w.replicas {
+		if d, ok := r.writer.(Discarder); ok {
+			if err := d.Discard(); err != nil {
+				return errors.Wrapf(err, "replica %s", r.name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// jitter returns the timestamp offset of the sample of the series in this
+// replica, in range [-jitter, +jitter]. It's random but depends only on
+// the series and the timestamp, so that parallel workers writing
+// different time ranges give the same result as one writer.
+func (r *replica) jitter(l labels.Labels, t time.Time, jitter time.Duration) time.Duration {
+	h := randval.Uint64(seriesSeed(r.seed, l), t.UnixNano())
+	return time.Duration(h%uint64(2*jitter+1)) - jitter
+}
+
+// factor returns the value scale factor of the series in this replica.
+// It's random but always the same for the same series.
+func (r *replica) factor(l labels.Labels, jitter float64) float64 {
+	hash := l.Hash()
+	if f, found := r.factors[hash]; found {
+		return f
+	}
+
+	random := rand.New(rand.NewSource(seriesSeed(r.seed, l)))
+	f := 1 + jitter*(2*random.Float64()-1)
+	r.factors[hash] = f
+	return f
+}
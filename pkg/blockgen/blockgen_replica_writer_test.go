@@ -0,0 +1,165 @@
+package blockgen
+
+import (
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"testing"
+	"time"
+)
+
+func Test_replicaWriter_Write(t *testing.T) {
+	valProvider, err := NewRandValProvider(RandValProviderConfig{
+		Metrics: []MetricConfig{
+			{
+				Name:       "foo_total",
+				Type:       Counter,
+				ValueModel: &randval.Config{MaxValue: 1e9, MaxChangeValue: 100},
+			},
+		},
+		TargetCount: 5,
+	})
+	if err != nil {
+		t.Fatalf("NewRandValProvider: %v", err)
+	}
+
+	a, b := &memWriter{}, &memWriter{}
+	config := ReplicationConfig{
+		Replicas: []ReplicaConfig{
+			{Name: "a", ExternalLabels: map[string]string{"replica": "a"}},
+			{Name: "b", ExternalLabels: map[string]string{"replica": "b"}},
+		},
+		TimestampJitter: time.Second,
+		ValueJitter:     0.05,
+	}
+
+	writer, err := NewReplicaWriter([]Writer{a, b}, config)
+	if err != nil {
+		t.Fatalf("NewReplicaWriter: %v", err)
+	}
+
+	generatorConfig := DefaultGeneratorConfig(time.Hour)
+	generatorConfig.FlushInterval = 30 * time.Minute
+	if err := NewGeneratorWithConfig(generatorConfig).Generate(writer, valProvider); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	if a.flushes != b.flushes || a.flushes == 0 {
+		t.Errorf("want same number of flushes, got %d and %d", a.flushes, b.flushes)
+	}
+
+	for key, as := range a.samples {
+		bs := b.samples[key]
+		if len(as) != len(bs) {
+			t.Fatalf("%s: want same number of samples, got %d and %d", key, len(as), len(bs))
+		}
+
+		different := false
+		for i := range as {
+			if as[i] != bs[i] {
+				different = true
+			}
+
+			if i > 0 && (as[i] < as[i-1] || bs[i] < bs[i-1]) {
+				t.Fatalf("%s: counter went down at sample %d", key, i)
+			}
+
+			ta, tb := a.times[key][i], b.times[key][i]
+			if d := ta.Sub(tb); d > 2*time.Second || d < -2*time.Second {
+				t.Fatalf("%s: timestamps %v and %v too far apart", key, ta, tb)
+			}
+		}
+
+		if !different {
+			t.Errorf("%s: want jitter between replicas, got same values", key)
+		}
+	}
+
+	bc := config.Replicas[1].BlockWriterConfig(BlockWriterConfig{
+		Dir:            "/out",
+		ExternalLabels: map[string]string{"cluster": "eu"},
+	})
+	if bc.Dir != "/out/b" || bc.ExternalLabels["cluster"] != "eu" || bc.ExternalLabels["replica"] != "b" {
+		t.Errorf("wrong replica block writer config: %+v", bc)
+	}
+}
+
+func Test_replicaWriter_SetBlockRange(t *testing.T) {
+	a := &memWriter{}
+	config := ReplicationConfig{
+		Replicas:        []ReplicaConfig{{Name: "a"}},
+		TimestampJitter: 7 * time.Second,
+	}
+
+	writer, err := NewReplicaWriter([]Writer{a}, config)
+	if err != nil {
+		t.Fatalf("NewReplicaWriter: %v", err)
+	}
+
+	mint := time.Date(2019, time.September, 30, 0, 0, 0, 0, time.UTC)
+	maxt := mint.Add(2 * time.Hour)
+	writer.(BlockRangeSetter).SetBlockRange(mint, maxt)
+
+	v := &valAdapter{v: 1, l: labels.FromStrings("__name__", "foo")}
+	for i := 0; i < 100; i++ {
+		if err := writer.Write(mint, v); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := writer.Write(maxt.Add(-time.Second), v); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	for _, ts := range a.times[v.Labels().String()] {
+		if ts.Before(mint) || !ts.Before(maxt) {
+			t.Fatalf("sample at %s outside of block range [%s, %s)", ts, mint, maxt)
+		}
+	}
+}
+
+func Test_replicaWriter_Jitter(t *testing.T) {
+	config := ReplicationConfig{
+		Replicas:        []ReplicaConfig{{Name: "a"}},
+		TimestampJitter: 7 * time.Second,
+	}
+
+	all, second := &memWriter{}, &memWriter{}
+	allWriter, err := NewReplicaWriter([]Writer{all}, config)
+	if err != nil {
+		t.Fatalf("NewReplicaWriter: %v", err)
+	}
+	secondWriter, err := NewReplicaWriter([]Writer{second}, config)
+	if err != nil {
+		t.Fatalf("NewReplicaWriter: %v", err)
+	}
+
+	// Fresh writer of the second half, as in parallel worker, gives the
+	// same timestamps as the writer of all the samples.
+	start := time.Date(2019, time.September, 30, 0, 0, 0, 0, time.UTC)
+	v := &valAdapter{v: 1, l: labels.FromStrings("__name__", "foo")}
+	for i := 0; i < 100; i++ {
+		ts := start.Add(time.Duration(i) * 15 * time.Second)
+		if err := allWriter.Write(ts, v); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if i >= 50 {
+			if err := secondWriter.Write(ts, v); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+	}
+
+	key := v.Labels().String()
+	different := false
+	for i, ts := range second.times[key] {
+		if !ts.Equal(all.times[key][50+i]) {
+			t.Fatalf("sample %d: want %s, got %s", 50+i, all.times[key][50+i], ts)
+		}
+		if !ts.Equal(start.Add(time.Duration(50+i) * 15 * time.Second)) {
+			different = true
+		}
+	}
+
+	if !different {
+		t.Errorf("want jitter, got exact timestamps")
+	}
+}
@@ -0,0 +1,203 @@
+package blockgen
+
+import (
+	"bufio"
+	"context"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/value"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultScrapeTargetLabel is the default of `ScrapeTargetsConfig.TargetLabel`.
+const DefaultScrapeTargetLabel = "target"
+
+// openMetricsContentType is the content type of OpenMetrics text.
+const openMetricsContentType = "application/openmetrics-text; version=0.0.1; charset=utf-8"
+
+// ScrapeTargetsConfig configures `NewScrapeTargets`.
+type ScrapeTargetsConfig struct {
+	// TargetLabel is the label whose values are the simulated targets,
+	// e.g. `pod` with `K8sSchemaConfig`.
+	TargetLabel string `yaml:"targetLabel"`
+
+	// TickInterval makes the values move forward at this interval of
+	// the wall clock. If zero, they move forward when scraped, so that
+	// every scrape of a target returns new values.
+	TickInterval time.Duration `yaml:"tickInterval"`
+}
+
+// ScrapeTargets serves the current values of value providers as
+// simulated scrape targets, one `http.Handler` per target, in
+// OpenMetrics text format.
+type ScrapeTargets struct {
+	config       ScrapeTargetsConfig
+	valProviders []ValProvider
+
+	mtx sync.Mutex
+
+	// targets are the targets of the first sample, in order.
+	targets []string
+	index   map[string]int
+
+	// series are the current series of every target.
+	series []map[uint64][]*omSeries
+
+	// sample is the number of the current sample, seen is the sample
+	// last served by every target.
+	sample int64
+	seen   []int64
+}
+
+// NewScrapeTargets creates scrape targets of the values of the providers.
+// The targets are the values of `config.TargetLabel` of the first sample.
+// The series of targets which only appear later, e.g. with series churn,
+// are served by one of the first targets chosen by the label value.
+func NewScrapeTargets(config ScrapeTargetsConfig, valProviders ...ValProvider) (*ScrapeTargets, error) {
+	if len(valProviders) == 0 {
+		return nil, errors.New("no value providers")
+	}
+
+	if config.TickInterval < 0 {
+		return nil, errors.New("tickInterval must not be negative")
+	}
+
+	if config.TargetLabel == "" {
+		config.TargetLabel = DefaultScrapeTargetLabel
+	}
+
+	s := &ScrapeTargets{
+		config:       config,
+		valProviders: valProviders,
+		index:        map[string]int{},
+	}
+
+	// The targets are found while reading the first sample.
+	s.advance()
+
+	if len(s.targets) == 0 {
+		return nil, errors.Errorf("no series with label %s", config.TargetLabel)
+	}
+
+	return s, nil
+}
+
+// Targets returns the names of the targets, i.e. the values of the target label.
+func (s *ScrapeTargets) Targets() []string {
+	return append([]string(nil), s.targets...)
+}
+
+// Handler returns the handler serving the metrics of the target.
+func (s *ScrapeTargets) Handler(target string) (http.Handler, error) {
+	i, found := s.index[target]
+	if !found {
+		return nil, errors.Errorf("unknown target %s", target)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", openMetricsContentType)
+
+		buf := bufio.NewWriter(w)
+		s.write(buf, i)
+		buf.Flush()
+	}), nil
+}
+
+// Run moves the values forward every tick interval until the context is
+// done. It returns immediately if values move forward when scraped.
+func (s *ScrapeTargets) Run(ctx context.Context) error {
+	if s.config.TickInterval == 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(s.config.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			s.mtx.Lock()
+			s.advance()
+			s.mtx.Unlock()
+		}
+	}
+}
+
+// write writes the metrics of the target with given index, moving the
+// values forward first if the target has seen them.
+func (s *ScrapeTargets) write(w *bufio.Writer, i int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.config.TickInterval == 0 && s.seen[i] == s.sample {
+		s.advance()
+	}
+	s.seen[i] = s.sample
+
+	for _, family := range omFamilies(s.series[i]) {
+		family.write(w, false)
+	}
+	w.WriteString("# EOF\n")
+}
+
+// advance reads the next sample of the providers. The mutex must be held.
+func (s *ScrapeTargets) advance() {
+	first := s.targets == nil
+
+	var samples []Val
+	for _, valProvider := range s.valProviders {
+		for v := range valProvider.Next() {
+			// Terminated series just disappear, same as from real targets.
+			if !value.IsStaleNaN(v.Val()) {
+				samples = append(samples, v)
+			}
+		}
+	}
+
+	if first {
+		for _, v := range samples {
+			target := v.Labels().Get(s.config.TargetLabel)
+			if _, found := s.index[target]; !found && target != "" {
+				s.index[target] = len(s.targets)
+				s.targets = append(s.targets, target)
+			}
+		}
+
+		sort.Strings(s.targets)
+		for i, target := range s.targets {
+			s.index[target] = i
+		}
+		s.seen = make([]int64, len(s.targets))
+	}
+
+	s.series = make([]map[uint64][]*omSeries, len(s.targets))
+	for i := range s.series {
+		s.series[i] = map[uint64][]*omSeries{}
+	}
+
+	for _, v := range samples {
+		i, found := s.index[v.Labels().Get(s.config.TargetLabel)]
+		if !found {
+			if len(s.targets) == 0 {
+				continue
+			}
+			h := fnv.New64a()
+			h.Write([]byte(v.Labels().Get(s.config.TargetLabel)))
+			i = int(h.Sum64() % uint64(len(s.targets)))
+		}
+
+		l := v.Labels()
+		hash := l.Hash()
+		s.series[i][hash] = append(s.series[i][hash], &omSeries{
+			labels:  l,
+			samples: []omSample{{v: v.Val()}},
+		})
+	}
+
+	s.sample++
+}
@@ -0,0 +1,141 @@
+package blockgen
+
+import (
+	"context"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingProvider counts the calls of Next, for tests.
+type countingProvider struct {
+	ValProvider
+	calls int
+}
+
+func (p *countingProvider) Next() <-chan Val {
+	p.calls++
+	return p.ValProvider.Next()
+}
+
+// scrapeTarget scrapes the handler and returns the target label values
+// of the series.
+func scrapeTarget(t *testing.T, s *ScrapeTargets, target string) []string {
+	h, err := s.Handler(target)
+	if err != nil {
+		t.Fatalf("Handler: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("want OpenMetrics content type, got %s", ct)
+	}
+
+	b, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+
+	var res []string
+	p := textparse.NewOpenMetricsParser(b)
+	for {
+		entry, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("parse %s: %v", target, err)
+		}
+
+		if entry == textparse.EntrySeries {
+			if _, ts, _ := p.Series(); ts != nil {
+				t.Errorf("want no timestamps")
+			}
+			var l promlabels.Labels
+			p.Metric(&l)
+			res = append(res, l.Get("target"))
+		}
+	}
+
+	return res
+}
+
+func TestScrapeTargets(t *testing.T) {
+	valProvider := &countingProvider{ValProvider: NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3})}
+
+	s, err := NewScrapeTargets(ScrapeTargetsConfig{}, valProvider)
+	if err != nil {
+		t.Fatalf("NewScrapeTargets: %v", err)
+	}
+
+	if want := []string{"target_0", "target_1", "target_2"}; !reflect.DeepEqual(s.Targets(), want) {
+		t.Fatalf("want targets %v, got %v", want, s.Targets())
+	}
+
+	series := scrapeTarget(t, s, "target_1")
+	if len(series) != 2 {
+		t.Fatalf("want 2 series, got %v", series)
+	}
+	for _, m := range series {
+		if m != "target_1" {
+			t.Errorf("want only series of target_1, got %s", m)
+		}
+	}
+
+	// Every target gets new values at every scrape, other targets catch up.
+	for i, c := range []struct {
+		target string
+		calls  int
+	}{
+		{"target_1", 2},
+		{"target_0", 2},
+		{"target_0", 3},
+		{"target_2", 3},
+	} {
+		scrapeTarget(t, s, c.target)
+		if valProvider.calls != c.calls {
+			t.Errorf("scrape %d: want %d samples, got %d", i, c.calls, valProvider.calls)
+		}
+	}
+
+	if _, err := s.Handler("target_3"); err == nil {
+		t.Errorf("want error for unknown target")
+	}
+}
+
+func TestScrapeTargets_Tick(t *testing.T) {
+	valProvider := &countingProvider{ValProvider: NewValProvider(ValProviderConfig{MetricCount: 1, TargetCount: 1})}
+
+	s, err := NewScrapeTargets(ScrapeTargetsConfig{TickInterval: 5 * time.Millisecond}, valProvider)
+	if err != nil {
+		t.Fatalf("NewScrapeTargets: %v", err)
+	}
+
+	// Scrapes don't move the values forward.
+	scrapeTarget(t, s, "target_0")
+	scrapeTarget(t, s, "target_0")
+	if valProvider.calls != 1 {
+		t.Errorf("want 1 sample, got %d", valProvider.calls)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := s.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if valProvider.calls < 5 {
+		t.Errorf("want more samples after ticks, got %d", valProvider.calls)
+	}
+}
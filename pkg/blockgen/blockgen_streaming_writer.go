@@ -0,0 +1,280 @@
+package blockgen
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// samplesPerChunk is the number of samples after which chunk is cut,
+// same as in tsdb head.
+const samplesPerChunk = 120
+
+// NewStreamingBlockWriter creates TSDB block writer which writes chunks to
+// disk as soon as they are full instead of keeping all samples in memory
+// until `Flush`. Only the labels and chunk references of every series
+// are kept in memory, so it can write blocks of large ranges, e.g. 14d,
+// directly. The compaction level in meta.json is the level the block
+// would get from Thanos Compactor, see `CompactionLevel`.
+//
+// Samples of every series must be written in time order, the others are
+// handled according to `config.InvalidSamples`. Same as the
+// writer of `NewBlockWriterWithConfig`, the returned writer is not
+// thread-safe and every `Flush` writes one block.
+func NewStreamingBlockWriter(config BlockWriterConfig) (Writer, error) {
+	logger := log.NewLogfmtLogger(os.Stderr)
+
+	builder, err := newBlockBuilder(config, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	checker, err := newSampleChecker(logger, config.InvalidSamples, config.Metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &streamingBlockWriter{
+		logger:  logger,
+		dir:     config.Dir,
+		builder: builder,
+		metrics: config.Metrics,
+		checker: checker,
+	}
+	res.reset()
+
+	return res, nil
+}
+
+// streamSeries is one series of the block being written.
+type streamSeries struct {
+	*blockSeries
+
+	// chunk is the open chunk, nil if none, mint is its first timestamp.
+	chunk    chunkenc.Chunk
+	appender chunkenc.Appender
+	mint     int64
+
+	// maxt and lastV are the latest sample of the series.
+	maxt  int64
+	lastV float64
+}
+
+// streamingBlockWriter is implementation of Writer interface. Not designed to be thread-safe.
+type streamingBlockWriter struct {
+	logger  log.Logger
+	dir     string
+	builder *blockBuilder
+	metrics *BlockWriterMetrics
+	checker *sampleChecker
+
+	// series by labels hash, usually one per hash.
+	series    map[uint64][]*streamSeries
+	numSeries int
+
+	// mint and maxt are the time range of written samples.
+	mint int64
+	maxt int64
+
+	// blockMint and blockMaxt are the range of the next block as set by
+	// SetBlockRange, zero if not set.
+	blockMint int64
+	blockMaxt int64
+
+	// lastBlock is the ID of the block written by the last Flush.
+	lastBlock ulid.ULID
+}
+
+// reset prepares the writer for the next block.
+func (w *streamingBlockWriter) reset() {
+	if w.metrics != nil {
+		w.metrics.headSeries.Sub(float64(w.numSeries))
+	}
+
+	w.series = map[uint64][]*streamSeries{}
+	w.numSeries = 0
+	w.mint = math.MaxInt64
+	w.maxt = math.MinInt64
+	w.blockMint, w.blockMaxt = 0, 0
+}
+
+// SetBlockRange implements BlockRangeSetter interface.
+func (w *streamingBlockWriter) SetBlockRange(mint, maxt time.Time) {
+	w.blockMint = timestamp.FromTime(mint)
+	w.blockMaxt = timestamp.FromTime(maxt)
+}
+
+// Write implements Writer interface. The chunk of the series is written
+// to disk when full.
+func (w *streamingBlockWriter) Write(t time.Time, v Val) error {
+	ts := timestamp.FromTime(t)
+	s, err := w.getOrCreate(v.Labels())
+	if err != nil {
+		return err
+	}
+
+	if ok, err := w.checker.check(s.labels, s.maxt, s.lastV, ts, v.Val()); !ok {
+		return err
+	}
+
+	if s.chunk != nil && s.chunk.NumSamples() >= samplesPerChunk {
+		if err := w.cut(s); err != nil {
+			return err
+		}
+	}
+
+	if s.chunk == nil {
+		chunk := chunkenc.NewXORChunk()
+		app, err := chunk.Appender()
+		if err != nil {
+			return errors.Wrap(err, "chunk appender")
+		}
+		s.chunk, s.appender, s.mint = chunk, app, ts
+	}
+
+	s.appender.Append(ts, v.Val())
+	s.maxt, s.lastV = ts, v.Val()
+
+	if ts < w.mint {
+		w.mint = ts
+	}
+	if ts > w.maxt {
+		w.maxt = ts
+	}
+
+	if w.metrics != nil {
+		w.metrics.samplesAppended.Inc()
+	}
+
+	return nil
+}
+
+// getOrCreate returns the series with given labels.
+func (w *streamingBlockWriter) getOrCreate(l labels.Labels) (*streamSeries, error) {
+	hash := l.Hash()
+	for _, s := range w.series[hash] {
+		if s.labels.Equals(l) {
+			return s, nil
+		}
+	}
+
+	bs, err := w.builder.newSeries(l)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &streamSeries{blockSeries: bs, maxt: math.MinInt64}
+	w.series[hash] = append(w.series[hash], s)
+	w.numSeries++
+
+	if w.metrics != nil {
+		w.metrics.headSeries.Inc()
+	}
+
+	return s, nil
+}
+
+// cut writes the open chunk of the series to disk.
+func (w *streamingBlockWriter) cut(s *streamSeries) error {
+	chk := chunks.Meta{Chunk: s.chunk, MinTime: s.mint, MaxTime: s.maxt}
+	if err := w.builder.addChunk(s.blockSeries, chk); err != nil {
+		return err
+	}
+
+	s.chunk, s.appender = nil, nil
+	return nil
+}
+
+// Flush implements Writer interface. It writes the remaining chunks, the
+// index and meta.json and makes the block visible.
+func (w *streamingBlockWriter) Flush() error {
+	start := time.Now()
+	if err := w.writeBlock(); err != nil {
+		return errors.Wrap(err, "writeBlock")
+	}
+
+	if w.metrics != nil && w.lastBlock != (ulid.ULID{}) {
+		w.metrics.flushDuration.Observe(time.Since(start).Seconds())
+
+		size, err := dirSize(filepath.Join(w.dir, w.lastBlock.String()))
+		if err != nil {
+			return errors.Wrap(err, "block size")
+		}
+		w.metrics.blockSize.Observe(float64(size))
+	}
+
+	w.checker.flush()
+	w.reset()
+	return nil
+}
+
+// writeBlock cuts all open chunks and writes the block.
+func (w *streamingBlockWriter) writeBlock() error {
+	w.lastBlock = ulid.ULID{}
+
+	// No block is written when there are no samples.
+	if w.numSeries == 0 {
+		return nil
+	}
+
+	mint, maxt := w.mint, w.maxt+1
+	if w.blockMaxt != 0 {
+		if mint < w.blockMint || maxt > w.blockMaxt {
+			return errors.Errorf("samples in [%d, %d) are outside of block range [%d, %d)",
+				mint, maxt, w.blockMint, w.blockMaxt)
+		}
+		mint, maxt = w.blockMint, w.blockMaxt
+	}
+
+	for _, ss := range w.series {
+		for _, s := range ss {
+			if s.chunk != nil {
+				if err := w.cut(s); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	stats := w.builder.stats
+	level.Info(w.logger).Log(
+		"series_count", w.numSeries,
+		"sample_count", stats.NumSamples,
+		"chunk_count", stats.NumChunks,
+		"mint", timestamp.Time(mint),
+		"maxt", timestamp.Time(maxt))
+
+	id, err := w.builder.write(mint, maxt)
+	if err != nil {
+		return err
+	}
+
+	w.lastBlock = id
+	return nil
+}
+
+// Discard implements Discarder interface.
+func (w *streamingBlockWriter) Discard() error {
+	if err := w.builder.discard(); err != nil {
+		return err
+	}
+
+	w.checker.reset()
+	w.reset()
+	return nil
+}
+
+// LastFlushedBlock returns the ID of the block written by the last Flush,
+// zero if there was nothing to write.
+func (w *streamingBlockWriter) LastFlushedBlock() ulid.ULID {
+	return w.lastBlock
+}
@@ -0,0 +1,169 @@
+package blockgen
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readBlockSamples reads all samples of the block, by series.
+func readBlockSamples(t *testing.T, dir string) map[string][]float64 {
+	block, err := tsdb.OpenBlock(log.NewNopLogger(), dir, nil)
+	if err != nil {
+		t.Fatalf("OpenBlock: %v", err)
+	}
+	defer block.Close()
+
+	q, err := tsdb.NewBlockQuerier(block, math.MinInt64, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("NewBlockQuerier: %v", err)
+	}
+	defer q.Close()
+
+	set, err := q.Select(labels.NewMustRegexpMatcher("__name__", ".+"))
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+
+	res := map[string][]float64{}
+	for set.Next() {
+		s := set.At()
+		it := s.Iterator()
+		for it.Next() {
+			_, v := it.At()
+			res[s.Labels().String()] = append(res[s.Labels().String()], v)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("iterate %s: %v", s.Labels(), err)
+		}
+	}
+	if err := set.Err(); err != nil {
+		t.Fatalf("iterate series: %v", err)
+	}
+
+	return res
+}
+
+func Test_streamingBlockWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, err := NewStreamingBlockWriter(BlockWriterConfig{
+		Dir:            dir,
+		ExternalLabels: map[string]string{"cluster": "eu-1"},
+	})
+	if err != nil {
+		t.Fatalf("NewStreamingBlockWriter: %v", err)
+	}
+
+	// 2d blocks are aligned to Unix epoch, so the window spans two of them.
+	config := DefaultGeneratorConfig(48 * time.Hour)
+	config.StartTime = time.Date(2019, time.September, 30, 0, 0, 0, 0, time.UTC)
+	config.SampleInterval = time.Minute
+	config.FlushInterval = 48 * time.Hour
+	config.AlignBlocks = true
+
+	// Generate the same data into memory to compare with.
+	want := &memWriter{}
+	for _, w := range []Writer{writer, want} {
+		providers, err := newTestValProviders()
+		if err != nil {
+			t.Fatalf("newTestValProviders: %v", err)
+		}
+
+		if err := NewGeneratorWithConfig(config).Generate(w, providers...); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+	}
+
+	metaFiles, err := filepath.Glob(filepath.Join(dir, "*", metaFilename))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+
+	if len(metaFiles) != 2 {
+		t.Fatalf("want 2 blocks, got %d", len(metaFiles))
+	}
+
+	got := map[string][]float64{}
+	for _, f := range metaFiles {
+		meta, err := ReadThanosMeta(filepath.Dir(f))
+		if err != nil {
+			t.Fatalf("ReadThanosMeta: %v", err)
+		}
+
+		if meta.MaxTime-meta.MinTime != int64(48*time.Hour/time.Millisecond) {
+			t.Errorf("%s: want 2d block, got [%d, %d)", f, meta.MinTime, meta.MaxTime)
+		}
+
+		if meta.Compaction.Level != 3 {
+			t.Errorf("%s: want compaction level 3, got %d", f, meta.Compaction.Level)
+		}
+
+		if meta.Thanos.Labels["cluster"] != "eu-1" {
+			t.Errorf("%s: wrong external labels %v", f, meta.Thanos.Labels)
+		}
+
+		for key, values := range readBlockSamples(t, filepath.Dir(f)) {
+			got[key] = append(got[key], values...)
+		}
+	}
+
+	if len(got) != len(want.samples) {
+		t.Fatalf("want %d series, got %d", len(want.samples), len(got))
+	}
+
+	for key, values := range want.samples {
+		if len(got[key]) != len(values) {
+			t.Errorf("%s: want %d samples, got %d", key, len(values), len(got[key]))
+			continue
+		}
+
+		for i, v := range values {
+			if math.Float64bits(v) != math.Float64bits(got[key][i]) {
+				t.Errorf("%s: sample %d: want %v, got %v", key, i, v, got[key][i])
+				break
+			}
+		}
+	}
+}
+
+func Test_streamingBlockWriter_OutOfOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, err := NewStreamingBlockWriter(BlockWriterConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewStreamingBlockWriter: %v", err)
+	}
+
+	now := time.Now()
+	v := &valAdapter{v: 1, l: labels.FromStrings("__name__", "foo")}
+	if err := writer.Write(now, v); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := writer.Write(now.Add(-time.Minute), v); err == nil {
+		t.Errorf("want out of order error")
+	}
+
+	if err := writer.(Discarder).Discard(); err != nil {
+		t.Fatalf("Discard: %v", err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("want empty dir after discard, got %d files", len(files))
+	}
+}
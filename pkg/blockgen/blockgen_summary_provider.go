@@ -0,0 +1,265 @@
+package blockgen
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// DefaultSummaryQuantiles are the quantiles used when none are configured.
+var DefaultSummaryQuantiles = []float64{0.5, 0.9, 0.99}
+
+// SummaryProviderConfig configures the `ValProvider` returned by `NewSummaryProvider`.
+//
+// For each target it produces the Prometheus summary family:
+// `<Name>{quantile="..."}` series for every quantile, `<Name>_sum`
+// and `<Name>_count`.
+type SummaryProviderConfig struct {
+	// Name is the base name of the summary, e.g. rpc_duration_seconds.
+	Name string `yaml:"name"`
+
+	// TargetCount is the number of simulated collection targets.
+	TargetCount int `yaml:"targetCount"`
+
+	// Quantiles to produce, in range [0, 1]. Default is `DefaultSummaryQuantiles`.
+	Quantiles []float64 `yaml:"quantiles"`
+
+	// Observations is the distribution of the observed values, e.g. latencies.
+	// Negative observations are recorded as zero.
+	Observations randval.DistConfig `yaml:"observations"`
+
+	// ObservationsPerSample is the average number of observations
+	// made between two samples. The actual number is random and at
+	// least one. Quantiles are calculated over the observations made
+	// since the previous sample.
+	ObservationsPerSample int `yaml:"observationsPerSample"`
+
+	// Seed is the random seed.
+	Seed int64 `yaml:"seed"`
+}
+
+// NewSummaryProvider creates new ValProvider which produces summaries.
+// At every sample the quantile values are ordered, i.e. p50 <= p90 <= p99,
+// and `_sum` and `_count` never decrease.
+func NewSummaryProvider(config SummaryProviderConfig) (ValProvider, error) {
+	if config.Name == "" {
+		return nil, errors.New("name must be set")
+	}
+
+	if config.TargetCount <= 0 {
+		return nil, errors.New("targetCount must be positive")
+	}
+
+	if config.ObservationsPerSample <= 0 {
+		return nil, errors.New("observationsPerSample must be positive")
+	}
+
+	if err := config.Observations.Validate(); err != nil {
+		return nil, errors.Wrap(err, "observations")
+	}
+
+	quantiles := config.Quantiles
+	if len(quantiles) == 0 {
+		quantiles = DefaultSummaryQuantiles
+	}
+	quantiles = append([]float64(nil), quantiles...)
+	sort.Float64s(quantiles)
+
+	for _, q := range quantiles {
+		if q < 0 || q > 1 {
+			return nil, errors.Errorf("quantile %v not in range [0, 1]", q)
+		}
+	}
+
+	var targets []*summaryTarget
+	for targetIndex := 0; targetIndex < config.TargetCount; targetIndex++ {
+		target := fmt.Sprintf("target_%d", targetIndex)
+
+		s := &summaryTarget{
+			sumLabels:   labels.FromStrings("__name__", config.Name+"_sum", "target", target),
+			countLabels: labels.FromStrings("__name__", config.Name+"_count", "target", target),
+			seed:        int64(randval.Uint64(config.Seed, int64(targetIndex))),
+		}
+
+		for _, q := range quantiles {
+			s.quantileLabels = append(s.quantileLabels, labels.FromStrings(
+				"__name__", config.Name,
+				"quantile", formatFloatLabel(q),
+				"target", target,
+			))
+		}
+
+		targets = append(targets, s)
+	}
+
+	return &summaryProvider{
+		config:    config,
+		quantiles: quantiles,
+		mean:      config.Observations.PositiveMean(),
+		targets:   targets,
+	}, nil
+}
+
+// summarySegmentSamples is the number of samples in one summary segment,
+// see `summaryProvider`.
+const summarySegmentSamples = 64
+
+// summaryTarget is one summary of one target.
+type summaryTarget struct {
+	quantileLabels []labels.Labels
+	sumLabels      labels.Labels
+	countLabels    labels.Labels
+
+	// seed is the random seed of the target.
+	seed int64
+
+	// segment is the index of the loaded segment. counts and sums are
+	// the cumulative numbers and raw sums of observations by every
+	// sample of the segment, scale is the factor of raw observations.
+	segment int64
+	counts  []int64
+	sums    []float64
+	scale   float64
+}
+
+// summaryProvider is implementation of `ValProvider` for summaries.
+//
+// The samples are split into segments of summarySegmentSamples samples
+// with ObservationsPerSample observations per sample on average. Every
+// sample gets one observation and the rest are spread over the samples of
+// the segment at random. The observations of every target and sample are
+// drawn from the random source reseeded for them, and scaled so that the
+// observations of the segment add up to their expected total. This way
+// `_count` and `_sum` at the start of every segment are known without
+// drawing the observations before it, so that seeking is cheap, and
+// `_sum` is the sum of the same observations the quantiles are from.
+type summaryProvider struct {
+	config    SummaryProviderConfig
+	quantiles []float64
+	targets   []*summaryTarget
+
+	// mean is the mean observation.
+	mean float64
+
+	// pos is the index of the next sample.
+	pos int64
+}
+
+// Next implements ValProvider interface.
+func (g *summaryProvider) Next() <-chan Val {
+	sample := g.pos
+	g.pos++
+
+	source := randval.NewSource(0)
+	random := rand.New(source)
+	segment, index := sample/summarySegmentSamples, sample%summarySegmentSamples
+
+	// The values are ready before the goroutine starts, it shares nothing.
+	var vals []Val
+	var observations []float64
+	for _, s := range g.targets {
+		g.load(s, segment, source, random)
+
+		count, sum := s.counts[index], s.sums[index]
+		n := int(count)
+		if index > 0 {
+			n -= int(s.counts[index-1])
+		}
+
+		observations = g.observe(s, sample, n, source, random, observations[:0])
+		for i := range observations {
+			observations[i] *= s.scale
+		}
+
+		// Quantiles from the sorted observations are ordered
+		// the same way as the quantiles themselves.
+		sort.Float64s(observations)
+		for i, q := range g.quantiles {
+			v := observations[int(math.Round(q*float64(n-1)))]
+			vals = append(vals, &valAdapter{v: v, l: s.quantileLabels[i]})
+		}
+
+		segmentCount := float64(segment * summarySegmentSamples * int64(g.config.ObservationsPerSample))
+		vals = append(vals,
+			&valAdapter{v: g.mean*segmentCount + s.scale*sum, l: s.sumLabels},
+			&valAdapter{v: segmentCount + float64(count), l: s.countLabels},
+		)
+	}
+
+	c := make(chan Val)
+	go func() {
+		defer close(c)
+
+		for _, v := range vals {
+			c <- v
+		}
+	}()
+
+	return c
+}
+
+// SeekSample implements SampleSeeker interface.
+func (g *summaryProvider) SeekSample(index int64) error {
+	if index < g.pos {
+		return errors.Errorf("cannot seek back from sample %d to %d", g.pos, index)
+	}
+
+	g.pos = index
+	return nil
+}
+
+// load spreads the observations of the segment over its samples and
+// calculates the scale of the target, unless it's already loaded.
+func (g *summaryProvider) load(s *summaryTarget, segment int64, source *randval.Source, random *rand.Rand) {
+	if s.counts != nil && s.segment == segment {
+		return
+	}
+
+	if s.counts == nil {
+		s.counts = make([]int64, summarySegmentSamples)
+		s.sums = make([]float64, summarySegmentSamples)
+	}
+
+	for i := range s.counts {
+		s.counts[i] = 1
+	}
+
+	// Negative indexes are not used by samples.
+	seed := int64(randval.Uint64(s.seed, -1-segment))
+	for i := 0; i < summarySegmentSamples*(g.config.ObservationsPerSample-1); i++ {
+		s.counts[randval.Uint64(seed, int64(i))%summarySegmentSamples]++
+	}
+
+	var count int64
+	var sum float64
+	var observations []float64
+	for i := range s.counts {
+		observations = g.observe(s, segment*summarySegmentSamples+int64(i), int(s.counts[i]), source, random, observations[:0])
+		for _, v := range observations {
+			sum += v
+		}
+
+		count += s.counts[i]
+		s.counts[i] = count
+		s.sums[i] = sum
+	}
+
+	s.segment = segment
+	s.scale = 0
+	if sum > 0 {
+		s.scale = g.mean * float64(count) / sum
+	}
+}
+
+// observe appends n raw observations of the target made by the sample.
+func (g *summaryProvider) observe(s *summaryTarget, sample int64, n int, source *randval.Source, random *rand.Rand, observations []float64) []float64 {
+	source.Seed(int64(randval.Uint64(s.seed, sample)))
+	for i := 0; i < n; i++ {
+		observations = append(observations, math.Max(g.config.Observations.Sample(random), 0))
+	}
+	return observations
+}
@@ -0,0 +1,91 @@
+package blockgen
+
+import (
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	"math"
+	"testing"
+)
+
+func Test_summaryProvider_Next(t *testing.T) {
+	config := SummaryProviderConfig{
+		Name:        "rpc_duration_seconds",
+		TargetCount: 3,
+		Observations: randval.DistConfig{
+			Type:   randval.LogNormal,
+			Mean:   -3,
+			StdDev: 1,
+		},
+		ObservationsPerSample: 10,
+		Seed:                  7,
+	}
+
+	p, err := NewSummaryProvider(config)
+	if err != nil {
+		t.Fatalf("NewSummaryProvider: %v", err)
+	}
+
+	last := map[string]float64{}
+	for i := 0; i < 50; i++ {
+		prevQuantile := -1.0
+		for v := range p.Next() {
+			l := v.Labels()
+			key := l.String()
+
+			switch l.Get("__name__") {
+			case "rpc_duration_seconds":
+				if v.Val() < prevQuantile {
+					t.Fatalf("sample %d: %s=%v less than lower quantile %v", i, key, v.Val(), prevQuantile)
+				}
+				prevQuantile = v.Val()
+			default:
+				if v.Val() < last[key] {
+					t.Fatalf("sample %d: %s went down from %v to %v", i, key, last[key], v.Val())
+				}
+				prevQuantile = -1
+			}
+			last[key] = v.Val()
+		}
+	}
+
+	// (3 quantiles + sum + count) x 3 targets
+	if len(last) != 15 {
+		t.Errorf("want 15 series, got %d", len(last))
+	}
+}
+
+func Test_summaryProvider_Sum(t *testing.T) {
+	// With one observation per sample, every quantile is the observation
+	// and `_sum` must grow by it.
+	p, err := NewSummaryProvider(SummaryProviderConfig{
+		Name:        "rpc_duration_seconds",
+		TargetCount: 1,
+		Observations: randval.DistConfig{
+			Type:   randval.LogNormal,
+			Mean:   -3,
+			StdDev: 1,
+		},
+		ObservationsPerSample: 1,
+		Seed:                  7,
+	})
+	if err != nil {
+		t.Fatalf("NewSummaryProvider: %v", err)
+	}
+
+	sum := 0.0
+	for i := 0; i < 200; i++ {
+		var observation, newSum float64
+		for v := range p.Next() {
+			switch v.Labels().Get("__name__") {
+			case "rpc_duration_seconds":
+				observation = v.Val()
+			case "rpc_duration_seconds_sum":
+				newSum = v.Val()
+			}
+		}
+
+		if d := newSum - sum - observation; math.Abs(d) > 1e-9 {
+			t.Fatalf("sample %d: sum grew by %v, observed %v", i, newSum-sum, observation)
+		}
+		sum = newSum
+	}
+}
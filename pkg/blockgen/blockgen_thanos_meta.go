@@ -0,0 +1,56 @@
+package blockgen
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"time"
+)
+
+const (
+	// metaFilename is the name of block meta file, same as in tsdb.
+	metaFilename = metadata.MetaFilename
+
+	// DefaultThanosSource is the Thanos source of the generated blocks.
+	DefaultThanosSource = "blockgen"
+)
+
+// ThanosBlockRanges are the block ranges produced by Thanos Compactor,
+// each range being one compaction level higher than the previous one.
+var ThanosBlockRanges = []time.Duration{
+	2 * time.Hour,
+	8 * time.Hour,
+	2 * 24 * time.Hour,
+	14 * 24 * time.Hour,
+}
+
+// CompactionLevel returns the compaction level Thanos Compactor would
+// give to the block of given range: 1 for raw 2h blocks, 2 for 8h, 3 for
+// 2d and 4 for 14d. Other ranges get the level of the largest of
+// `ThanosBlockRanges` not greater than the range.
+func CompactionLevel(blockRange time.Duration) int {
+	level := 1
+	for i, r := range ThanosBlockRanges {
+		if r <= blockRange {
+			level = i + 1
+		}
+	}
+
+	return level
+}
+
+// ReadThanosMeta reads meta.json from the block directory. The Thanos
+// section is empty if the block does not have it.
+func ReadThanosMeta(blockDir string) (*metadata.Meta, error) {
+	meta, err := metadata.Read(blockDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read meta")
+	}
+
+	return meta, nil
+}
+
+// WriteThanosMeta atomically replaces meta.json in the block directory.
+func WriteThanosMeta(blockDir string, meta *metadata.Meta) error {
+	return errors.Wrap(metadata.Write(log.NewNopLogger(), blockDir, meta), "write meta")
+}
@@ -0,0 +1,65 @@
+package blockgen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_blockWriter_ThanosMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, err := NewBlockWriterWithConfig(BlockWriterConfig{
+		Dir: dir,
+		ExternalLabels: map[string]string{
+			"cluster": "eu-1",
+			"replica": "a",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewBlockWriterWithConfig: %v", err)
+	}
+
+	generatorConfig := DefaultGeneratorConfig(4 * time.Minute)
+	generatorConfig.FlushInterval = 2 * time.Minute
+	valProvider := NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3})
+
+	if err := NewGeneratorWithConfig(generatorConfig).Generate(writer, valProvider); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	metaFiles, err := filepath.Glob(filepath.Join(dir, "*", metaFilename))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+
+	// Two full blocks and one with the very last sample.
+	if len(metaFiles) != 3 {
+		t.Fatalf("want 3 blocks, got %d", len(metaFiles))
+	}
+
+	for _, f := range metaFiles {
+		meta, err := ReadThanosMeta(filepath.Dir(f))
+		if err != nil {
+			t.Fatalf("ReadThanosMeta: %v", err)
+		}
+
+		if meta.Thanos.Source != DefaultThanosSource {
+			t.Errorf("%s: want source %s, got %s", f, DefaultThanosSource, meta.Thanos.Source)
+		}
+
+		if meta.Thanos.Labels["cluster"] != "eu-1" || meta.Thanos.Labels["replica"] != "a" {
+			t.Errorf("%s: wrong external labels %v", f, meta.Thanos.Labels)
+		}
+
+		if meta.Stats.NumSeries != 6 || meta.Version != 1 {
+			t.Errorf("%s: tsdb part of meta is broken: %+v", f, meta.BlockMeta)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package blockgen
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/objstore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// UploadWriterConfig configures the writer returned by `NewUploadWriter`.
+type UploadWriterConfig struct {
+	// Dir is the directory where the wrapped writer writes blocks.
+	Dir string
+
+	// DeleteLocal makes the writer delete the local copy of every block
+	// after verified upload. This keeps disk usage bounded.
+	DeleteLocal bool
+}
+
+// NewUploadWriter wraps the writer to upload all blocks in `config.Dir` to
+// the bucket after every `Flush`. See `UploadBlocks`. The uploads are
+// cancelled with the context, which should be the one of the generation.
+//
+// If the wrapped writer is the one created by `NewBlockWriter`,
+// `NewStreamingBlockWriter` or `NewDownsampleWriter`, only the blocks
+// written by this writer are uploaded, so that several writers can
+// write into the same directory, e.g. in `GenerateParallel`.
+func NewUploadWriter(ctx context.Context, logger log.Logger, writer Writer, bkt objstore.Bucket, config UploadWriterConfig) Writer {
+	return &uploadWriter{
+		ctx:      ctx,
+		logger:   logger,
+		writer:   writer,
+		bkt:      bkt,
+		config:   config,
+		uploaded: map[ulid.ULID]struct{}{},
+	}
+}
+
+// uploadWriter is implementation of Writer which uploads blocks.
+type uploadWriter struct {
+	ctx    context.Context
+	logger log.Logger
+	writer Writer
+	bkt    objstore.Bucket
+	config UploadWriterConfig
+
+	// uploaded are the blocks in the dir already uploaded by this writer,
+	// so that they are not checked in the bucket at every flush.
+	uploaded map[ulid.ULID]struct{}
+}
+
+// Write implements Writer interface.
+func (w *uploadWriter) Write(t time.Time, v Val) error {
+	return w.writer.Write(t, v)
+}
+
+// Flush implements Writer interface.
+func (w *uploadWriter) Flush() error {
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+
+	if f, ok := w.writer.(blocksFlusher); ok {
+		for _, id := range f.LastFlushedBlocks() {
+			if _, err := uploadBlock(w.ctx, w.logger, w.bkt, w.config.Dir, id, w.config.DeleteLocal); err != nil {
+				return errors.Wrap(err, "uploadBlock")
+			}
+		}
+		return nil
+	}
+
+	if f, ok := w.writer.(blockFlusher); ok {
+		id := f.LastFlushedBlock()
+		if id == (ulid.ULID{}) {
+			return nil
+		}
+
+		_, err := uploadBlock(w.ctx, w.logger, w.bkt, w.config.Dir, id, w.config.DeleteLocal)
+		return errors.Wrap(err, "uploadBlock")
+	}
+
+	ids, err := blockIDs(w.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, found := w.uploaded[id]; found {
+			continue
+		}
+
+		if _, err := uploadBlock(w.ctx, w.logger, w.bkt, w.config.Dir, id, w.config.DeleteLocal); err != nil {
+			return errors.Wrap(err, "uploadBlock")
+		}
+		w.uploaded[id] = struct{}{}
+	}
+
+	return nil
+}
+
+// SetBlockRange implements BlockRangeSetter interface.
+func (w *uploadWriter) SetBlockRange(mint, maxt time.Time) {
+	if s, ok := w.writer.(BlockRangeSetter); ok {
+		s.SetBlockRange(mint, maxt)
+	}
+}
+
+// Discard implements Discarder interface.
+func (w *uploadWriter) Discard() error {
+	if d, ok := w.writer.(Discarder); ok {
+		return d.Discard()
+	}
+
+	return nil
+}
+
+// blockFlusher is implemented by writers which know the block they flushed.
+type blockFlusher interface {
+	LastFlushedBlock() ulid.ULID
+}
+
+// blocksFlusher is implemented by writers which flush several blocks at once.
+type blocksFlusher interface {
+	LastFlushedBlocks() []ulid.ULID
+}
+
+// UploadBlocks uploads all blocks in the dir to the bucket, each into its
+// own top-level directory named after the block ULID, the same layout as
+// Thanos uses. Blocks already in the bucket are not uploaded again. The
+// meta.json is uploaded last so that partially uploaded blocks are not
+// seen by Thanos.
+//
+// If deleteLocal is true, the local copy of the block is deleted after all
+// its files are verified to be in the bucket, see `objstore.VerifyDir`.
+//
+// It returns the number of uploaded blocks.
+func UploadBlocks(ctx context.Context, logger log.Logger, bkt objstore.Bucket, dir string, deleteLocal bool) (int, error) {
+	ids, err := blockIDs(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	uploaded := 0
+	for _, id := range ids {
+		ok, err := uploadBlock(ctx, logger, bkt, dir, id, deleteLocal)
+		if err != nil {
+			return uploaded, err
+		}
+		if ok {
+			uploaded++
+		}
+	}
+
+	return uploaded, nil
+}
+
+// uploadBlock uploads one block unless it's already in the bucket, and
+// returns true if it did.
+func uploadBlock(ctx context.Context, logger log.Logger, bkt objstore.Bucket, dir string, id ulid.ULID, deleteLocal bool) (bool, error) {
+	blockDir := filepath.Join(dir, id.String())
+
+	exists, err := bkt.Exists(ctx, id.String()+objstore.DirDelim+metaFilename)
+	if err != nil {
+		return false, errors.Wrapf(err, "check block %s exists", id)
+	}
+
+	if !exists {
+		if err := objstore.UploadDir(ctx, bkt, blockDir, id.String(), metaFilename); err != nil {
+			return false, errors.Wrapf(err, "upload block %s", id)
+		}
+		level.Info(logger).Log("msg", "uploaded block", "block", id, "bucket", bkt.Name())
+	}
+
+	if !deleteLocal {
+		return !exists, nil
+	}
+
+	if err := objstore.VerifyDir(ctx, bkt, blockDir, id.String()); err != nil {
+		return !exists, errors.Wrapf(err, "verify block %s", id)
+	}
+
+	if err := os.RemoveAll(blockDir); err != nil {
+		return !exists, errors.Wrapf(err, "delete local block %s", id)
+	}
+	level.Debug(logger).Log("msg", "deleted local block", "block", id)
+
+	return !exists, nil
+}
+
+// blockIDs returns the IDs of complete blocks in the dir. Directories
+// which are not named as ULID, e.g. `*.tmp` ones, are skipped.
+func blockIDs(dir string) ([]ulid.ULID, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read dir %s", dir)
+	}
+
+	var res []ulid.ULID
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+
+		id, err := ulid.Parse(f.Name())
+		if err != nil {
+			continue
+		}
+
+		res = append(res, id)
+	}
+
+	return res, nil
+}
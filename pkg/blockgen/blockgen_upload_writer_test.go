@@ -0,0 +1,114 @@
+package blockgen
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/ppanyukov/thanos-data-gen/pkg/objstore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_uploadWriter_Flush(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "blocks")
+	bkt, err := objstore.NewFilesystemBucket(filepath.Join(tmp, "bucket"))
+	if err != nil {
+		t.Fatalf("NewFilesystemBucket: %v", err)
+	}
+
+	blockWriter, err := NewBlockWriter(dir)
+	if err != nil {
+		t.Fatalf("NewBlockWriter: %v", err)
+	}
+
+	writer := NewUploadWriter(context.Background(), log.NewNopLogger(), blockWriter, bkt, UploadWriterConfig{
+		Dir:         dir,
+		DeleteLocal: true,
+	})
+
+	generatorConfig := DefaultGeneratorConfig(4 * time.Minute)
+	generatorConfig.FlushInterval = 2 * time.Minute
+	valProvider := NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3})
+
+	if err := NewGeneratorWithConfig(generatorConfig).Generate(writer, valProvider); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	if ids, err := blockIDs(dir); err != nil || len(ids) != 0 {
+		t.Fatalf("want no local blocks, got %v, err: %v", ids, err)
+	}
+
+	blocks := 0
+	if err := bkt.Iter(context.Background(), "", func(name string) error {
+		exists, err := bkt.Exists(context.Background(), name+metaFilename)
+		if exists {
+			blocks++
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("Iter: %v", err)
+	}
+
+	if blocks != 3 {
+		t.Errorf("want 3 blocks in bucket, got %d", blocks)
+	}
+}
+
+// existsCountingBucket counts the calls of Exists, for tests.
+type existsCountingBucket struct {
+	objstore.Bucket
+	exists int
+}
+
+func (b *existsCountingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	b.exists++
+	return b.Bucket.Exists(ctx, name)
+}
+
+// plainWriter hides the optional interfaces of the writer, for tests.
+type plainWriter struct {
+	Writer
+}
+
+func Test_uploadWriter_Flush_Dir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "blocks")
+	fsBkt, err := objstore.NewFilesystemBucket(filepath.Join(tmp, "bucket"))
+	if err != nil {
+		t.Fatalf("NewFilesystemBucket: %v", err)
+	}
+	bkt := &existsCountingBucket{Bucket: fsBkt}
+
+	blockWriter, err := NewBlockWriter(dir)
+	if err != nil {
+		t.Fatalf("NewBlockWriter: %v", err)
+	}
+
+	writer := NewUploadWriter(context.Background(), log.NewNopLogger(), plainWriter{blockWriter}, bkt, UploadWriterConfig{Dir: dir})
+
+	generatorConfig := DefaultGeneratorConfig(4 * time.Minute)
+	generatorConfig.FlushInterval = 2 * time.Minute
+	valProvider := NewValProvider(ValProviderConfig{MetricCount: 2, TargetCount: 3})
+
+	if err := NewGeneratorWithConfig(generatorConfig).Generate(writer, valProvider); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	// Every block is checked once, not at every flush.
+	if bkt.exists != 3 {
+		t.Errorf("want 3 checks of 3 blocks, got %d", bkt.exists)
+	}
+}
@@ -2,8 +2,11 @@ package blockgen
 
 import (
 	"fmt"
+	"github.com/pkg/errors"
+	"github.com/ppanyukov/thanos-data-gen/pkg/randval"
+	"github.com/prometheus/prometheus/pkg/value"
 	"github.com/prometheus/prometheus/tsdb/labels"
-	"math/rand"
+	"math"
 )
 
 // ValProviderConfig configures the number of metrics per
@@ -11,10 +14,16 @@ import (
 // The number of metrics per interval will be (MetricCount x TargetCount).
 type ValProviderConfig struct {
 	// MetricCount is the number of metrics each target produces.
-	MetricCount int
+	MetricCount int `yaml:"metricCount"`
 
 	// TargetCount is the number of simulated collection targets.
-	TargetCount int
+	TargetCount int `yaml:"targetCount"`
+
+	// ValueModel optionally sets the range of the generated values.
+	// Each value is picked independently from [MinValue, MaxValue),
+	// so MaxChangeValue and ChangeRandSeed are not used here.
+	// When nil, the values are in range [0, 1000).
+	ValueModel *randval.Config `yaml:"valueModel"`
 }
 
 // NewValProvider creates new ValProvider with the supplied
@@ -26,24 +35,31 @@ func NewValProvider(config ValProviderConfig) ValProvider {
 	// seed rand with fixed value to get consistent repeatable results :)
 	return &valProvider{
 		config: config,
-		random: rand.New(rand.NewSource(454)),
+		seed:   454,
 	}
 }
 
 // valProvider is implementation of `ValProvider`.
 type valProvider struct {
 	config ValProviderConfig
-	random *rand.Rand
+
+	// seed is the random seed. Every value is derived from the seed,
+	// the series and the sample, so that seeking is cheap.
+	seed int64
+
+	// pos is the index of the next sample.
+	pos int64
 }
 
 // Next implements ValProvider interface.
 func (g *valProvider) Next() <-chan Val {
 	c := make(chan Val)
+	sample := g.pos
+	g.pos++
 
 	go func() {
 		defer close(c)
 
-		random := g.random
 		config := &g.config
 		counter := 0
 
@@ -62,7 +78,7 @@ func (g *valProvider) Next() <-chan Val {
 					},
 				}
 
-				value := float64(random.Intn(1000))
+				value := g.value(counter, sample)
 
 				c <- &valAdapter{v: value, l: ourLabels}
 				counter++
@@ -73,6 +89,27 @@ func (g *valProvider) Next() <-chan Val {
 	return c
 }
 
+// SeekSample implements SampleSeeker interface.
+func (g *valProvider) SeekSample(index int64) error {
+	if index < g.pos {
+		return errors.Errorf("cannot seek back from sample %d to %d", g.pos, index)
+	}
+
+	g.pos = index
+	return nil
+}
+
+// value returns the random value of the series with given index at the sample.
+func (g *valProvider) value(series int, sample int64) float64 {
+	seed := int64(randval.Uint64(g.seed, int64(series)))
+
+	if model := g.config.ValueModel; model != nil {
+		return model.MinValue + randval.Float64(seed, sample)*(model.MaxValue-model.MinValue)
+	}
+
+	return float64(randval.Uint64(seed, sample) % 1000)
+}
+
 // valAdapter is a small implementation of Val.
 // NOTE: it assumes the labels are already sorted!
 type valAdapter struct {
@@ -88,3 +125,8 @@ func (v *valAdapter) Labels() labels.Labels {
 	// simple cast, assume labels are sorted already
 	return labels.Labels(v.l)
 }
+
+// newStaleVal returns the staleness marker for the series.
+func newStaleVal(l labels.Labels) Val {
+	return &valAdapter{v: math.Float64frombits(value.StaleNaN), l: l}
+}
@@ -0,0 +1,417 @@
+package blockgen
+
+import (
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxProblemsPerCheck is the number of problems of the same check of one
+// block reported in full, the rest are only counted.
+const maxProblemsPerCheck = 10
+
+// VerifyConfig is what the blocks checked by `VerifyBlocks` must contain.
+type VerifyConfig struct {
+	// Retention and SampleInterval are the same as in `GeneratorConfig`.
+	Retention      time.Duration
+	SampleInterval time.Duration
+
+	// StartTime is the same as in `GeneratorConfig`. If zero, only the
+	// duration covered by blocks is checked, not the exact time range.
+	StartTime time.Time
+
+	// SeriesCount is the number of series every block must have, zero to
+	// skip the check, e.g. when series churn.
+	SeriesCount int
+
+	// Counters are the metric names which must not decrease. A counter
+	// may only reset, i.e. drop to a value not greater than its first one.
+	Counters []string
+
+	// TimestampTolerance is how far samples may be from the regular
+	// SampleInterval grid, e.g. the timestamp jitter of replicas.
+	TimestampTolerance time.Duration
+}
+
+// VerifyReport is the result of `VerifyBlocks`.
+type VerifyReport struct {
+	Blocks  int
+	Series  uint64
+	Samples uint64
+
+	// Problems are human-readable descriptions of everything which is not
+	// as expected, empty if the blocks are good.
+	Problems []string
+}
+
+// OK returns true if no problems were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// String returns the report as multi-line text.
+func (r *VerifyReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "verified %d blocks, %d series, %d samples: ", r.Blocks, r.Series, r.Samples)
+	if r.OK() {
+		b.WriteString("OK")
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "%d problems", len(r.Problems))
+	for _, p := range r.Problems {
+		b.WriteString("\n  - ")
+		b.WriteString(p)
+	}
+
+	return b.String()
+}
+
+// problemf adds the problem to the report.
+func (r *VerifyReport) problemf(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// VerifyBlocks checks the blocks in dir, as produced by the generator
+// with the given config. It checks that:
+//
+//   - the index of every block is readable, sorted and agrees with meta.json;
+//   - every block has `config.SeriesCount` series;
+//   - samples of every series are `config.SampleInterval` apart;
+//   - raw blocks cover the whole `config.Retention`;
+//   - blocks of the same resolution don't overlap;
+//   - counters don't decrease.
+//
+// Downsampled blocks are checked for the index, series count and overlaps
+// only. The error is returned only if the blocks cannot be read at all,
+// everything else is reported in `VerifyReport.Problems`.
+func VerifyBlocks(dir string, config VerifyConfig) (*VerifyReport, error) {
+	if config.SampleInterval <= 0 {
+		return nil, errors.New("sampleInterval must be positive duration")
+	}
+
+	ids, err := blockIDs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &verifier{
+		config:   config,
+		report:   &VerifyReport{},
+		counters: map[string]bool{},
+	}
+
+	for _, name := range config.Counters {
+		v.counters[name] = true
+	}
+
+	// Block metas by resolution.
+	metas := map[int64][]tsdb.BlockMeta{}
+	for _, id := range ids {
+		meta, err := v.verifyBlock(filepath.Join(dir, id.String()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "block %s", id)
+		}
+
+		metas[meta.Thanos.Downsample.Resolution] = append(metas[meta.Thanos.Downsample.Resolution], meta.BlockMeta)
+	}
+
+	if len(ids) == 0 {
+		v.report.problemf("no blocks in %s", dir)
+		return v.report, nil
+	}
+
+	for resolution, m := range metas {
+		sort.Slice(m, func(i, j int) bool {
+			return m[i].MinTime < m[j].MinTime
+		})
+
+		if overlaps := tsdb.OverlappingBlocks(m); len(overlaps) > 0 {
+			v.report.problemf("overlapping blocks of resolution %dms: %s", resolution, overlaps)
+		}
+	}
+
+	v.verifyCoverage(metas[0])
+
+	return v.report, nil
+}
+
+// verifier keeps the state of `VerifyBlocks`.
+type verifier struct {
+	config   VerifyConfig
+	report   *VerifyReport
+	counters map[string]bool
+}
+
+// blockProblems limits the number of reported problems of one block.
+type blockProblems struct {
+	report *VerifyReport
+	id     string
+	counts map[string]int
+}
+
+// add reports the problem of given check, unless reported enough already.
+func (p *blockProblems) add(check string, format string, args ...interface{}) {
+	p.counts[check]++
+	if p.counts[check] <= maxProblemsPerCheck {
+		p.report.problemf("block %s: %s: %s", p.id, check, fmt.Sprintf(format, args...))
+	}
+}
+
+// flush reports the number of problems not reported in full.
+func (p *blockProblems) flush() {
+	checks := make([]string, 0, len(p.counts))
+	for check := range p.counts {
+		checks = append(checks, check)
+	}
+	sort.Strings(checks)
+
+	for _, check := range checks {
+		if n := p.counts[check] - maxProblemsPerCheck; n > 0 {
+			p.report.problemf("block %s: %s: %d more problems", p.id, check, n)
+		}
+	}
+}
+
+// verifyBlock checks one block and returns its meta.
+func (v *verifier) verifyBlock(dir string) (*metadata.Meta, error) {
+	meta, err := ReadThanosMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := tsdb.OpenBlock(log.NewNopLogger(), dir, downsample.NewPool())
+	if err != nil {
+		return nil, errors.Wrap(err, "open block")
+	}
+	defer block.Close()
+
+	ir, err := block.Index()
+	if err != nil {
+		return nil, errors.Wrap(err, "open index")
+	}
+	defer ir.Close()
+
+	cr, err := block.Chunks()
+	if err != nil {
+		return nil, errors.Wrap(err, "open chunks")
+	}
+	defer cr.Close()
+
+	p, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "read postings")
+	}
+
+	problems := &blockProblems{report: v.report, id: meta.ULID.String(), counts: map[string]int{}}
+	defer problems.flush()
+
+	raw := meta.Thanos.Downsample.Resolution == 0
+
+	var (
+		stats   tsdb.BlockStats
+		lastRef uint64
+		last    labels.Labels
+	)
+	for p.Next() {
+		ref := p.At()
+		if stats.NumSeries > 0 && ref <= lastRef {
+			problems.add("index", "postings not sorted, %d after %d", ref, lastRef)
+		}
+		lastRef = ref
+
+		var lset labels.Labels
+		var chks []chunks.Meta
+		if err := ir.Series(ref, &lset, &chks); err != nil {
+			problems.add("index", "read series %d: %v", ref, err)
+			continue
+		}
+		stats.NumSeries++
+
+		verifyLabels(problems, lset)
+		if last != nil && labels.Compare(last, lset) >= 0 {
+			problems.add("index", "series %s not after %s", lset, last)
+		}
+		last = lset
+
+		samples := &seriesSamples{}
+		for i, c := range chks {
+			if c.MinTime > c.MaxTime || c.MinTime < meta.MinTime || c.MaxTime >= meta.MaxTime {
+				problems.add("index", "series %s: chunk [%d, %d] outside of block", lset, c.MinTime, c.MaxTime)
+			}
+
+			if i > 0 && c.MinTime <= chks[i-1].MaxTime {
+				problems.add("index", "series %s: chunks [%d, %d] and [%d, %d] overlap or not sorted",
+					lset, chks[i-1].MinTime, chks[i-1].MaxTime, c.MinTime, c.MaxTime)
+			}
+
+			chk, err := cr.Chunk(c.Ref)
+			if err != nil {
+				problems.add("index", "series %s: read chunk: %v", lset, err)
+				continue
+			}
+			stats.NumChunks++
+			stats.NumSamples += uint64(chk.NumSamples())
+
+			if !raw {
+				continue
+			}
+
+			it := chk.Iterator(nil)
+			for it.Next() {
+				samples.add(it.At())
+			}
+			if err := it.Err(); err != nil {
+				problems.add("index", "series %s: iterate chunk: %v", lset, err)
+			}
+		}
+
+		if raw {
+			v.verifySamples(problems, lset, samples)
+		}
+	}
+	if err := p.Err(); err != nil {
+		problems.add("index", "iterate postings: %v", err)
+	}
+
+	if stats.NumSeries != meta.Stats.NumSeries || stats.NumChunks != meta.Stats.NumChunks || stats.NumSamples != meta.Stats.NumSamples {
+		problems.add("index", "%d series, %d chunks and %d samples in index but %d, %d and %d in meta.json",
+			stats.NumSeries, stats.NumChunks, stats.NumSamples,
+			meta.Stats.NumSeries, meta.Stats.NumChunks, meta.Stats.NumSamples)
+	}
+
+	if n := v.config.SeriesCount; n > 0 && stats.NumSeries != uint64(n) {
+		problems.add("series count", "want %d series, got %d", n, stats.NumSeries)
+	}
+
+	v.report.Blocks++
+	v.report.Series += stats.NumSeries
+	v.report.Samples += stats.NumSamples
+
+	return meta, nil
+}
+
+// verifyLabels checks that the labels are valid, as required by tsdb.
+func verifyLabels(problems *blockProblems, lset labels.Labels) {
+	if len(lset) == 0 {
+		problems.add("index", "series without labels")
+		return
+	}
+
+	for i, l := range lset {
+		if l.Name == "" || l.Value == "" {
+			problems.add("index", "series %s: empty label name or value", lset)
+		}
+
+		if i > 0 && l.Name <= lset[i-1].Name {
+			problems.add("index", "series %s: labels not sorted or duplicate", lset)
+		}
+	}
+}
+
+// seriesSamples are the samples of one series in one block.
+type seriesSamples struct {
+	times  []int64
+	values []float64
+}
+
+// add adds the sample.
+func (s *seriesSamples) add(t int64, v float64) {
+	s.times = append(s.times, t)
+	s.values = append(s.values, v)
+}
+
+// verifySamples checks the sample interval and counter monotonicity.
+func (v *verifier) verifySamples(problems *blockProblems, lset labels.Labels, s *seriesSamples) {
+	interval := int64(v.config.SampleInterval / time.Millisecond)
+	tolerance := int64(v.config.TimestampTolerance / time.Millisecond)
+
+	for i := 1; i < len(s.times); i++ {
+		if d := s.times[i] - s.times[i-1]; d < interval-tolerance || d > interval+tolerance {
+			problems.add("sample interval", "series %s: samples at %d and %d are %dms apart, want %s",
+				lset, s.times[i-1], s.times[i], d, v.config.SampleInterval)
+			break
+		}
+	}
+
+	if !v.counters[lset.Get("__name__")] {
+		return
+	}
+
+	first, prev := math.NaN(), math.NaN()
+	for i, val := range s.values {
+		if value.IsStaleNaN(val) {
+			continue
+		}
+
+		if math.IsNaN(first) {
+			first = val
+		}
+
+		if val < prev && val > first {
+			problems.add("counter", "series %s: decreased from %v to %v at %d", lset, prev, val, s.times[i])
+			break
+		}
+		prev = val
+	}
+}
+
+// verifyCoverage checks that the raw blocks, sorted by time, cover the
+// retention without gaps.
+func (v *verifier) verifyCoverage(metas []tsdb.BlockMeta) {
+	c := &v.config
+	if len(metas) == 0 {
+		v.report.problemf("no raw blocks")
+		return
+	}
+
+	interval := int64(c.SampleInterval / time.Millisecond)
+	tolerance := int64(c.TimestampTolerance / time.Millisecond)
+
+	mint := metas[0].MinTime
+	maxt := metas[0].MaxTime
+	for i := 1; i < len(metas); i++ {
+		// The time range of missing samples, if any. Unaligned blocks end
+		// right after their last sample so the next one starts at most
+		// one sample interval later.
+		if missing := metas[i].MinTime - (metas[i-1].MaxTime - 1) - interval; missing > 2*tolerance {
+			v.report.problemf("%s of samples missing between blocks %s and %s",
+				time.Duration(missing)*time.Millisecond, metas[i-1].ULID, metas[i].ULID)
+		}
+
+		if metas[i].MaxTime > maxt {
+			maxt = metas[i].MaxTime
+		}
+	}
+
+	// The block range is half-open, the last sample is at maxt-1.
+	covered := time.Duration(maxt-1-mint) * time.Millisecond
+	if covered < c.Retention-2*c.TimestampTolerance {
+		v.report.problemf("blocks cover %s, want retention %s", covered, c.Retention)
+	}
+
+	if c.StartTime.IsZero() {
+		return
+	}
+
+	wantMint := timestamp.FromTime(c.StartTime.Add(-1 * c.Retention))
+	wantMaxt := timestamp.FromTime(c.StartTime)
+	if mint > wantMint+tolerance || maxt-1 < wantMaxt-tolerance {
+		v.report.problemf("blocks cover [%s, %s], want [%s, %s]",
+			timestamp.Time(mint).UTC().Format(time.RFC3339), timestamp.Time(maxt-1).UTC().Format(time.RFC3339),
+			timestamp.Time(wantMint).UTC().Format(time.RFC3339), timestamp.Time(wantMaxt).UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,193 @@
+package blockgen
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// generateVerifyBlocks generates 10h of raw and 5m blocks into dir.
+func generateVerifyBlocks(dir string, config GeneratorConfig) error {
+	writer, err := NewBlockWriter(dir)
+	if err != nil {
+		return err
+	}
+
+	writer, err = NewDownsampleWriter(writer, BlockWriterConfig{Dir: dir}, DownsampleConfig{
+		Resolutions: []time.Duration{ResLevel1},
+	})
+	if err != nil {
+		return err
+	}
+
+	valProvider, err := NewRandValProvider(RandValProviderConfig{
+		Metrics: []MetricConfig{
+			{Name: "foo_total", Type: Counter},
+			{Name: "bar", Type: Gauge},
+		},
+		TargetCount: 3,
+		Seed:        1,
+	})
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(NewGeneratorWithConfig(config).Generate(writer, valProvider), "Generate")
+}
+
+func TestVerifyBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	genConfig := DefaultGeneratorConfig(10 * time.Hour)
+	genConfig.StartTime = time.Date(2019, time.September, 30, 0, 0, 0, 0, time.UTC)
+	if err := generateVerifyBlocks(dir, genConfig); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	config := VerifyConfig{
+		Retention:      genConfig.Retention,
+		SampleInterval: genConfig.SampleInterval,
+		StartTime:      genConfig.StartTime,
+		SeriesCount:    6,
+		Counters:       []string{"foo_total"},
+	}
+
+	report, err := VerifyBlocks(dir, config)
+	if err != nil {
+		t.Fatalf("VerifyBlocks: %v", err)
+	}
+
+	if !report.OK() {
+		t.Fatalf("want no problems, got %s", report)
+	}
+
+	// 5 blocks plus the last sample, raw and 5m.
+	if report.Blocks != 12 {
+		t.Errorf("want 12 blocks, got %d", report.Blocks)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *VerifyConfig)
+		want   string
+	}{
+		{
+			name:   "series count",
+			modify: func(c *VerifyConfig) { c.SeriesCount = 7 },
+			want:   "want 7 series, got 6",
+		},
+		{
+			name:   "sample interval",
+			modify: func(c *VerifyConfig) { c.SampleInterval = 30 * time.Second },
+			want:   "sample interval",
+		},
+		{
+			name:   "retention",
+			modify: func(c *VerifyConfig) { c.Retention = 12 * time.Hour },
+			want:   "want retention 12h0m0s",
+		},
+		{
+			name:   "start time",
+			modify: func(c *VerifyConfig) { c.StartTime = c.StartTime.Add(time.Hour) },
+			want:   "blocks cover [2019-09-29T14:00:00Z, 2019-09-30T00:00:00Z]",
+		},
+		{
+			name:   "counter",
+			modify: func(c *VerifyConfig) { c.Counters = []string{"bar"} },
+			want:   "decreased",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := config
+			tt.modify(&c)
+
+			report, err := VerifyBlocks(dir, c)
+			if err != nil {
+				t.Fatalf("VerifyBlocks: %v", err)
+			}
+
+			if report.OK() || !strings.Contains(report.String(), tt.want) {
+				t.Errorf("want problem '%s', got %s", tt.want, report)
+			}
+		})
+	}
+}
+
+func TestVerifyBlocks_Blocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thanos-data-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	genConfig := DefaultGeneratorConfig(4 * time.Hour)
+	genConfig.StartTime = time.Date(2019, time.September, 30, 0, 0, 0, 0, time.UTC)
+	config := VerifyConfig{
+		Retention:      genConfig.Retention,
+		SampleInterval: genConfig.SampleInterval,
+	}
+
+	// Same data twice, so all blocks overlap.
+	for i := 0; i < 2; i++ {
+		if err := generateVerifyBlocks(dir, genConfig); err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+	}
+
+	report, err := VerifyBlocks(dir, config)
+	if err != nil {
+		t.Fatalf("VerifyBlocks: %v", err)
+	}
+
+	if !strings.Contains(report.String(), "overlapping blocks of resolution 0ms") ||
+		!strings.Contains(report.String(), "overlapping blocks of resolution 300000ms") {
+		t.Errorf("want overlapping blocks, got %s", report)
+	}
+
+	// Drop the middle raw block, leaving a gap.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("remove dir: %v", err)
+	}
+
+	if err := generateVerifyBlocks(dir, genConfig); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	ids, err := blockIDs(dir)
+	if err != nil {
+		t.Fatalf("blockIDs: %v", err)
+	}
+
+	for _, id := range ids {
+		meta, err := ReadThanosMeta(filepath.Join(dir, id.String()))
+		if err != nil {
+			t.Fatalf("ReadThanosMeta: %v", err)
+		}
+
+		if meta.Thanos.Downsample.Resolution == 0 && meta.MinTime == timestamp.FromTime(genConfig.StartTime.Add(-2*time.Hour)) {
+			if err := os.RemoveAll(filepath.Join(dir, id.String())); err != nil {
+				t.Fatalf("remove block: %v", err)
+			}
+		}
+	}
+
+	report, err = VerifyBlocks(dir, config)
+	if err != nil {
+		t.Fatalf("VerifyBlocks: %v", err)
+	}
+
+	if !strings.Contains(report.String(), "2h0m0s of samples missing between blocks") {
+		t.Errorf("want missing samples, got %s", report)
+	}
+}
@@ -4,15 +4,51 @@ import (
 	"context"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/pkg/value"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 )
 
-// NewBlockWriter create new TSDB block writer.
+// BlockWriterConfig configures the writer returned by `NewBlockWriterWithConfig`.
+type BlockWriterConfig struct {
+	// Dir is the output directory.
+	Dir string `yaml:"-"`
+
+	// ExternalLabels are written into the Thanos section of meta.json
+	// of every block, e.g. cluster and replica.
+	ExternalLabels map[string]string `yaml:"externalLabels"`
+
+	// Source is written into the Thanos section of meta.json of every
+	// block. Default is `DefaultThanosSource`.
+	Source string `yaml:"source"`
+
+	// Metrics are updated by the writer if set, see `NewBlockWriterMetrics`.
+	Metrics *BlockWriterMetrics `yaml:"-"`
+
+	// InvalidSamples is what to do with out of order and duplicate
+	// samples. Default is `FailInvalidSamples`.
+	InvalidSamples InvalidSamplePolicy `yaml:"invalidSamples"`
+}
+
+// NewBlockWriter create new TSDB block writer with default config.
+// See `NewBlockWriterWithConfig`.
+func NewBlockWriter(dir string) (Writer, error) {
+	return NewBlockWriterWithConfig(BlockWriterConfig{
+		Dir: dir,
+	})
+}
+
+// NewBlockWriterWithConfig create new TSDB block writer.
 //
 // The returned writer is generally not assumed to be thread-safe at the moment.
 //
@@ -36,14 +72,48 @@ import (
 // Note that the writer will not check if the target directory exists or
 // contains anything at all. It is the caller's responsibility to
 // ensure that the resulting blocks do not overlap etc.
-func NewBlockWriter(dir string) (Writer, error) {
+//
+// The meta.json of every block has the Thanos section so that the blocks
+// can be used by Thanos Store and Compactor as they are.
+func NewBlockWriterWithConfig(config BlockWriterConfig) (Writer, error) {
 	logger := log.NewLogfmtLogger(os.Stderr)
 
+	if config.Source == "" {
+		config.Source = DefaultThanosSource
+	}
+
+	checker, err := newSampleChecker(logger, config.InvalidSamples, config.Metrics)
+	if err != nil {
+		return nil, err
+	}
+
 	res := &blockWriter{
-		logger: logger,
-		dir:    dir,
+		logger:  logger,
+		dir:     config.Dir,
+		config:  config,
+		metrics: config.Metrics,
+		checker: checker,
+	}
+
+	// Registerer must be nil interface rather than nil pointer when there are no metrics.
+	var reg prometheus.Registerer
+	if res.metrics != nil {
+		reg = res.metrics.writerRegisterer()
+		res.headReg = &replacingRegisterer{reg: reg}
 	}
 
+	// TODO(ppanyukov): what exactly is "ranges" arg here?
+	compactor, err := tsdb.NewLeveledCompactor(
+		context.Background(),
+		reg,
+		logger,
+		tsdb.DefaultOptions.BlockRanges,
+		chunkenc.NewPool())
+	if err != nil {
+		return nil, errors.Wrap(err, "create leveled compactor")
+	}
+	res.compactor = compactor
+
 	if err := res.initHeadAndAppender(); err != nil {
 		return nil, err
 	}
@@ -59,26 +129,124 @@ type blockWriter struct {
 	// dir is output directory, given to us as arg.
 	dir string
 
+	// config is given to us as arg.
+	config BlockWriterConfig
+
 	// prometheus specific things, created and managed by us.
-	head     *tsdb.Head
-	appender tsdb.Appender
+	head      *tsdb.Head
+	appender  tsdb.Appender
+	compactor *tsdb.LeveledCompactor
+
+	// metrics are nil if not configured, headReg is nil then too.
+	metrics *BlockWriterMetrics
+	headReg *replacingRegisterer
+
+	// headSeries is the number of head series last added to metrics.
+	headSeries int64
+
+	// checker finds invalid samples using the latest sample of every
+	// series, by labels hash. The head appender can't as nothing is
+	// committed until Flush.
+	checker *sampleChecker
+	latest  map[uint64][]*latestSample
 
 	// metricCount is incremented internally every time Write is called.
 	metricCount int64
+
+	// liveSeriesCount is the number of series written with the
+	// timestamp lastTime. With series churn this is less than the
+	// number of series in the head.
+	lastTime        int64
+	liveSeriesCount int64
+
+	// lastBlock is the ID of the block written by the last Flush.
+	lastBlock ulid.ULID
+
+	// staging is the directory where the compactor writes the block of
+	// the current Flush before it's moved into dir, empty between flushes.
+	// Other writers may write into the same dir, so this is the only
+	// directory Discard removes.
+	staging string
+
+	// blockMint and blockMaxt are the range of the next block as set by
+	// SetBlockRange, zero if not set.
+	blockMint int64
+	blockMaxt int64
+}
+
+// SetBlockRange implements BlockRangeSetter interface.
+func (w *blockWriter) SetBlockRange(mint, maxt time.Time) {
+	w.blockMint = timestamp.FromTime(mint)
+	w.blockMaxt = timestamp.FromTime(maxt)
 }
 
 // Write implements Writer interface. Everything goes into memory until Flush.
 func (w *blockWriter) Write(t time.Time, v Val) error {
 	// Simply write to appender until Flush() is called.
+	ts := timestamp.FromTime(t)
+	if ok, err := w.checkSample(v.Labels(), ts, v.Val()); !ok {
+		return err
+	}
+
 	w.metricCount++
 
-	if _, err := w.appender.Add(v.Labels(), timestamp.FromTime(t), v.Val()); err != nil {
+	if ts != w.lastTime {
+		w.lastTime = ts
+		w.liveSeriesCount = 0
+		w.updateHeadSeries()
+	}
+	if !value.IsStaleNaN(v.Val()) {
+		w.liveSeriesCount++
+	}
+
+	if _, err := w.appender.Add(v.Labels(), ts, v.Val()); err != nil {
 		return errors.Wrap(err, "appender.Add")
 	}
 
+	if w.metrics != nil {
+		w.metrics.samplesAppended.Inc()
+	}
+
 	return nil
 }
 
+// latestSample is the latest sample written of the series.
+type latestSample struct {
+	labels labels.Labels
+	t      int64
+	v      float64
+}
+
+// checkSample returns true if the sample is to be appended, see `sampleChecker`.
+func (w *blockWriter) checkSample(l labels.Labels, t int64, v float64) (bool, error) {
+	hash := l.Hash()
+	for _, s := range w.latest[hash] {
+		if !s.labels.Equals(l) {
+			continue
+		}
+
+		ok, err := w.checker.check(l, s.t, s.v, t, v)
+		if ok {
+			s.t, s.v = t, v
+		}
+		return ok, err
+	}
+
+	w.latest[hash] = append(w.latest[hash], &latestSample{labels: l, t: t, v: v})
+	return true, nil
+}
+
+// updateHeadSeries adds the change of the number of head series to metrics.
+func (w *blockWriter) updateHeadSeries() {
+	if w.metrics == nil {
+		return
+	}
+
+	n := int64(w.head.NumSeries())
+	w.metrics.headSeries.Add(float64(n - w.headSeries))
+	w.headSeries = n
+}
+
 // Flush implements Writer interface. This is where actual block writing
 // happens. After flush completes, more writes can continue.
 func (w *blockWriter) Flush() error {
@@ -86,13 +254,20 @@ func (w *blockWriter) Flush() error {
 	//  - write head to disk
 	//  - close head
 	//  - open new head and appender
+	w.updateHeadSeries()
+
+	start := time.Now()
 	if err := w.writeHeadToDisk(); err != nil {
 		return errors.Wrap(err, "writeHeadToDisk")
 	}
+	if w.metrics != nil {
+		w.metrics.flushDuration.Observe(time.Since(start).Seconds())
+	}
 
-	if err := w.head.Close(); err != nil {
-		return errors.Wrap(err, "close head")
+	if err := w.closeHead(); err != nil {
+		return err
 	}
+	w.checker.flush()
 
 	if err := w.initHeadAndAppender(); err != nil {
 		return errors.Wrap(err, "initHeadAndAppender")
@@ -101,6 +276,52 @@ func (w *blockWriter) Flush() error {
 	return nil
 }
 
+// Discard implements Discarder interface. It drops the head and removes
+// the partially written block of the failed Flush, if any.
+func (w *blockWriter) Discard() error {
+	if err := w.appender.Rollback(); err != nil {
+		return errors.Wrap(err, "appender.Rollback")
+	}
+
+	if err := w.closeHead(); err != nil {
+		return err
+	}
+
+	if w.staging != "" {
+		level.Info(w.logger).Log("msg", "removing partially written block", "dir", w.staging)
+		if err := os.RemoveAll(w.staging); err != nil {
+			return errors.Wrapf(err, "remove %s", w.staging)
+		}
+		w.staging = ""
+	}
+
+	w.liveSeriesCount = 0
+	w.blockMint, w.blockMaxt = 0, 0
+	w.checker.reset()
+	return errors.Wrap(w.initHeadAndAppender(), "initHeadAndAppender")
+}
+
+// closeHead closes the head and unregisters its metrics.
+func (w *blockWriter) closeHead() error {
+	if err := w.head.Close(); err != nil {
+		return errors.Wrap(err, "close head")
+	}
+
+	if w.metrics != nil {
+		w.headReg.unregisterAll()
+		w.metrics.headSeries.Sub(float64(w.headSeries))
+		w.headSeries = 0
+	}
+
+	return nil
+}
+
+// LastFlushedBlock returns the ID of the block written by the last Flush,
+// zero if there was nothing to write.
+func (w *blockWriter) LastFlushedBlock() ulid.ULID {
+	return w.lastBlock
+}
+
 // initHeadAndAppender creates and initialises new head and appender.
 func (w *blockWriter) initHeadAndAppender() error {
 	logger := w.logger
@@ -111,12 +332,14 @@ func (w *blockWriter) initHeadAndAppender() error {
 		// setting to 1 seems to be the right thing as want all events.
 		var chunkRange int64 = 1
 
-		// Registerer and WAL can be nil as we don't use them.
-		// Not declaring to avoid dependency on github.com/prometheus/client_golang
-		// var r prometheus.Registerer = nil
-		// var w *wal.WAL = nil
+		// Registerer can be nil if there are no metrics. WAL can be nil
+		// as we don't use it.
+		var reg prometheus.Registerer
+		if w.headReg != nil {
+			reg = w.headReg
+		}
 
-		h, err := tsdb.NewHead(nil /*Registerer*/, logger, nil /*WAL*/, chunkRange)
+		h, err := tsdb.NewHead(reg, logger, nil /*WAL*/, chunkRange)
 		if err != nil {
 			return errors.Wrap(err, "tsdb.NewHead")
 		}
@@ -126,6 +349,7 @@ func (w *blockWriter) initHeadAndAppender() error {
 
 	w.head = head
 	w.appender = head.Appender()
+	w.latest = map[uint64][]*latestSample{}
 	return nil
 }
 
@@ -135,11 +359,13 @@ func (w *blockWriter) writeHeadToDisk() error {
 		return errors.Wrap(err, "appender.Commit")
 	}
 
+	// seriesCount is the number of unique series in the block.
 	seriesCount := w.head.NumSeries()
 	mint := timestamp.Time(w.head.MinTime())
 	maxt := timestamp.Time(w.head.MaxTime())
 	level.Info(w.logger).Log(
 		"series_count", seriesCount,
+		"live_series_count", w.liveSeriesCount,
 		"metric_count", w.metricCount,
 		"mint", mint,
 		"maxt", maxt)
@@ -153,20 +379,99 @@ func (w *blockWriter) writeHeadToDisk() error {
 	// Because of this block intervals are always +1 than the total samples it includes.
 	{
 		int_mint := timestamp.FromTime(mint)
-		int_maxt := timestamp.FromTime(maxt)
-
-		// TODO(ppanyukov): what exactly is "ranges" arg here?
-		compactor, err := tsdb.NewLeveledCompactor(
-			context.Background(),
-			nil,
-			w.logger,
-			tsdb.DefaultOptions.BlockRanges,
-			chunkenc.NewPool())
+		int_maxt := timestamp.FromTime(maxt) + 1
+
+		// Use the range set by SetBlockRange if any, the head is empty
+		// when mint > maxt.
+		if w.blockMaxt != 0 {
+			if int_mint < int_maxt && (int_mint < w.blockMint || int_maxt > w.blockMaxt) {
+				return errors.Errorf("samples in [%d, %d) are outside of block range [%d, %d)",
+					int_mint, int_maxt, w.blockMint, w.blockMaxt)
+			}
+
+			int_mint, int_maxt = w.blockMint, w.blockMaxt
+			w.blockMint, w.blockMaxt = 0, 0
+		}
+
+		// The compactor leaves its `*.tmp` directory behind if it fails
+		// half way, so write into our own directory to know what to remove.
+		if err := os.MkdirAll(w.dir, os.ModePerm); err != nil {
+			return errors.Wrap(err, "create dir")
+		}
+		staging, err := ioutil.TempDir(w.dir, "blockgen-*.tmp")
 		if err != nil {
-			return errors.Wrap(err, "create leveled compactor")
+			return errors.Wrap(err, "create staging dir")
 		}
+		w.staging = staging
 
-		_, err = compactor.Write(w.dir, w.head, int_mint, int_maxt+1, nil)
-		return errors.Wrap(err, "writing WAL")
+		id, err := w.compactor.Write(staging, w.head, int_mint, int_maxt, nil)
+		if err != nil {
+			if w.metrics != nil {
+				w.metrics.compactionErrors.Inc()
+			}
+			return errors.Wrap(err, "writing WAL")
+		}
+		w.lastBlock = id
+
+		// No block is written when there are no samples.
+		if id != (ulid.ULID{}) {
+			blockDir := filepath.Join(staging, id.String())
+			if err := w.writeThanosMeta(blockDir); err != nil {
+				return errors.Wrap(err, "writeThanosMeta")
+			}
+
+			if err := os.Rename(blockDir, filepath.Join(w.dir, id.String())); err != nil {
+				return errors.Wrap(err, "move block from staging dir")
+			}
+		}
+
+		if err := os.RemoveAll(staging); err != nil {
+			return errors.Wrap(err, "remove staging dir")
+		}
+		w.staging = ""
+
+		if id == (ulid.ULID{}) {
+			return nil
+		}
+
+		return w.observeBlockSize(id)
+	}
+}
+
+// observeBlockSize adds the size of the block on disk to metrics.
+func (w *blockWriter) observeBlockSize(id ulid.ULID) error {
+	if w.metrics == nil {
+		return nil
 	}
+
+	size, err := dirSize(filepath.Join(w.dir, id.String()))
+	if err != nil {
+		return errors.Wrap(err, "block size")
+	}
+
+	w.metrics.blockSize.Observe(float64(size))
+	return nil
+}
+
+// writeThanosMeta adds Thanos section to meta.json of the block.
+func (w *blockWriter) writeThanosMeta(blockDir string) error {
+	meta, err := ReadThanosMeta(blockDir)
+	if err != nil {
+		return err
+	}
+
+	labels := w.config.ExternalLabels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	// Blocks larger than 2h would have been compacted.
+	meta.Compaction.Level = CompactionLevel(time.Duration(meta.MaxTime-meta.MinTime) * time.Millisecond)
+
+	meta.Thanos = metadata.Thanos{
+		Labels: labels,
+		Source: metadata.SourceType(w.config.Source),
+	}
+
+	return WriteThanosMeta(blockDir, meta)
 }
@@ -0,0 +1,77 @@
+package objstore
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore/client"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+)
+
+// ObjProvider is the type of object storage.
+type ObjProvider string
+
+const (
+	// FILESYSTEM is the local filesystem bucket, see `NewFilesystemBucket`.
+	FILESYSTEM ObjProvider = "FILESYSTEM"
+)
+
+// BucketConfig is the bucket config in the same format as Thanos uses
+// for `--objstore.config-file`, e.g.:
+//
+//	type: FILESYSTEM
+//	config:
+//	  directory: /tmp/bucket
+//
+// or:
+//
+//	type: GCS
+//	config:
+//	  bucket: thanos-data
+type BucketConfig struct {
+	Type   ObjProvider `yaml:"type"`
+	Config interface{} `yaml:"config"`
+}
+
+// NewBucketFromFile creates bucket using the YAML config from the file.
+func NewBucketFromFile(logger log.Logger, file string) (Bucket, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read bucket config file %s", file)
+	}
+
+	bkt, err := NewBucket(logger, b)
+	return bkt, errors.Wrapf(err, "bucket config file %s", file)
+}
+
+// NewBucket creates bucket using the YAML config. FILESYSTEM bucket is
+// for offline use, all the other types, e.g. GCS, S3 or AZURE, are created
+// by Thanos, see `client.NewBucket`.
+func NewBucket(logger log.Logger, confContentYaml []byte) (Bucket, error) {
+	bucketConf := &BucketConfig{}
+	if err := yaml.UnmarshalStrict(confContentYaml, bucketConf); err != nil {
+		return nil, errors.Wrap(err, "parsing config YAML file")
+	}
+
+	// Re-marshal the provider specific part to parse it strictly.
+	config, err := yaml.Marshal(bucketConf.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal content of bucket configuration")
+	}
+
+	switch strings.ToUpper(string(bucketConf.Type)) {
+	case string(FILESYSTEM):
+		var fsConfig FilesystemConfig
+		if err := yaml.UnmarshalStrict(config, &fsConfig); err != nil {
+			return nil, errors.Wrap(err, "parsing filesystem config")
+		}
+		return NewFilesystemBucket(fsConfig.Directory)
+	default:
+		bkt, err := client.NewBucket(logger, confContentYaml, nil, "blockgen")
+		if err != nil {
+			return nil, err
+		}
+		return bkt, nil
+	}
+}
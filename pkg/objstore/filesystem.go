@@ -0,0 +1,170 @@
+package objstore
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FilesystemConfig is the config of filesystem bucket.
+type FilesystemConfig struct {
+	Directory string `yaml:"directory"`
+}
+
+// NewFilesystemBucket returns a new filesystem bucket which stores the
+// objects as files in the given directory. Good for offline use and tests.
+func NewFilesystemBucket(rootDir string) (Bucket, error) {
+	if rootDir == "" {
+		return nil, errors.New("directory must be set")
+	}
+
+	absDir, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filesystemBucket{rootDir: absDir}, nil
+}
+
+// filesystemBucket implements the Bucket interface on top of local filesystem.
+type filesystemBucket struct {
+	rootDir string
+}
+
+// path returns the file path of the object.
+func (b *filesystemBucket) path(name string) string {
+	return filepath.Join(b.rootDir, filepath.FromSlash(name))
+}
+
+// Upload implements Bucket interface.
+func (b *filesystemBucket) Upload(_ context.Context, name string, r io.Reader) error {
+	file := b.path(name)
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Write into temp file first so that readers never see partial object.
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrapf(err, "copy to %s", tmp)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// Delete implements Bucket interface. Empty parent directories are removed.
+func (b *filesystemBucket) Delete(_ context.Context, name string) error {
+	file := b.path(name)
+	for file != b.rootDir {
+		if err := os.RemoveAll(file); err != nil {
+			return errors.Wrapf(err, "rm %s", file)
+		}
+
+		file = filepath.Dir(file)
+		empty, err := isDirEmpty(file)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Iter implements Bucket interface.
+func (b *filesystemBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	absDir := b.path(dir)
+	info, err := os.Stat(absDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "stat %s", absDir)
+	}
+	if !info.IsDir() {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(absDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		name := objectName(dir, file.Name())
+		if file.IsDir() {
+			name += DirDelim
+		}
+
+		if err := f(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get implements Bucket interface.
+func (b *filesystemBucket) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(b.path(name))
+}
+
+// Exists implements Bucket interface.
+func (b *filesystemBucket) Exists(_ context.Context, name string) (bool, error) {
+	info, err := os.Stat(b.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "stat %s", name)
+	}
+
+	return !info.IsDir(), nil
+}
+
+// Name implements Bucket interface.
+func (b *filesystemBucket) Name() string {
+	return b.rootDir
+}
+
+// Close implements Bucket interface.
+func (b *filesystemBucket) Close() error {
+	return nil
+}
+
+// isDirEmpty returns true if the directory has no entries.
+func isDirEmpty(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+
+	return false, err
+}
@@ -0,0 +1,159 @@
+// Package objstore is the object storage abstraction modelled after
+// github.com/thanos-io/thanos/pkg/objstore, enough to upload generated
+// blocks to a bucket. Buckets are either local filesystem or Thanos
+// buckets of any provider Thanos supports.
+package objstore
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// DirDelim is the delimiter used to model a directory structure in an object store bucket.
+const DirDelim = "/"
+
+// Bucket provides read and write access to an object storage bucket.
+type Bucket interface {
+	io.Closer
+
+	// Upload the contents of the reader as an object into the bucket.
+	Upload(ctx context.Context, name string, r io.Reader) error
+
+	// Delete removes the object with the given name.
+	Delete(ctx context.Context, name string) error
+
+	// Iter calls f for each entry in the given directory, not recursive.
+	// The argument to f is the full object name including the prefix of
+	// the inspected directory. Directory names end with `DirDelim`.
+	Iter(ctx context.Context, dir string, f func(string) error) error
+
+	// Get returns a reader for the given object name.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// Exists checks if the given object exists in the bucket.
+	Exists(ctx context.Context, name string) (bool, error)
+
+	// Name returns the bucket name for the provider.
+	Name() string
+}
+
+// UploadDir uploads all files in srcdir to the bucket into directory
+// named dstdir. The file named `lastFile`, if any, is uploaded after all
+// other files, e.g. the block meta.json so that readers never see partially
+// uploaded block.
+func UploadDir(ctx context.Context, bkt Bucket, srcdir, dstdir, lastFile string) error {
+	df, err := os.Stat(srcdir)
+	if err != nil {
+		return errors.Wrap(err, "stat dir")
+	}
+	if !df.IsDir() {
+		return errors.Errorf("%s is not a directory", srcdir)
+	}
+
+	var last string
+	err = filepath.Walk(srcdir, func(src string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(srcdir, src)
+		if err != nil {
+			return err
+		}
+		if rel == lastFile {
+			last = src
+			return nil
+		}
+
+		return UploadFile(ctx, bkt, src, objectName(dstdir, rel))
+	})
+	if err != nil {
+		return err
+	}
+
+	if last != "" {
+		return UploadFile(ctx, bkt, last, objectName(dstdir, lastFile))
+	}
+
+	return nil
+}
+
+// VerifyDir checks that every file in srcdir exists in dstdir in the
+// bucket. The sizes are checked by `UploadFile` while uploading, as
+// object storages can't tell them without reading the object.
+func VerifyDir(ctx context.Context, bkt Bucket, srcdir, dstdir string) error {
+	return filepath.Walk(srcdir, func(src string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(srcdir, src)
+		if err != nil {
+			return err
+		}
+
+		name := objectName(dstdir, rel)
+		exists, err := bkt.Exists(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "check %s exists", name)
+		}
+		if !exists {
+			return errors.Errorf("%s does not exist", name)
+		}
+
+		return nil
+	})
+}
+
+// UploadFile uploads the file with the given name to the bucket, and
+// checks that the whole file was uploaded.
+func UploadFile(ctx context.Context, bkt Bucket, src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "open file %s", src)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "stat file %s", src)
+	}
+
+	r := &countingReader{r: f}
+	if err := bkt.Upload(ctx, dst, r); err != nil {
+		return errors.Wrapf(err, "upload file %s as %s", src, dst)
+	}
+
+	if r.n != fi.Size() {
+		return errors.Errorf("uploaded %d bytes of file %s as %s, want %d", r.n, src, dst, fi.Size())
+	}
+
+	return nil
+}
+
+// countingReader counts the bytes read from the reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// objectName converts relative file path into object name in the directory.
+func objectName(dir, rel string) string {
+	return path.Join(dir, filepath.ToSlash(rel))
+}
@@ -0,0 +1,149 @@
+package objstore
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestUploadDir(t *testing.T) {
+	ctx := context.Background()
+
+	tmp, err := ioutil.TempDir("", "objstore-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	bucketDir := filepath.Join(tmp, "bucket")
+	bkt, err := NewBucket(log.NewNopLogger(), []byte("type: FILESYSTEM\nconfig:\n  directory: " + bucketDir + "\n"))
+	if err != nil {
+		t.Fatalf("NewBucket: %v", err)
+	}
+
+	srcDir := filepath.Join(tmp, "src")
+	files := map[string]string{
+		"meta.json":         "{}",
+		"index":             "index data",
+		"chunks/000001":     "chunk data",
+		"chunks/000002.tmp": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(srcDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+
+	if err := UploadDir(ctx, bkt, srcDir, "block", "meta.json"); err != nil {
+		t.Fatalf("UploadDir: %v", err)
+	}
+
+	if err := VerifyDir(ctx, bkt, srcDir, "block"); err != nil {
+		t.Fatalf("VerifyDir: %v", err)
+	}
+
+	var names []string
+	if err := bkt.Iter(ctx, "block", func(name string) error {
+		names = append(names, name)
+		return nil
+	}); err != nil {
+		t.Fatalf("Iter: %v", err)
+	}
+	sort.Strings(names)
+
+	want := []string{"block/chunks/", "block/index", "block/meta.json"}
+	if len(names) != len(want) {
+		t.Fatalf("want %v, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, names)
+		}
+	}
+
+	if err := VerifyDir(ctx, bkt, srcDir, "block"); err != nil {
+		t.Fatalf("VerifyDir: %v", err)
+	}
+
+	// Delete one object, verification must notice.
+	if err := bkt.Delete(ctx, "block/chunks/000001"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if exists, _ := bkt.Exists(ctx, "block/chunks/000001"); exists {
+		t.Fatalf("object exists after Delete")
+	}
+	if err := VerifyDir(ctx, bkt, srcDir, "block"); err == nil {
+		t.Fatalf("want VerifyDir error, got nil")
+	}
+}
+
+func TestNewBucket_Errors(t *testing.T) {
+	configs := []string{
+		"type: S3\nconfig:\n  bucket: foo\n",
+		"type: NFS\nconfig:\n  directory: /tmp\n",
+		"type: FILESYSTEM\nconfig:\n  dir: /tmp\n",
+		"type: FILESYSTEM\nconfigs:\n  directory: /tmp\n",
+	}
+
+	for _, config := range configs {
+		if _, err := NewBucket(log.NewNopLogger(), []byte(config)); err == nil {
+			t.Errorf("want error for config %q, got nil", config)
+		}
+	}
+}
+
+func TestNewBucket_Thanos(t *testing.T) {
+	config := "type: S3\nconfig:\n  bucket: foo\n  endpoint: localhost:9000\n  access_key: key\n  secret_key: secret\n"
+	bkt, err := NewBucket(log.NewNopLogger(), []byte(config))
+	if err != nil {
+		t.Fatalf("NewBucket: %v", err)
+	}
+	defer bkt.Close()
+
+	if bkt.Name() != "foo" {
+		t.Errorf("want bucket foo, got %s", bkt.Name())
+	}
+}
+
+// shortBucket uploads only the first byte of every object.
+type shortBucket struct {
+	Bucket
+}
+
+func (b shortBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	return b.Bucket.Upload(ctx, name, io.LimitReader(r, 1))
+}
+
+func TestUploadFile_Short(t *testing.T) {
+	ctx := context.Background()
+
+	tmp, err := ioutil.TempDir("", "objstore-test")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "index")
+	if err := ioutil.WriteFile(src, []byte("index data"), 0666); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	bkt := inmem.NewBucket()
+	if err := UploadFile(ctx, bkt, src, "block/index"); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+
+	if err := UploadFile(ctx, shortBucket{bkt}, src, "block/index"); err == nil {
+		t.Errorf("want error for partially uploaded file")
+	}
+}
@@ -0,0 +1,127 @@
+package randval
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// DistType is the type of the random distribution.
+type DistType string
+
+const (
+	// Normal is the normal distribution with Mean and StdDev.
+	Normal DistType = "normal"
+
+	// LogNormal is the log-normal distribution. Mean and StdDev are the
+	// parameters of the underlying normal distribution, so the median of
+	// the values is exp(Mean).
+	LogNormal DistType = "lognormal"
+
+	// Bimodal is the mix of two normal distributions: (Mean, StdDev) and
+	// (Mean2, StdDev2). Values are drawn from the second one with
+	// probability Weight2.
+	Bimodal DistType = "bimodal"
+)
+
+// DistConfig is the configuration of random distribution, e.g. of request
+// latencies.
+type DistConfig struct {
+	Type   DistType `yaml:"type"`
+	Mean   float64  `yaml:"mean"`
+	StdDev float64  `yaml:"stdDev"`
+
+	// Mean2, StdDev2 and Weight2 are used by Bimodal only.
+	Mean2   float64 `yaml:"mean2"`
+	StdDev2 float64 `yaml:"stdDev2"`
+	Weight2 float64 `yaml:"weight2"`
+}
+
+// Validate checks the config is usable.
+func (c DistConfig) Validate() error {
+	switch c.Type {
+	case Normal, LogNormal:
+	case Bimodal:
+		if c.StdDev2 < 0 {
+			return errors.New("stdDev2 must not be negative")
+		}
+		if c.Weight2 < 0 || c.Weight2 > 1 {
+			return errors.New("weight2 must be in range [0, 1]")
+		}
+	default:
+		return fmt.Errorf("unknown distribution type '%s'", c.Type)
+	}
+
+	if c.StdDev < 0 {
+		return errors.New("stdDev must not be negative")
+	}
+
+	return nil
+}
+
+// Sample draws one value from the distribution using given random source.
+func (c DistConfig) Sample(r *rand.Rand) float64 {
+	switch c.Type {
+	case LogNormal:
+		return math.Exp(c.Mean + c.StdDev*r.NormFloat64())
+	case Bimodal:
+		if r.Float64() < c.Weight2 {
+			return c.Mean2 + c.StdDev2*r.NormFloat64()
+		}
+		return c.Mean + c.StdDev*r.NormFloat64()
+	default:
+		return c.Mean + c.StdDev*r.NormFloat64()
+	}
+}
+
+// CDF returns the probability of a value not greater than x.
+func (c DistConfig) CDF(x float64) float64 {
+	switch c.Type {
+	case LogNormal:
+		if x <= 0 {
+			return 0
+		}
+		return normalCDF(math.Log(x), c.Mean, c.StdDev)
+	case Bimodal:
+		return (1-c.Weight2)*normalCDF(x, c.Mean, c.StdDev) + c.Weight2*normalCDF(x, c.Mean2, c.StdDev2)
+	default:
+		return normalCDF(x, c.Mean, c.StdDev)
+	}
+}
+
+// PositiveMean returns the mean of the values with negative values
+// taken as zero.
+func (c DistConfig) PositiveMean() float64 {
+	switch c.Type {
+	case LogNormal:
+		return math.Exp(c.Mean + c.StdDev*c.StdDev/2)
+	case Bimodal:
+		return (1-c.Weight2)*normalPositiveMean(c.Mean, c.StdDev) + c.Weight2*normalPositiveMean(c.Mean2, c.StdDev2)
+	default:
+		return normalPositiveMean(c.Mean, c.StdDev)
+	}
+}
+
+// normalCDF is CDF of the normal distribution.
+func normalCDF(x, mean, stdDev float64) float64 {
+	if stdDev == 0 {
+		if x < mean {
+			return 0
+		}
+		return 1
+	}
+
+	return (1 + math.Erf((x-mean)/(stdDev*math.Sqrt2))) / 2
+}
+
+// normalPositiveMean is the mean of max(X, 0) for normal X.
+func normalPositiveMean(mean, stdDev float64) float64 {
+	if stdDev == 0 {
+		return math.Max(mean, 0)
+	}
+
+	z := mean / stdDev
+	pdf := math.Exp(-z*z/2) / math.Sqrt(2*math.Pi)
+	return mean*normalCDF(z, 0, 1) + stdDev*pdf
+}
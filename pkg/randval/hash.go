@@ -0,0 +1,56 @@
+package randval
+
+// Uint64 returns the n-th pseudo-random number of the stream with given seed.
+// Unlike `math/rand`, any number of the stream is calculated in constant time,
+// which lets sequences derive their values from the sequence number.
+func Uint64(seed, n int64) uint64 {
+	return mix64(uint64(seed) ^ mix64(uint64(n)))
+}
+
+// Float64 returns the n-th pseudo-random number of the stream with given seed
+// as float in range [0, 1).
+func Float64(seed, n int64) float64 {
+	return float64(Uint64(seed, n)>>11) / (1 << 53)
+}
+
+// NewSource returns `rand.Source64` which returns the numbers of the stream
+// with given seed, see `Uint64`. Unlike `rand.NewSource` it's cheap to
+// create and reseed, e.g. for every series at every sample.
+func NewSource(seed int64) *Source {
+	return &Source{seed: seed}
+}
+
+// Source is implementation of `rand.Source64`, see `NewSource`.
+type Source struct {
+	seed int64
+	n    int64
+}
+
+// Int63 implements rand.Source interface.
+func (s *Source) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// Uint64 implements rand.Source64 interface.
+func (s *Source) Uint64() uint64 {
+	res := Uint64(s.seed, s.n)
+	s.n++
+	return res
+}
+
+// Seed implements rand.Source interface.
+func (s *Source) Seed(seed int64) {
+	s.seed = seed
+	s.n = 0
+}
+
+// mix64 is the finalizer of splitmix64, which maps every input to
+// a well-mixed output.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -3,7 +3,6 @@ package randval
 
 import (
 	"math"
-	"math/rand"
 )
 
 // Val is the numeric value with sequence number.
@@ -20,6 +19,14 @@ type ValSeq interface {
 	Next() Val
 }
 
+// SeqSeeker is implemented by `ValSeq` which can seek without making
+// the values before the wanted one.
+type SeqSeeker interface {
+	// SeekSeq makes the next call to `Next` return the value with given
+	// sequence number.
+	SeekSeq(seq int64)
+}
+
 // Config is the configuration for the value generators.
 type Config struct {
 	MinValue float64 `yaml:"minValue"`
@@ -32,14 +39,12 @@ type Config struct {
 	MaxChangeValue float64 `yaml:"changeBaseValue"`
 
 	// ChangeRandSeed is the random number generator seed
-	// for generating the sequence of changes. Use `0` for
-	// the seed based on current time and completely random
-	// sequences.
+	// for generating the sequence of changes. The same seed
+	// gives the same sequence.
 	ChangeRandSeed int64 `yaml:"changeRandSeed"`
 }
 
 // DefaultConfig returns a copy of default config.
-// The random seed is based on current time.
 func DefaultConfig() Config {
 	return Config{
 		MinValue:       0,
@@ -50,74 +55,76 @@ func DefaultConfig() Config {
 }
 
 // NewRandCounterVal creates new random counter sequence.
+//
+// The counter increases by random amount in range [0, MaxChangeValue] at
+// every step and is reset to about MinValue when it would go above MaxValue.
+// The sequence implements `SeqSeeker`.
 func NewRandCounterVal(config Config) ValSeq {
-	changeRandSource := rand.NewSource(config.ChangeRandSeed)
-	changeRand := rand.New(changeRandSource)
-
 	return &randCounterValT{
 		config: config,
-		currentValue: Val{
-			Seq: 0,
-			Val: config.MinValue,
-		},
-		changeRand: changeRand,
+		walk:   newWalk(config.ChangeRandSeed, 0, config.MaxChangeValue),
 	}
 }
 
 // NewRandGaugeVal creates new random gauge sequence.
+//
+// The gauge starts at MinValue and changes by random amount in range
+// [-MaxChangeValue, +MaxChangeValue] at every step, bouncing off MinValue
+// and MaxValue. The sequence implements `SeqSeeker`.
 func NewRandGaugeVal(config Config) ValSeq {
-	changeRandSource := rand.NewSource(config.ChangeRandSeed)
-	changeRand := rand.New(changeRandSource)
-
 	return &randGaugeValT{
 		config: config,
-		currentValue: Val{
-			Seq: 0,
-			Val: config.MinValue,
-		},
-		changeRand: changeRand,
+		walk:   newWalk(config.ChangeRandSeed, -config.MaxChangeValue, config.MaxChangeValue),
 	}
 }
 
 // randCounterValT implements counter `ValSeq`: monotonic increase in value.
 type randCounterValT struct {
-	config       Config
-	currentValue Val
-	changeRand   *rand.Rand
+	config Config
+	walk   *walk
 }
 
 func (c *randCounterValT) Next() Val {
-	// monotonic increase like so:
-	//  nextValue = currentValue + (rand baseChange)
-	actualChange := c.config.MaxChangeValue * c.changeRand.Float64()
-	nextValue := c.currentValue.Val + actualChange
+	total := c.walk.next()
 
 	// reset to min if out of bounds
-	if nextValue > c.config.MaxValue || nextValue < c.config.MinValue {
-		nextValue = c.config.MinValue
+	return Val{
+		Seq: c.walk.seq,
+		Val: c.config.MinValue + math.Mod(total, c.config.MaxValue-c.config.MinValue),
 	}
+}
 
-	c.currentValue.Seq += 1
-	c.currentValue.Val = nextValue
-	return c.currentValue
+// SeekSeq implements SeqSeeker interface.
+func (c *randCounterValT) SeekSeq(seq int64) {
+	c.walk.seek(seq)
 }
 
-// randCounterValT implements gauge `ValSeq`: value which goes between min and max.
+// randGaugeValT implements gauge `ValSeq`: value which goes between min and max.
 type randGaugeValT struct {
-	config       Config
-	currentValue Val
-	changeRand   *rand.Rand
+	config Config
+	walk   *walk
 }
 
 func (c *randGaugeValT) Next() Val {
-	// fluctuate like so:
-	//  nextValue = currentValue +/- (baseChange +/- jitter)
-	actualChange := c.config.MaxChangeValue * 2 * (c.changeRand.Float64() - 0.5)
-	nextValue := c.currentValue.Val + actualChange
-	nextValue = math.Min(nextValue, c.config.MaxValue)
-	nextValue = math.Max(nextValue, c.config.MinValue)
-
-	c.currentValue.Seq += 1
-	c.currentValue.Val = nextValue
-	return c.currentValue
+	offset := c.walk.next()
+
+	// fold the walk into range so that it bounces off min and max
+	width := c.config.MaxValue - c.config.MinValue
+	offset = math.Mod(offset, 2*width)
+	if offset < 0 {
+		offset += 2 * width
+	}
+	if offset > width {
+		offset = 2*width - offset
+	}
+
+	return Val{
+		Seq: c.walk.seq,
+		Val: c.config.MinValue + offset,
+	}
+}
+
+// SeekSeq implements SeqSeeker interface.
+func (c *randGaugeValT) SeekSeq(seq int64) {
+	c.walk.seek(seq)
 }
@@ -2,6 +2,7 @@ package randval
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"testing"
 )
@@ -41,3 +42,68 @@ func Test_randGaugeValT_Next(t *testing.T) {
 		fmt.Fprintf(os.Stdout, "Gauge %d: %d\n", val.Seq, int(val.Val))
 	}
 }
+
+func Test_randGaugeValT_SeekSeq(t *testing.T) {
+	config := Config{
+		MinValue:       10,
+		MaxValue:       100,
+		MaxChangeValue: 18,
+		ChangeRandSeed: 86755,
+	}
+
+	var values []Val
+	gauge := NewRandGaugeVal(config)
+	for i := 0; i < 1000; i++ {
+		values = append(values, gauge.Next())
+	}
+
+	prev := config.MinValue
+	for _, v := range values {
+		if v.Val < config.MinValue || v.Val > config.MaxValue {
+			t.Fatalf("value %d out of range: %f", v.Seq, v.Val)
+		}
+		if change := math.Abs(v.Val - prev); change > config.MaxChangeValue+1e-9 {
+			t.Fatalf("value %d changed by %f", v.Seq, change)
+		}
+		prev = v.Val
+	}
+
+	for _, seq := range []int64{1, 63, 64, 65, 500, 1000} {
+		gauge := NewRandGaugeVal(config)
+		gauge.(SeqSeeker).SeekSeq(seq)
+		if got, want := gauge.Next(), values[seq-1]; got != want {
+			t.Fatalf("seek to %d: want %v, got %v", seq, want, got)
+		}
+	}
+}
+
+func Test_randCounterValT_SeekSeq(t *testing.T) {
+	config := Config{
+		MinValue:       10,
+		MaxValue:       1000,
+		MaxChangeValue: 18,
+		ChangeRandSeed: 156,
+	}
+
+	var values []Val
+	counter := NewRandCounterVal(config)
+	for i := 0; i < 1000; i++ {
+		values = append(values, counter.Next())
+	}
+
+	prev := config.MinValue
+	for _, v := range values {
+		if change := v.Val - prev; change > config.MaxChangeValue+1e-9 || (change < 0 && v.Val > config.MinValue+config.MaxChangeValue) {
+			t.Fatalf("value %d changed by %f", v.Seq, change)
+		}
+		prev = v.Val
+	}
+
+	for _, seq := range []int64{1, 63, 64, 65, 500, 1000} {
+		counter := NewRandCounterVal(config)
+		counter.(SeqSeeker).SeekSeq(seq)
+		if got, want := counter.Next(), values[seq-1]; got != want {
+			t.Fatalf("seek to %d: want %v, got %v", seq, want, got)
+		}
+	}
+}
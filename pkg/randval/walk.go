@@ -0,0 +1,160 @@
+package randval
+
+import (
+	"math"
+)
+
+const (
+	// walkSegmentSteps is the number of steps of one walk segment.
+	walkSegmentSteps = 64
+
+	// walkDepth is the depth of the tree of segment totals, the walk
+	// has 2^walkDepth segments.
+	walkDepth = 40
+)
+
+// walk is the random walk with steps in range [lo, hi] which can seek to
+// any step without making the steps before it.
+//
+// The steps are split into segments. The totals of segments are drawn top
+// down from the binary tree: the total of the node is split between its
+// children by the random amount which has the same distribution as if the
+// steps were summed. This gives the value at the start of any segment in
+// walkDepth steps. Within the segment, the steps are random in range [lo, hi]
+// and moved towards one of the bounds just enough to add up to the total of
+// the segment, so they stay in range.
+type walk struct {
+	seed     int64
+	treeSeed int64
+	lo, hi   float64
+
+	// seq is the number of steps made, x is the value after them.
+	seq int64
+	x   float64
+
+	// loaded is false when the segment of the next step is yet to be
+	// loaded, e.g. after seek.
+	loaded bool
+
+	// segment is the index of the loaded segment, up tells whether its
+	// steps are moved up or down by fraction move of the distance to
+	// the bound.
+	segment int64
+	up      bool
+	move    float64
+}
+
+func newWalk(seed int64, lo, hi float64) *walk {
+	return &walk{
+		seed:     seed,
+		treeSeed: int64(Uint64(seed, -1)),
+		lo:       lo,
+		hi:       hi,
+	}
+}
+
+// next makes the step and returns the new value.
+func (w *walk) next() float64 {
+	w.seq++
+
+	segment := (w.seq - 1) / walkSegmentSteps
+	if !w.loaded || segment != w.segment {
+		w.load(segment)
+	}
+
+	w.x += w.step(w.seq)
+	return w.x
+}
+
+// seek makes the next step the one with given number.
+func (w *walk) seek(seq int64) {
+	w.seq = seq - 1
+	w.loaded = false
+}
+
+// load prepares the segment and catches up with the steps made in it.
+func (w *walk) load(segment int64) {
+	start, total := w.segmentTotal(segment)
+
+	first := segment*walkSegmentSteps + 1
+	sum := 0.0
+	for i := first; i < first+walkSegmentSteps; i++ {
+		sum += w.rawStep(i)
+	}
+
+	w.segment = segment
+	w.up = total >= sum
+	if w.up {
+		w.move = fraction(total-sum, walkSegmentSteps*w.hi-sum)
+	} else {
+		w.move = fraction(sum-total, sum-walkSegmentSteps*w.lo)
+	}
+	w.loaded = true
+
+	w.x = start
+	for i := first; i < w.seq; i++ {
+		w.x += w.step(i)
+	}
+}
+
+// segmentTotal returns the value at the start of the segment and the total
+// of its steps.
+func (w *walk) segmentTotal(segment int64) (start, total float64) {
+	variance := (w.hi - w.lo) * (w.hi - w.lo) / 12
+	steps := float64(walkSegmentSteps) * (1 << walkDepth)
+
+	total = steps*(w.lo+w.hi)/2 + math.Sqrt(steps*variance)*w.normal(0)
+	total = math.Max(steps*w.lo, math.Min(steps*w.hi, total))
+
+	node := int64(1)
+	for level := walkDepth - 1; level >= 0; level-- {
+		// Both halves must stay reachable with their number of steps.
+		half := steps / 2
+		limit := math.Min(total/2-half*w.lo, half*w.hi-total/2)
+		delta := math.Sqrt(steps*variance) / 2 * w.normal(node)
+		left := total/2 + math.Max(-limit, math.Min(limit, delta))
+
+		node *= 2
+		if segment>>uint(level)&1 == 1 {
+			node++
+			start += left
+			total -= left
+		} else {
+			total = left
+		}
+		steps = half
+	}
+
+	return start, total
+}
+
+// rawStep returns the random step with given number before moving it
+// towards the segment total.
+func (w *walk) rawStep(seq int64) float64 {
+	return w.lo + (w.hi-w.lo)*Float64(w.seed, seq)
+}
+
+// step returns the step with given number of the loaded segment.
+func (w *walk) step(seq int64) float64 {
+	s := w.rawStep(seq)
+	if w.up {
+		return s + (w.hi-s)*w.move
+	}
+	return s - (s-w.lo)*w.move
+}
+
+// normal returns the normally distributed random number of the tree node,
+// using Box-Muller transform.
+func (w *walk) normal(node int64) float64 {
+	u1 := Float64(w.treeSeed, 2*node)
+	u2 := Float64(w.treeSeed, 2*node+1)
+	return math.Sqrt(-2*math.Log(1-u1)) * math.Cos(2*math.Pi*u2)
+}
+
+// fraction returns a/b limited to range [0, 1].
+func fraction(a, b float64) float64 {
+	if b <= 0 {
+		return 0
+	}
+	return math.Max(0, math.Min(1, a/b))
+}